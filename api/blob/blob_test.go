@@ -0,0 +1,53 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+var ctx = context.Background()
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+
+	if err := s.Put(ctx, "file.txt", strings.NewReader("hello")); err != nil {
+		t.Fatalf("Put() got %v, wanted nil", err)
+	}
+	_ = s.Put(ctx, "file.txt", strings.NewReader("goodbye"))
+	r, err := s.Open(ctx, "file.txt")
+	if err != nil {
+		t.Fatalf("Open() got %v, wanted nil", err)
+	}
+	d, _ := io.ReadAll(r)
+	_ = r.Close()
+	if string(d) != "goodbye" {
+		t.Errorf("Open() got %q, wanted %q", d, "goodbye")
+	}
+
+	if err := s.Delete(ctx, "file.txt"); err != nil {
+		t.Errorf("Delete() got %v, wanted nil", err)
+	}
+	if _, err := s.Open(ctx, "file.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open() after Delete() got %v, wanted %v", err, ErrNotFound)
+	}
+	if err := s.Delete(ctx, "file.txt"); err != nil {
+		t.Errorf("Delete() on missing blob got %v, wanted nil", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("store left %v files behind, wanted none", len(entries))
+	}
+
+	for _, key := range []string{"", "../escape", "a/b", ".hidden"} {
+		if err := s.Put(ctx, key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) got %v, wanted %v", key, err, ErrInvalidKey)
+		}
+	}
+}
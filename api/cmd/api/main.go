@@ -2,45 +2,269 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/intrntsrfr/vue-ws-test/blob"
 	"github.com/intrntsrfr/vue-ws-test/database"
 	"github.com/intrntsrfr/vue-ws-test/handler"
+	"github.com/intrntsrfr/vue-ws-test/ratelimit"
+	"github.com/intrntsrfr/vue-ws-test/util"
 	"os"
 
 	api "github.com/intrntsrfr/vue-ws-test"
 )
 
 type Config struct {
-	JWTKey string `json:"jwt_key"`
+	JWTKey          string        `json:"jwt_key"`
+	AccessTokenTTL  util.Duration `json:"access_token_ttl"`
+	RefreshTokenTTL util.Duration `json:"refresh_token_ttl"`
+	// BcryptCost is the cost passwords are hashed with. Changing it rehashes
+	// passwords the next time their users log in.
+	BcryptCost        int                   `json:"bcrypt_cost"`
+	CredentialPolicy  *api.CredentialPolicy `json:"credential_policy"`
+	HeartbeatInterval util.Duration         `json:"heartbeat_interval"`
+	// SendQueueSize is how many events may wait to be sent to a websocket
+	// client. Clients that fall further behind are disconnected, or miss
+	// events if DropSlowClientEvents is set.
+	SendQueueSize        int  `json:"send_queue_size"`
+	DropSlowClientEvents bool `json:"drop_slow_client_events"`
+	// ResumeWindow is how long disconnected websocket sessions can be
+	// resumed for, keeping at most ReplayBufferSize events.
+	ResumeWindow     util.Duration `json:"resume_window"`
+	ReplayBufferSize int           `json:"replay_buffer_size"`
+	// TypingTimeout is how long typing indicators last without being renewed
+	TypingTimeout util.Duration `json:"typing_timeout"`
+	// IdleTimeout is how long users can be inactive before they turn idle
+	IdleTimeout util.Duration `json:"idle_timeout"`
+	// Database is either "json" or "sqlite", and is stored at DatabasePath
+	Database     string `json:"database"`
+	DatabasePath string `json:"database_path"`
+	// AttachmentsPath is the directory uploaded attachments are kept in
+	AttachmentsPath   string   `json:"attachments_path"`
+	MaxAttachmentSize int64    `json:"max_attachment_size"`
+	AttachmentTypes   []string `json:"attachment_types"`
+	// AttachmentURLTTL is how long links to download attachments work for
+	AttachmentURLTTL util.Duration `json:"attachment_url_ttl"`
+	// UnattachedAttachmentTTL is how long uploads are kept for without being
+	// sent with a message
+	UnattachedAttachmentTTL util.Duration `json:"unattached_attachment_ttl"`
+	// RateLimits changes the default limits on routes and websocket events
+	RateLimits *RateLimitsConfig `json:"rate_limits"`
+	// LoginLockout decides how long logins have to wait after failing
+	LoginLockout *LockoutConfig `json:"login_lockout"`
+	// TrustedProxies are the proxies allowed to pass on the address of
+	// clients in X-Forwarded-For, as addresses or CIDR networks
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// LockoutConfig is handler.LockoutConfig as it is written in the config file
+type LockoutConfig struct {
+	FreeAttempts    int           `json:"free_attempts"`
+	BaseDelay       util.Duration `json:"base_delay"`
+	MaxDelay        util.Duration `json:"max_delay"`
+	Threshold       int           `json:"threshold"`
+	IPThreshold     int           `json:"ip_threshold"`
+	LockoutDuration util.Duration `json:"lockout_duration"`
+}
+
+// RateLimit allows Burst requests at once, and one more every Interval. A
+// burst of 0 removes the limit.
+type RateLimit struct {
+	Burst    int           `json:"burst"`
+	Interval util.Duration `json:"interval"`
+}
+
+// RateLimitsConfig has limits by route, such as "POST /api/messages/", and by
+// websocket event, such as "typing".
+type RateLimitsConfig struct {
+	Routes map[string]RateLimit `json:"routes"`
+	Events map[string]RateLimit `json:"events"`
+}
+
+// rateLimits returns the default limits, changed by the ones in the config.
+func rateLimits(config *Config) (*handler.RateLimitConfig, error) {
+	limits := handler.DefaultRateLimits()
+	if config.RateLimits == nil {
+		return limits, nil
+	}
+	for route, l := range config.RateLimits.Routes {
+		limits.Routes[route] = ratelimit.Limit{Burst: l.Burst, Interval: l.Interval.Duration}
+	}
+	for name, l := range config.RateLimits.Events {
+		op, ok := handler.ParseOpCode(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown websocket event %q in rate_limits", name)
+		}
+		limits.Events[op] = ratelimit.Limit{Burst: l.Burst, Interval: l.Interval.Duration}
+	}
+	return limits, nil
+}
+
+// store is a database that the server can close when it stops.
+type store interface {
+	database.DB
+	Close() error
+}
+
+// databasePath returns where the database chosen in the config is stored.
+func databasePath(config *Config) string {
+	if config.DatabasePath != "" {
+		return config.DatabasePath
+	}
+	if config.Database == "sqlite" {
+		return "./data.db"
+	}
+	return "./data.json"
+}
+
+// openDatabase opens the database chosen in the config.
+func openDatabase(config *Config) (store, error) {
+	switch config.Database {
+	case "", "json":
+		return database.Open(databasePath(config))
+	case "sqlite":
+		return database.OpenSQLite(databasePath(config))
+	default:
+		return nil, fmt.Errorf("unknown database %q, use json or sqlite", config.Database)
+	}
+}
+
+// dryRunMigrations prints the migrations the database chosen in the config
+// needs, without applying them.
+func dryRunMigrations(config *Config) error {
+	var (
+		migrations []database.Migration
+		err        error
+	)
+	switch config.Database {
+	case "", "json":
+		migrations, err = database.DryRunJSON(databasePath(config))
+	case "sqlite":
+		migrations, err = database.DryRunSQLite(databasePath(config))
+	default:
+		return fmt.Errorf("unknown database %q, use json or sqlite", config.Database)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(migrations) == 0 {
+		fmt.Println("database is up to date")
+		return nil
+	}
+	fmt.Println("database needs these migrations:")
+	for _, m := range migrations {
+		fmt.Println(" ", m)
+	}
+	return nil
 }
 
 func main() {
+	dryRun := flag.Bool("migrate-dry-run", false, "print the migrations the database needs and exit")
+	flag.Parse()
+
 	file, err := os.ReadFile("./config.json")
 	if err != nil {
 		panic("config file not found")
 	}
-	var config *Config
-	err = json.Unmarshal(file, &config)
+	// fields missing from the file keep their defaults
+	config := &Config{
+		CredentialPolicy: api.DefaultCredentialPolicy(),
+		AttachmentsPath:  "./attachments",
+	}
+	err = json.Unmarshal(file, config)
 	if err != nil {
 		panic("mangled config file, fix it")
 	}
 
+	if *dryRun {
+		if err := dryRunMigrations(config); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// dependencies
-	db, err := database.Open("./data.json")
+	db, err := openDatabase(config)
 	if err != nil {
 		panic(err)
 	}
-	defer func(db *database.JsonDB) {
+	defer func(db store) {
 		err := db.Close()
 		if err != nil {
 			fmt.Println(err)
 		}
 	}(db)
 
-	jwtUtil := api.NewJWTUtil([]byte(config.JWTKey))
+	jwtUtil := api.NewJWTUtil(&api.JWTConfig{
+		Key:             []byte(config.JWTKey),
+		AccessTokenTTL:  config.AccessTokenTTL.Duration,
+		RefreshTokenTTL: config.RefreshTokenTTL.Duration,
+		Revocations:     db,
+	})
+	passwordUtil, err := api.NewPasswordUtil(config.BcryptCost)
+	if err != nil {
+		panic(err)
+	}
+	blobs, err := blob.NewFileStore(config.AttachmentsPath)
+	if err != nil {
+		panic(err)
+	}
+
+	limits, err := rateLimits(config)
+	if err != nil {
+		panic(err)
+	}
+	limiters := handler.NewRateLimiters(limits)
+
+	var lockout *handler.LockoutConfig
+	if l := config.LoginLockout; l != nil {
+		lockout = &handler.LockoutConfig{
+			FreeAttempts:    l.FreeAttempts,
+			BaseDelay:       l.BaseDelay.Duration,
+			MaxDelay:        l.MaxDelay.Duration,
+			Threshold:       l.Threshold,
+			IPThreshold:     l.IPThreshold,
+			LockoutDuration: l.LockoutDuration.Duration,
+		}
+	}
+	logins := handler.NewLoginTracker(lockout)
+
+	slowClientPolicy := handler.DisconnectSlowClients
+	if config.DropSlowClientEvents {
+		slowClientPolicy = handler.DropSlowClientEvents
+	}
 
 	// server
-	h := handler.NewHandler(&handler.Config{JwtUtil: jwtUtil, DB: db})
+	h, err := handler.NewHandler(&handler.Config{
+		JwtUtil:          jwtUtil,
+		PasswordUtil:     passwordUtil,
+		CredentialPolicy: config.CredentialPolicy,
+		DB:               db,
+		RateLimiters:     limiters,
+		Logins:           logins,
+		Blobs:            blobs,
+		Attachments: &handler.AttachmentConfig{
+			MaxSize:       config.MaxAttachmentSize,
+			AllowedTypes:  config.AttachmentTypes,
+			UnattachedTTL: config.UnattachedAttachmentTTL.Duration,
+		},
+		Hub: &handler.HubConfig{
+			HeartbeatInterval: config.HeartbeatInterval.Duration,
+			SendQueueSize:     config.SendQueueSize,
+			SlowClientPolicy:  slowClientPolicy,
+			ResumeWindow:      config.ResumeWindow.Duration,
+			ReplayBufferSize:  config.ReplayBufferSize,
+			TypingTimeout:     config.TypingTimeout.Duration,
+			IdleTimeout:       config.IdleTimeout.Duration,
+			URLSigner:         api.NewURLSigner([]byte(config.JWTKey), config.AttachmentURLTTL.Duration),
+		},
+		TrustedProxies: config.TrustedProxies,
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	// run server
 	// this will block
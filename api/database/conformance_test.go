@@ -0,0 +1,42 @@
+package database_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/database/dbtest"
+)
+
+func TestJsonDB_Conformance(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) database.DB {
+		db, err := database.Open("")
+		if err != nil {
+			t.Fatalf("encountered error: %v", err)
+		}
+		return db
+	})
+}
+
+// the journal is only written when there is a data file
+func TestJsonDB_ConformanceOnDisk(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) database.DB {
+		db, err := database.Open(filepath.Join(t.TempDir(), "data.json"))
+		if err != nil {
+			t.Fatalf("encountered error: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	})
+}
+
+func TestSQLiteDB_Conformance(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) database.DB {
+		db, err := database.OpenSQLite("")
+		if err != nil {
+			t.Fatalf("encountered error: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	})
+}
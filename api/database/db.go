@@ -1,17 +1,199 @@
 package database
 
 import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/intrntsrfr/vue-ws-test/search"
 	"github.com/intrntsrfr/vue-ws-test/structs"
 )
 
+var (
+	// ErrNotFound is wrapped by every error about something that does not
+	// exist, so that callers can tell them apart from failures.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is wrapped by every error about something that clashes with
+	// what is already stored.
+	ErrConflict = errors.New("conflict")
+
+	ErrUserNotFound       = &kindError{"user not found", ErrNotFound}
+	ErrMessageNotFound    = &kindError{"message not found", ErrNotFound}
+	ErrChannelNotFound    = &kindError{"channel not found", ErrNotFound}
+	ErrTokenNotFound      = &kindError{"token not found", ErrNotFound}
+	ErrAttachmentNotFound = &kindError{"attachment not found", ErrNotFound}
+	ErrSanctionNotFound   = &kindError{"sanction not found", ErrNotFound}
+	ErrAuditEntryNotFound = &kindError{"audit log entry not found", ErrNotFound}
+	ErrUsernameTaken      = &kindError{"username already taken", ErrConflict}
+	ErrDirectChannelTaken = &kindError{"there already is a direct message between these users", ErrConflict}
+
+	// ErrSchemaTooNew is returned when stored data was written by a newer
+	// version than this one, which does not know how to read it.
+	ErrSchemaTooNew = errors.New("schema version too new")
+)
+
+// kindError is an error with a message of its own, that is also of a more
+// general kind, such as ErrNotFound.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// directPair returns the two members of a DM in a fixed order, so that a DM
+// is known by the same pair whoever opens it.
+func directPair(memberIDs []string) (string, string, error) {
+	if len(memberIDs) != 2 || memberIDs[0] == memberIDs[1] {
+		return "", "", errors.New("a direct message needs two different members")
+	}
+	if memberIDs[0] < memberIDs[1] {
+		return memberIDs[0], memberIDs[1], nil
+	}
+	return memberIDs[1], memberIDs[0], nil
+}
+
+// MessageCursor is a place in the history of a channel to page from. Messages
+// are ordered by timestamp and then by ID, so a cursor with the ID of a
+// message sits between the messages sent at the same instant. A cursor with
+// only a timestamp sits at every message sent then, which are neither before
+// nor after it.
+type MessageCursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// AuditQuery picks a page of entries from the audit log. Empty fields match
+// every entry.
+type AuditQuery struct {
+	Action   structs.AuditAction
+	ActorID  string
+	TargetID string
+	// Before is the ID of an entry, to only return those recorded before it
+	Before string
+	Limit  int
+}
+
+// DB stores everything the server knows. Every method can fail, for example
+// when ctx is cancelled. Methods that look something up return an error
+// wrapping ErrNotFound if it does not exist, and those that store something
+// return one wrapping ErrConflict if it clashes with what is already there.
 type DB interface {
-	CreateUser(u *structs.User) (*structs.User, error)
-	FindUserByID(id string) *structs.User
-	FindUserByUsername(username string) *structs.User
+	// CreateUser stores a new user. Usernames are unique.
+	CreateUser(ctx context.Context, u *structs.User) (*structs.User, error)
+	UpdateUser(ctx context.Context, u *structs.User) (*structs.User, error)
+	FindUserByID(ctx context.Context, id string) (*structs.User, error)
+	FindUserByUsername(ctx context.Context, username string) (*structs.User, error)
+	// CountUsers returns how many users there are.
+	CountUsers(ctx context.Context) (int, error)
+	// ClaimOwnership makes a user the owner if there is none yet, and reports
+	// whether it did. Only one of the users claiming it at once gets it.
+	ClaimOwnership(ctx context.Context, userID string) (bool, error)
+
+	CreateChannel(ctx context.Context, channel *structs.Channel) (*structs.Channel, error)
+	// CreateChannelWithMembers creates a channel along with its members, all
+	// or nothing. There can only be one DM between two users, so creating
+	// another returns ErrDirectChannelTaken.
+	CreateChannelWithMembers(ctx context.Context, channel *structs.Channel, memberIDs []string) (*structs.Channel, error)
+	UpdateChannel(ctx context.Context, channel *structs.Channel) (*structs.Channel, error)
+	// DeleteChannel removes a channel along with its messages and members.
+	DeleteChannel(ctx context.Context, id string) error
+	FindChannelByID(ctx context.Context, id string) (*structs.Channel, error)
+	// GetChannels returns the public channels.
+	GetChannels(ctx context.Context) ([]*structs.Channel, error)
+	// FindDirectChannel returns the DM channel between two users, as created
+	// by CreateChannelWithMembers.
+	FindDirectChannel(ctx context.Context, userID, otherID string) (*structs.Channel, error)
+
+	AddChannelMember(ctx context.Context, channelID, userID string) error
+	RemoveChannelMember(ctx context.Context, channelID, userID string) error
+	IsChannelMember(ctx context.Context, channelID, userID string) (bool, error)
+	GetChannelMembers(ctx context.Context, channelID string) ([]*structs.User, error)
+	// GetUserChannels returns every channel a user is a member of, including
+	// private conversations.
+	GetUserChannels(ctx context.Context, userID string) ([]*structs.Channel, error)
+
+	CreateMessage(ctx context.Context, message *structs.Message) (*structs.Message, error)
+	UpdateMessage(ctx context.Context, message *structs.Message) (*structs.Message, error)
+	DeleteMessage(ctx context.Context, id string) error
+	FindMessageByID(ctx context.Context, id string) (*structs.Message, error)
+	// GetRecentMessages returns the newest messages in a channel, oldest first.
+	GetRecentMessages(ctx context.Context, channelID string, limit int) ([]*structs.Message, error)
+	// GetMessagesBefore returns the messages in a channel right before the
+	// cursor, oldest first.
+	GetMessagesBefore(ctx context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error)
+	// GetMessagesAfter returns the messages in a channel right after the
+	// cursor, oldest first.
+	GetMessagesAfter(ctx context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error)
+	// GetMessagesAround returns the messages in a channel around the cursor,
+	// oldest first. About half of them are before it, and the rest at or
+	// after it.
+	GetMessagesAround(ctx context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error)
+
+	CreateRefreshToken(ctx context.Context, token *structs.RefreshToken) (*structs.RefreshToken, error)
+	FindRefreshToken(ctx context.Context, hash string) (*structs.RefreshToken, error)
+	DeleteRefreshToken(ctx context.Context, hash string) error
+	// DeleteUserRefreshTokens deletes every refresh token of a user.
+	DeleteUserRefreshTokens(ctx context.Context, userID string) error
+
+	// RevokeToken adds the ID of an access token to the revocation list. It
+	// only needs to be remembered until the token expires.
+	RevokeToken(ctx context.Context, id string, expires time.Time) error
+	IsTokenRevoked(ctx context.Context, id string) (bool, error)
+	// RevokeUserTokens revokes every access token of a user issued so far, by
+	// moving their token version up by one.
+	RevokeUserTokens(ctx context.Context, userID string) error
+	// UserTokenVersion returns the version the access tokens of a user have
+	// to carry, which is 0 until their tokens are first revoked.
+	UserTokenVersion(ctx context.Context, userID string) (int, error)
+
+	// CreateReaction adds the reaction of a user to a message, and reports
+	// whether it was added. Reacting twice with the same emoji is a no-op.
+	CreateReaction(ctx context.Context, messageID string, user *structs.User, emoji string) (bool, error)
+	// DeleteReaction removes the reaction of a user from a message, and
+	// reports whether there was anything to remove.
+	DeleteReaction(ctx context.Context, messageID string, user *structs.User, emoji string) (bool, error)
+
+	// SetReadState stores the last message a user has read in a channel, if
+	// it was sent after the one stored before it. It reports whether it was
+	// stored, as read states only ever move forward.
+	SetReadState(ctx context.Context, state *structs.ReadState) (bool, error)
+	// GetReadStates returns the last message a user has read in every channel
+	// they have read anything in.
+	GetReadStates(ctx context.Context, userID string) ([]*structs.ReadState, error)
+	// CountMessagesAfter counts the messages in a channel sent after t by
+	// anyone but the given user, and how many of those mention them, going by
+	// search.Mentions.
+	CountMessagesAfter(ctx context.Context, channelID, userID string, t time.Time, mention string) (count, mentions int, err error)
+
+	// CreateAttachment stores an uploaded attachment. It returns
+	// ErrChannelNotFound if the channel it was uploaded to does not exist.
+	// Attachments are deleted along with their channel.
+	CreateAttachment(ctx context.Context, attachment *structs.Attachment) (*structs.Attachment, error)
+	FindAttachmentByID(ctx context.Context, id string) (*structs.Attachment, error)
+	// DeleteUnattachedAttachments deletes the attachments uploaded before the
+	// given time that no message has, and returns them so that their files
+	// can be deleted too.
+	DeleteUnattachedAttachments(ctx context.Context, before time.Time) ([]*structs.Attachment, error)
+
+	// SetSanction puts a sanction on a user, replacing the one of the same
+	// type if there is one. It returns ErrUserNotFound if the user does not
+	// exist.
+	SetSanction(ctx context.Context, sanction *structs.Sanction) error
+	// FindSanction returns the sanction of a type on a user, including one
+	// that has expired.
+	FindSanction(ctx context.Context, userID string, sanctionType structs.SanctionType) (*structs.Sanction, error)
+	DeleteSanction(ctx context.Context, userID string, sanctionType structs.SanctionType) error
 
-	CreateMessage(message *structs.Message) (*structs.Message, error)
-	GetRecentMessages(limit int) []*structs.Message
+	// CreateAuditEntry appends an entry to the audit log. Entries can never
+	// be changed or removed.
+	CreateAuditEntry(ctx context.Context, entry *structs.AuditEntry) error
+	// GetAuditEntries returns the entries matching q, newest first. It
+	// returns ErrAuditEntryNotFound if the Before entry does not exist.
+	GetAuditEntries(ctx context.Context, q *AuditQuery) ([]*structs.AuditEntry, error)
 
-	CreateReaction(messageID string, emoji rune) error
-	DeleteReaction(messageID string, emoji rune) error
+	// SearchMessages returns a page of the messages matching q, newest first,
+	// along with how many match in total.
+	SearchMessages(ctx context.Context, q *search.Query) ([]*structs.Message, int, error)
 }
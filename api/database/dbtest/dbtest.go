@@ -0,0 +1,1040 @@
+// Package dbtest checks that an implementation of database.DB keeps the
+// contract the rest of the server relies on. A backend runs it from its own
+// tests:
+//
+//	func TestConformance(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) database.DB {
+//			db, err := OpenMyDB(...)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			t.Cleanup(func() { db.Close() })
+//			return db
+//		})
+//	}
+package dbtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/search"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+var ctx = context.Background()
+
+// Opener returns a new database for a single test. It may come with a
+// default channel, but nothing else.
+type Opener func(t *testing.T) database.DB
+
+// Run runs every conformance test against databases from open.
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db database.DB)
+	}{
+		{"Users", testUsers},
+		{"Channels", testChannels},
+		{"Members", testMembers},
+		{"DirectChannels", testDirectChannels},
+		{"Messages", testMessages},
+		{"RecentMessages", testRecentMessages},
+		{"MessagePagination", testMessagePagination},
+		{"Reactions", testReactions},
+		{"RefreshTokens", testRefreshTokens},
+		{"RevokedTokens", testRevokedTokens},
+		{"ReadStates", testReadStates},
+		{"Search", testSearch},
+		{"Attachments", testAttachments},
+		{"Sanctions", testSanctions},
+		{"Audit", testAudit},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, open(t))
+		})
+	}
+}
+
+func newUser(t *testing.T, db database.DB, username string) *structs.User {
+	t.Helper()
+	user, err := db.CreateUser(ctx, &structs.User{ID: uuid.New(), Username: username, Password: "hash", Created: time.Now()})
+	if err != nil {
+		t.Fatalf("CreateUser() got %v, wanted nil", err)
+	}
+	return user
+}
+
+func newChannel(t *testing.T, db database.DB, channelType structs.ChannelType) *structs.Channel {
+	t.Helper()
+	channel, err := db.CreateChannel(ctx, &structs.Channel{ID: uuid.New(), Type: channelType, Name: "channel", Created: time.Now()})
+	if err != nil {
+		t.Fatalf("CreateChannel() got %v, wanted nil", err)
+	}
+	return channel
+}
+
+func newMessage(t *testing.T, db database.DB, channelID uuid.UUID, author *structs.User, timestamp time.Time) *structs.Message {
+	t.Helper()
+	msg, err := db.CreateMessage(ctx, &structs.Message{
+		ID:        uuid.New(),
+		ChannelID: channelID,
+		Author:    author,
+		Content:   "message",
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage() got %v, wanted nil", err)
+	}
+	return msg
+}
+
+// ids returns the IDs of messages, for comparing and printing.
+func ids(messages []*structs.Message) []uuid.UUID {
+	out := make([]uuid.UUID, 0, len(messages))
+	for _, msg := range messages {
+		out = append(out, msg.ID)
+	}
+	return out
+}
+
+func sameIDs(got []*structs.Message, want []*structs.Message) bool {
+	return fmt.Sprint(ids(got)) == fmt.Sprint(ids(want))
+}
+
+func testUsers(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+
+	if got, err := db.CountUsers(ctx); got != 2 || err != nil {
+		t.Errorf("CountUsers() got (%v, %v), wanted 2", got, err)
+	}
+	got, _ := db.FindUserByID(ctx, jeff.ID.String())
+	if got == nil || got.Username != "jeff" || got.Password != "hash" || !got.Created.Equal(jeff.Created) {
+		t.Errorf("FindUserByID() got %v, wanted %v", got, jeff)
+	}
+	if got, _ := db.FindUserByUsername(ctx, "jeff"); got == nil || got.ID != jeff.ID {
+		t.Errorf("FindUserByUsername() got %v, wanted %v", got, jeff)
+	}
+	if got, err := db.FindUserByID(ctx, uuid.New().String()); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindUserByID() on missing user got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+	if got, err := db.FindUserByUsername(ctx, "alice"); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindUserByUsername() on missing user got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+	if _, err := db.CreateUser(ctx, &structs.User{ID: uuid.New(), Username: "jeff"}); !errors.Is(err, database.ErrConflict) {
+		t.Errorf("CreateUser() with a taken username got %v, wanted %v", err, database.ErrConflict)
+	}
+
+	jeffCopy := *jeff
+	jeffCopy.Password = "new hash"
+	jeffCopy.Role = structs.RoleModerator
+	if _, err := db.UpdateUser(ctx, &jeffCopy); err != nil {
+		t.Errorf("UpdateUser() got %v, wanted nil", err)
+	}
+	if got, _ := db.FindUserByID(ctx, jeff.ID.String()); got == nil || got.Password != "new hash" || got.Role != structs.RoleModerator {
+		t.Errorf("FindUserByID() after UpdateUser() got %v, wanted the new password and role", got)
+	}
+	if _, err := db.UpdateUser(ctx, &structs.User{ID: uuid.New(), Username: "alice"}); !errors.Is(err, database.ErrUserNotFound) {
+		t.Errorf("UpdateUser() on missing user got %v, wanted %v", err, database.ErrUserNotFound)
+	}
+
+	// users claiming ownership at once can not both get it
+	var (
+		wg     sync.WaitGroup
+		owners = make([]bool, 2)
+	)
+	for i, u := range []*structs.User{jeff, bob} {
+		wg.Add(1)
+		go func(i int, u *structs.User) {
+			defer wg.Done()
+			owners[i], _ = db.ClaimOwnership(ctx, u.ID.String())
+		}(i, u)
+	}
+	wg.Wait()
+	if owners[0] == owners[1] {
+		t.Errorf("ClaimOwnership() at once got %v, wanted one owner", owners)
+	}
+	owner := jeff
+	if owners[1] {
+		owner = bob
+	}
+	if got, _ := db.FindUserByID(ctx, owner.ID.String()); got == nil || got.Role != structs.RoleOwner {
+		t.Errorf("FindUserByID() after ClaimOwnership() got %v, wanted the owner", got)
+	}
+	if ok, err := db.ClaimOwnership(ctx, owner.ID.String()); ok || err != nil {
+		t.Errorf("ClaimOwnership() with an owner got (%v, %v), wanted (false, nil)", ok, err)
+	}
+	if _, err := db.ClaimOwnership(ctx, uuid.New().String()); !errors.Is(err, database.ErrUserNotFound) {
+		t.Errorf("ClaimOwnership() on missing user got %v, wanted %v", err, database.ErrUserNotFound)
+	}
+}
+
+func testChannels(t *testing.T, db database.DB) {
+	before, _ := db.GetChannels(ctx)
+	existing := len(before)
+	text := newChannel(t, db, structs.ChannelTypeText)
+	newChannel(t, db, structs.ChannelTypeDM)
+	newChannel(t, db, structs.ChannelTypeGroup)
+
+	channels, _ := db.GetChannels(ctx)
+	if len(channels) != existing+1 || channels[len(channels)-1].ID != text.ID {
+		t.Errorf("GetChannels() got %v, wanted only public channels, oldest first", channels)
+	}
+	if got, _ := db.FindChannelByID(ctx, text.ID.String()); got == nil || got.Name != "channel" {
+		t.Errorf("FindChannelByID() got %v, wanted %v", got, text)
+	}
+
+	textCopy := *text
+	textCopy.Topic = "topic"
+	override := &structs.PermissionOverride{Role: structs.RoleMember, Deny: structs.PermSendMessages}
+	textCopy.SetOverride(override)
+	if _, err := db.UpdateChannel(ctx, &textCopy); err != nil {
+		t.Errorf("UpdateChannel() got %v, wanted nil", err)
+	}
+	if got, _ := db.FindChannelByID(ctx, text.ID.String()); got == nil || got.Topic != "topic" ||
+		len(got.Overrides) != 1 || *got.Overrides[0] != *override {
+		t.Errorf("FindChannelByID() after UpdateChannel() got %v, wanted the new topic and override", got)
+	}
+
+	msg := newMessage(t, db, text.ID, nil, time.Now())
+	if err := db.DeleteChannel(ctx, text.ID.String()); err != nil {
+		t.Errorf("DeleteChannel() got %v, wanted nil", err)
+	}
+	if got, err := db.FindChannelByID(ctx, text.ID.String()); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindChannelByID() after DeleteChannel() got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+	if got, err := db.FindMessageByID(ctx, msg.ID.String()); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindMessageByID() after DeleteChannel() got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+
+	if _, err := db.UpdateChannel(ctx, &textCopy); !errors.Is(err, database.ErrChannelNotFound) {
+		t.Errorf("UpdateChannel() on missing channel got %v, wanted %v", err, database.ErrChannelNotFound)
+	}
+	if err := db.DeleteChannel(ctx, text.ID.String()); !errors.Is(err, database.ErrChannelNotFound) {
+		t.Errorf("DeleteChannel() on missing channel got %v, wanted %v", err, database.ErrChannelNotFound)
+	}
+}
+
+func testMembers(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	group := newChannel(t, db, structs.ChannelTypeGroup)
+	channelID := channel.ID.String()
+
+	for _, id := range []string{channelID, group.ID.String()} {
+		if err := db.AddChannelMember(ctx, id, jeff.ID.String()); err != nil {
+			t.Errorf("AddChannelMember() got %v, wanted nil", err)
+		}
+	}
+	_ = db.AddChannelMember(ctx, channelID, bob.ID.String())
+	// adding twice is a no-op
+	_ = db.AddChannelMember(ctx, channelID, bob.ID.String())
+
+	if ok, _ := db.IsChannelMember(ctx, channelID, jeff.ID.String()); !ok {
+		t.Errorf("IsChannelMember() got false, wanted true")
+	}
+	members, _ := db.GetChannelMembers(ctx, channelID)
+	if len(members) != 2 || members[0].Username != "bob" || members[1].Username != "jeff" {
+		t.Errorf("GetChannelMembers() got %v, wanted bob and jeff, by username", members)
+	}
+	if got, _ := db.GetUserChannels(ctx, jeff.ID.String()); len(got) != 2 || got[0].ID != channel.ID || got[1].ID != group.ID {
+		t.Errorf("GetUserChannels() got %v, wanted both channels, oldest first", got)
+	}
+
+	if err := db.RemoveChannelMember(ctx, channelID, bob.ID.String()); err != nil {
+		t.Errorf("RemoveChannelMember() got %v, wanted nil", err)
+	}
+	if ok, _ := db.IsChannelMember(ctx, channelID, bob.ID.String()); ok {
+		t.Errorf("IsChannelMember() after RemoveChannelMember() got true, wanted false")
+	}
+	if got, _ := db.GetUserChannels(ctx, bob.ID.String()); len(got) != 0 {
+		t.Errorf("GetUserChannels() after RemoveChannelMember() got %v, wanted none", got)
+	}
+
+	missing := uuid.New().String()
+	if err := db.AddChannelMember(ctx, missing, jeff.ID.String()); !errors.Is(err, database.ErrChannelNotFound) {
+		t.Errorf("AddChannelMember() on missing channel got %v, wanted %v", err, database.ErrChannelNotFound)
+	}
+	if err := db.RemoveChannelMember(ctx, missing, jeff.ID.String()); !errors.Is(err, database.ErrChannelNotFound) {
+		t.Errorf("RemoveChannelMember() on missing channel got %v, wanted %v", err, database.ErrChannelNotFound)
+	}
+	if ok, _ := db.IsChannelMember(ctx, missing, jeff.ID.String()); ok {
+		t.Errorf("IsChannelMember() on missing channel got true, wanted false")
+	}
+}
+
+func testDirectChannels(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+	alice := newUser(t, db, "alice")
+
+	conversation := func(channelType structs.ChannelType) *structs.Channel {
+		return &structs.Channel{ID: uuid.New(), Type: channelType, Created: time.Now()}
+	}
+	dm, err := db.CreateChannelWithMembers(ctx, conversation(structs.ChannelTypeDM), []string{jeff.ID.String(), bob.ID.String()})
+	if err != nil {
+		t.Fatalf("CreateChannelWithMembers() got %v, wanted nil", err)
+	}
+	// a group with the same two users is not a DM
+	group, err := db.CreateChannelWithMembers(ctx, conversation(structs.ChannelTypeGroup), []string{jeff.ID.String(), alice.ID.String()})
+	if err != nil {
+		t.Fatalf("CreateChannelWithMembers() a group got %v, wanted nil", err)
+	}
+	if members, _ := db.GetChannelMembers(ctx, group.ID.String()); len(members) != 2 {
+		t.Errorf("GetChannelMembers() of a new group got %v, wanted jeff and alice", members)
+	}
+
+	if got, _ := db.FindDirectChannel(ctx, bob.ID.String(), jeff.ID.String()); got == nil || got.ID != dm.ID {
+		t.Errorf("FindDirectChannel() got %v, wanted %v", got, dm)
+	}
+	if got, err := db.FindDirectChannel(ctx, jeff.ID.String(), alice.ID.String()); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindDirectChannel() got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+	_, err = db.CreateChannelWithMembers(ctx, conversation(structs.ChannelTypeDM), []string{bob.ID.String(), jeff.ID.String()})
+	if !errors.Is(err, database.ErrDirectChannelTaken) || !errors.Is(err, database.ErrConflict) {
+		t.Errorf("CreateChannelWithMembers() a second DM got %v, wanted %v", err, database.ErrDirectChannelTaken)
+	}
+
+	// only one of many DMs opened at once is created
+	const openers = 8
+	var (
+		wg      sync.WaitGroup
+		created = make(chan *structs.Channel, openers)
+	)
+	for i := 0; i < openers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			channel, err := db.CreateChannelWithMembers(ctx, conversation(structs.ChannelTypeDM), []string{alice.ID.String(), bob.ID.String()})
+			if err == nil {
+				created <- channel
+			} else if !errors.Is(err, database.ErrDirectChannelTaken) {
+				t.Errorf("CreateChannelWithMembers() at once got %v, wanted nil or %v", err, database.ErrDirectChannelTaken)
+			}
+		}()
+	}
+	wg.Wait()
+	close(created)
+	if len(created) != 1 {
+		t.Fatalf("DMs created at once got %v, wanted 1", len(created))
+	}
+	if got, _ := db.FindDirectChannel(ctx, alice.ID.String(), bob.ID.String()); got == nil || got.ID != (<-created).ID {
+		t.Errorf("FindDirectChannel() after opening at once got %v, wanted the one created", got)
+	}
+}
+
+func testMessages(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	msg := newMessage(t, db, channel.ID, jeff, time.Now())
+
+	got, _ := db.FindMessageByID(ctx, msg.ID.String())
+	if got == nil || got.Content != "message" || got.ChannelID != channel.ID || !got.Timestamp.Equal(msg.Timestamp) {
+		t.Fatalf("FindMessageByID() got %v, wanted %v", got, msg)
+	}
+	if got.Author == nil || got.Author.ID != jeff.ID || got.Author.Username != "jeff" {
+		t.Errorf("FindMessageByID().Author got %v, wanted %v", got.Author, jeff)
+	}
+	if got.EditedTimestamp != nil || len(got.History) != 0 {
+		t.Errorf("FindMessageByID() got an edit on a new message")
+	}
+
+	edited := time.Now()
+	msgCopy := *msg
+	msgCopy.Content = "edited"
+	msgCopy.EditedTimestamp = &edited
+	msgCopy.History = []*structs.MessageRevision{{Content: "message", Timestamp: msg.Timestamp}}
+	if _, err := db.UpdateMessage(ctx, &msgCopy); err != nil {
+		t.Errorf("UpdateMessage() got %v, wanted nil", err)
+	}
+	got, _ = db.FindMessageByID(ctx, msg.ID.String())
+	if got == nil || got.Content != "edited" || got.EditedTimestamp == nil || !got.EditedTimestamp.Equal(edited) {
+		t.Fatalf("FindMessageByID() after UpdateMessage() got %v, wanted the edit", got)
+	}
+	if len(got.History) != 1 || got.History[0].Content != "message" {
+		t.Errorf("FindMessageByID().History got %v, wanted the old content", got.History)
+	}
+
+	if err := db.DeleteMessage(ctx, msg.ID.String()); err != nil {
+		t.Errorf("DeleteMessage() got %v, wanted nil", err)
+	}
+	if got, err := db.FindMessageByID(ctx, msg.ID.String()); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindMessageByID() after DeleteMessage() got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+	if err := db.DeleteMessage(ctx, msg.ID.String()); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("DeleteMessage() on missing message got %v, wanted %v", err, database.ErrMessageNotFound)
+	}
+	if _, err := db.UpdateMessage(ctx, &msgCopy); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("UpdateMessage() on missing message got %v, wanted %v", err, database.ErrMessageNotFound)
+	}
+}
+
+func testRecentMessages(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	other := newChannel(t, db, structs.ChannelTypeText)
+
+	if got, _ := db.GetRecentMessages(ctx, channel.ID.String(), 10); got == nil || len(got) != 0 {
+		t.Errorf("GetRecentMessages() on empty channel got %v, wanted an empty slice", got)
+	}
+
+	start := time.Now()
+	var messages []*structs.Message
+	// created out of order, so that ordering is not left to insertion
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		newMessage(t, db, other.ID, jeff, start.Add(time.Duration(i)*time.Second))
+		messages = append(messages, newMessage(t, db, channel.ID, jeff, start.Add(time.Duration(i)*time.Second)))
+	}
+	sorted := []*structs.Message{messages[1], messages[3], messages[4], messages[0], messages[2]}
+
+	if got, _ := db.GetRecentMessages(ctx, channel.ID.String(), 10); !sameIDs(got, sorted) {
+		t.Errorf("GetRecentMessages() got %v, wanted %v", ids(got), ids(sorted))
+	}
+	if got, _ := db.GetRecentMessages(ctx, channel.ID.String(), 2); !sameIDs(got, sorted[3:]) {
+		t.Errorf("GetRecentMessages() with limit got %v, wanted the newest, oldest first %v", ids(got), ids(sorted[3:]))
+	}
+
+	// messages sent at the same time are ordered by ID
+	same := start.Add(time.Minute)
+	a := newMessage(t, db, channel.ID, jeff, same)
+	b := newMessage(t, db, channel.ID, jeff, same)
+	if b.ID.String() < a.ID.String() {
+		a, b = b, a
+	}
+	if got, _ := db.GetRecentMessages(ctx, channel.ID.String(), 2); !sameIDs(got, []*structs.Message{a, b}) {
+		t.Errorf("GetRecentMessages() with equal timestamps got %v, wanted %v", ids(got), ids([]*structs.Message{a, b}))
+	}
+}
+
+func testMessagePagination(t *testing.T, db database.DB) {
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	channelID := channel.ID.String()
+
+	start := time.Now()
+	var messages []*structs.Message
+	for i := 0; i < 10; i++ {
+		messages = append(messages, newMessage(t, db, channel.ID, nil, start.Add(time.Duration(i)*time.Second)))
+	}
+	at := cursorAt(messages[5])
+
+	if got, _ := db.GetMessagesBefore(ctx, channelID, at, 3); !sameIDs(got, messages[2:5]) {
+		t.Errorf("GetMessagesBefore() got %v, wanted %v", ids(got), ids(messages[2:5]))
+	}
+	if got, _ := db.GetMessagesAfter(ctx, channelID, at, 3); !sameIDs(got, messages[6:9]) {
+		t.Errorf("GetMessagesAfter() got %v, wanted %v", ids(got), ids(messages[6:9]))
+	}
+	if got, _ := db.GetMessagesAround(ctx, channelID, at, 4); !sameIDs(got, messages[3:7]) {
+		t.Errorf("GetMessagesAround() got %v, wanted %v", ids(got), ids(messages[3:7]))
+	}
+	if got, _ := db.GetMessagesBefore(ctx, channelID, cursorAt(messages[0]), 3); len(got) != 0 {
+		t.Errorf("GetMessagesBefore() the first message got %v, wanted none", ids(got))
+	}
+	if got, _ := db.GetMessagesAfter(ctx, channelID, cursorAt(messages[9]), 3); len(got) != 0 {
+		t.Errorf("GetMessagesAfter() the last message got %v, wanted none", ids(got))
+	}
+	if got, _ := db.GetMessagesAfter(ctx, channelID, database.MessageCursor{Timestamp: at.Timestamp}, 3); !sameIDs(got, messages[6:9]) {
+		t.Errorf("GetMessagesAfter() a timestamp got %v, wanted %v", ids(got), ids(messages[6:9]))
+	}
+
+	// messages sent at the same time as the cursor are paged through by ID,
+	// without skipping any
+	same := start.Add(time.Minute)
+	var tied []*structs.Message
+	for i := 0; i < 4; i++ {
+		tied = append(tied, newMessage(t, db, channel.ID, nil, same))
+	}
+	sort.Slice(tied, func(i, k int) bool { return tied[i].ID.String() < tied[k].ID.String() })
+	if got, _ := db.GetMessagesBefore(ctx, channelID, cursorAt(tied[2]), 2); !sameIDs(got, tied[:2]) {
+		t.Errorf("GetMessagesBefore() with equal timestamps got %v, wanted %v", ids(got), ids(tied[:2]))
+	}
+	if got, _ := db.GetMessagesAfter(ctx, channelID, cursorAt(tied[1]), 2); !sameIDs(got, tied[2:]) {
+		t.Errorf("GetMessagesAfter() with equal timestamps got %v, wanted %v", ids(got), ids(tied[2:]))
+	}
+	if got, _ := db.GetMessagesAround(ctx, channelID, cursorAt(tied[2]), 2); !sameIDs(got, tied[1:3]) {
+		t.Errorf("GetMessagesAround() with equal timestamps got %v, wanted %v", ids(got), ids(tied[1:3]))
+	}
+}
+
+// cursorAt returns a cursor at msg.
+func cursorAt(msg *structs.Message) database.MessageCursor {
+	return database.MessageCursor{Timestamp: msg.Timestamp, ID: msg.ID.String()}
+}
+
+func testReactions(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	msg := newMessage(t, db, channel.ID, jeff, time.Now())
+	msgID := msg.ID.String()
+
+	if added, err := db.CreateReaction(ctx, msgID, jeff, "👍"); err != nil || !added {
+		t.Errorf("CreateReaction() got (%v, %v), wanted (true, nil)", added, err)
+	}
+	if added, err := db.CreateReaction(ctx, msgID, jeff, "👍"); err != nil || added {
+		t.Errorf("CreateReaction() twice got (%v, %v), wanted (false, nil)", added, err)
+	}
+	_, _ = db.CreateReaction(ctx, msgID, bob, "👍")
+	_, _ = db.CreateReaction(ctx, msgID, bob, "🎉")
+
+	got, _ := db.FindMessageByID(ctx, msgID)
+	if got == nil || len(got.Reactions) != 2 {
+		t.Fatalf("FindMessageByID().Reactions got %v, wanted two reactions", got)
+	}
+	if r := got.Reactions[0]; r.Emoji != "👍" || len(r.Users) != 2 || r.Users[0].ID != jeff.ID || r.Users[1].ID != bob.ID {
+		t.Errorf("Reactions[0] got %v, wanted 👍 by jeff and bob, in that order", r)
+	}
+	if r := got.Reactions[1]; r.Emoji != "🎉" || len(r.Users) != 1 {
+		t.Errorf("Reactions[1] got %v, wanted 🎉 by bob", r)
+	}
+	if recent, _ := db.GetRecentMessages(ctx, channel.ID.String(), 1); len(recent) != 1 || len(recent[0].Reactions) != 2 {
+		t.Errorf("GetRecentMessages() got %v, wanted the message with its reactions", recent)
+	}
+
+	if removed, err := db.DeleteReaction(ctx, msgID, jeff, "👍"); err != nil || !removed {
+		t.Errorf("DeleteReaction() got (%v, %v), wanted (true, nil)", removed, err)
+	}
+	if removed, err := db.DeleteReaction(ctx, msgID, jeff, "👍"); err != nil || removed {
+		t.Errorf("DeleteReaction() twice got (%v, %v), wanted (false, nil)", removed, err)
+	}
+	_, _ = db.DeleteReaction(ctx, msgID, bob, "🎉")
+	if got, _ := db.FindMessageByID(ctx, msgID); got == nil || len(got.Reactions) != 1 {
+		t.Errorf("FindMessageByID().Reactions got %v, wanted reactions without users to be gone", got)
+	}
+
+	missing := uuid.New().String()
+	if _, err := db.CreateReaction(ctx, missing, jeff, "👍"); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("CreateReaction() on missing message got %v, wanted %v", err, database.ErrMessageNotFound)
+	}
+	if _, err := db.DeleteReaction(ctx, missing, jeff, "👍"); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("DeleteReaction() on missing message got %v, wanted %v", err, database.ErrMessageNotFound)
+	}
+}
+
+func testRefreshTokens(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	token := &structs.RefreshToken{
+		Hash:    "hash",
+		UserID:  jeff.ID,
+		Created: time.Now(),
+		Expires: time.Now().Add(time.Hour),
+	}
+	if _, err := db.CreateRefreshToken(ctx, token); err != nil {
+		t.Errorf("CreateRefreshToken() got %v, wanted nil", err)
+	}
+
+	got, _ := db.FindRefreshToken(ctx, "hash")
+	if got == nil || got.UserID != jeff.ID || !got.Expires.Equal(token.Expires) {
+		t.Errorf("FindRefreshToken() got %v, wanted %v", got, token)
+	}
+	if got, err := db.FindRefreshToken(ctx, "other"); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindRefreshToken() on missing token got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+
+	if err := db.DeleteRefreshToken(ctx, "hash"); err != nil {
+		t.Errorf("DeleteRefreshToken() got %v, wanted nil", err)
+	}
+	if got, err := db.FindRefreshToken(ctx, "hash"); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindRefreshToken() after DeleteRefreshToken() got (%v, %v), wanted %v", got, err, database.ErrNotFound)
+	}
+	// deleting is how a refresh token is claimed, so only one may succeed
+	if err := db.DeleteRefreshToken(ctx, "hash"); !errors.Is(err, database.ErrTokenNotFound) {
+		t.Errorf("DeleteRefreshToken() twice got %v, wanted %v", err, database.ErrTokenNotFound)
+	}
+
+	bob := newUser(t, db, "bob")
+	for _, hash := range []string{"jeff1", "jeff2", "bob"} {
+		owner := jeff
+		if hash == "bob" {
+			owner = bob
+		}
+		_, _ = db.CreateRefreshToken(ctx, &structs.RefreshToken{Hash: hash, UserID: owner.ID, Created: time.Now(), Expires: time.Now().Add(time.Hour)})
+	}
+	if err := db.DeleteUserRefreshTokens(ctx, jeff.ID.String()); err != nil {
+		t.Errorf("DeleteUserRefreshTokens() got %v, wanted nil", err)
+	}
+	for _, hash := range []string{"jeff1", "jeff2"} {
+		if _, err := db.FindRefreshToken(ctx, hash); !errors.Is(err, database.ErrNotFound) {
+			t.Errorf("FindRefreshToken() after DeleteUserRefreshTokens() got %v, wanted %v", err, database.ErrNotFound)
+		}
+	}
+	if _, err := db.FindRefreshToken(ctx, "bob"); err != nil {
+		t.Errorf("FindRefreshToken() of another user got %v, wanted nil", err)
+	}
+}
+
+func testRevokedTokens(t *testing.T, db database.DB) {
+	if ok, _ := db.IsTokenRevoked(ctx, "token"); ok {
+		t.Errorf("IsTokenRevoked() got true, wanted false")
+	}
+	if err := db.RevokeToken(ctx, "token", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("RevokeToken() got %v, wanted nil", err)
+	}
+	if ok, _ := db.IsTokenRevoked(ctx, "token"); !ok {
+		t.Errorf("IsTokenRevoked() got false, wanted true")
+	}
+
+	if got, err := db.UserTokenVersion(ctx, "jeff"); err != nil || got != 0 {
+		t.Errorf("UserTokenVersion() got (%v, %v), wanted 0", got, err)
+	}
+	for want := 1; want <= 2; want++ {
+		if err := db.RevokeUserTokens(ctx, "jeff"); err != nil {
+			t.Errorf("RevokeUserTokens() got %v, wanted nil", err)
+		}
+		if got, _ := db.UserTokenVersion(ctx, "jeff"); got != want {
+			t.Errorf("UserTokenVersion() after revoking %v times got %v, wanted %v", want, got, want)
+		}
+	}
+	if got, _ := db.UserTokenVersion(ctx, "bob"); got != 0 {
+		t.Errorf("UserTokenVersion() of another user got %v, wanted 0", got)
+	}
+}
+
+func testReadStates(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	start := time.Now()
+	first := newMessage(t, db, channel.ID, bob, start)
+	newMessage(t, db, channel.ID, jeff, start.Add(time.Second))
+	// someone else with a name starting with jeff's
+	_, err := db.CreateMessage(ctx, &structs.Message{
+		ID:        uuid.New(),
+		ChannelID: channel.ID,
+		Author:    bob,
+		Content:   "ask @jeffrey",
+		Timestamp: start.Add(time.Second * 3 / 2),
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage() got %v, wanted nil", err)
+	}
+	mention, err := db.CreateMessage(ctx, &structs.Message{
+		ID:        uuid.New(),
+		ChannelID: channel.ID,
+		Author:    bob,
+		Content:   "hey @jeff",
+		Timestamp: start.Add(time.Second * 2),
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage() got %v, wanted nil", err)
+	}
+
+	if got, err := db.GetReadStates(ctx, jeff.ID.String()); err != nil || len(got) != 0 {
+		t.Errorf("GetReadStates() got (%v, %v), wanted none", got, err)
+	}
+	// messages sent by the user themselves are never unread
+	count, mentions, err := db.CountMessagesAfter(ctx, channel.ID.String(), jeff.ID.String(), time.Time{}, "@jeff")
+	if err != nil || count != 3 || mentions != 1 {
+		t.Errorf("CountMessagesAfter() got (%v, %v, %v), wanted (3, 1, nil)", count, mentions, err)
+	}
+
+	state := &structs.ReadState{UserID: jeff.ID, ChannelID: channel.ID, MessageID: first.ID, Timestamp: first.Timestamp}
+	if ok, err := db.SetReadState(ctx, state); err != nil || !ok {
+		t.Errorf("SetReadState() got (%v, %v), wanted (true, nil)", ok, err)
+	}
+	count, mentions, _ = db.CountMessagesAfter(ctx, channel.ID.String(), jeff.ID.String(), first.Timestamp, "@jeff")
+	if count != 2 || mentions != 1 {
+		t.Errorf("CountMessagesAfter() got (%v, %v), wanted (2, 1)", count, mentions)
+	}
+
+	state = &structs.ReadState{UserID: jeff.ID, ChannelID: channel.ID, MessageID: mention.ID, Timestamp: mention.Timestamp}
+	_, _ = db.SetReadState(ctx, state)
+	got, _ := db.GetReadStates(ctx, jeff.ID.String())
+	if len(got) != 1 || got[0].MessageID != mention.ID || !got[0].Timestamp.Equal(mention.Timestamp) {
+		t.Errorf("GetReadStates() got %v, wanted only the latest state", got)
+	}
+	// read states never move back, even when acks arrive out of order
+	older := &structs.ReadState{UserID: jeff.ID, ChannelID: channel.ID, MessageID: first.ID, Timestamp: first.Timestamp}
+	if ok, err := db.SetReadState(ctx, older); err != nil || ok {
+		t.Errorf("SetReadState() of an older message got (%v, %v), wanted (false, nil)", ok, err)
+	}
+	if ok, _ := db.SetReadState(ctx, state); ok {
+		t.Errorf("SetReadState() of the same message got true, wanted false")
+	}
+	var wg sync.WaitGroup
+	for _, s := range []*structs.ReadState{older, state, older, state} {
+		wg.Add(1)
+		go func(s *structs.ReadState) {
+			defer wg.Done()
+			_, _ = db.SetReadState(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+	if got, _ := db.GetReadStates(ctx, jeff.ID.String()); len(got) != 1 || got[0].MessageID != mention.ID {
+		t.Errorf("GetReadStates() after acking out of order got %v, wanted the latest state", got)
+	}
+	if got, _ := db.GetReadStates(ctx, bob.ID.String()); len(got) != 0 {
+		t.Errorf("GetReadStates() for another user got %v, wanted none", got)
+	}
+
+	missing := &structs.ReadState{UserID: jeff.ID, ChannelID: uuid.New(), MessageID: first.ID, Timestamp: start}
+	if _, err := db.SetReadState(ctx, missing); !errors.Is(err, database.ErrChannelNotFound) {
+		t.Errorf("SetReadState() on missing channel got %v, wanted %v", err, database.ErrChannelNotFound)
+	}
+	_ = db.DeleteChannel(ctx, channel.ID.String())
+	if got, _ := db.GetReadStates(ctx, jeff.ID.String()); len(got) != 0 {
+		t.Errorf("GetReadStates() after DeleteChannel() got %v, wanted none", got)
+	}
+}
+
+func testSearch(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	other := newChannel(t, db, structs.ChannelTypeText)
+	start := time.Now()
+	send := func(channelID uuid.UUID, author *structs.User, content string, after time.Duration) *structs.Message {
+		msg, err := db.CreateMessage(ctx, &structs.Message{
+			ID:        uuid.New(),
+			ChannelID: channelID,
+			Author:    author,
+			Content:   content,
+			Timestamp: start.Add(after),
+		})
+		if err != nil {
+			t.Fatalf("CreateMessage() got %v, wanted nil", err)
+		}
+		return msg
+	}
+	first := send(channel.ID, jeff, "Deploying the new build", 0)
+	second := send(channel.ID, bob, "the build is broken", time.Second)
+	third := send(other.ID, jeff, "build fixed", time.Second*2)
+	send(channel.ID, bob, "unrelated", time.Second*3)
+
+	channels := []string{channel.ID.String(), other.ID.String()}
+	tests := []struct {
+		name  string
+		query search.Query
+		want  []*structs.Message
+		total int
+	}{
+		{"term", search.Query{Terms: []string{"BUILD"}, ChannelIDs: channels}, []*structs.Message{third, second, first}, 3},
+		{"every term", search.Query{Terms: []string{"build", "the"}, ChannelIDs: channels}, []*structs.Message{second, first}, 2},
+		{"author", search.Query{Terms: []string{"build"}, AuthorID: jeff.ID.String(), ChannelIDs: channels}, []*structs.Message{third, first}, 2},
+		{"channel", search.Query{Terms: []string{"build"}, ChannelIDs: channels[:1]}, []*structs.Message{second, first}, 2},
+		{"dates", search.Query{Terms: []string{"build"}, ChannelIDs: channels, After: first.Timestamp, Before: third.Timestamp}, []*structs.Message{second}, 1},
+		{"page", search.Query{Terms: []string{"build"}, ChannelIDs: channels, Offset: 1, Limit: 1}, []*structs.Message{second}, 3},
+		{"no match", search.Query{Terms: []string{"missing"}, ChannelIDs: channels}, []*structs.Message{}, 0},
+	}
+	for _, tt := range tests {
+		got, total, err := db.SearchMessages(ctx, &tt.query)
+		if err != nil {
+			t.Errorf("SearchMessages() %v got %v, wanted nil", tt.name, err)
+			continue
+		}
+		if !sameIDs(got, tt.want) {
+			t.Errorf("SearchMessages() %v got %v, wanted %v", tt.name, ids(got), ids(tt.want))
+		}
+		if total != tt.total {
+			t.Errorf("SearchMessages() %v total got %v, wanted %v", tt.name, total, tt.total)
+		}
+	}
+
+	// edits and deletes are searchable straight away
+	first.Content = "rolled back"
+	_, _ = db.UpdateMessage(ctx, first)
+	_ = db.DeleteMessage(ctx, second.ID.String())
+	query := &search.Query{Terms: []string{"build"}, ChannelIDs: channels}
+	if got, total, _ := db.SearchMessages(ctx, query); total != 1 || !sameIDs(got, []*structs.Message{third}) {
+		t.Errorf("SearchMessages() after editing got %v, wanted [%v]", ids(got), third.ID)
+	}
+	query = &search.Query{Terms: []string{"rolled"}, ChannelIDs: channels}
+	if got, _, _ := db.SearchMessages(ctx, query); !sameIDs(got, []*structs.Message{first}) {
+		t.Errorf("SearchMessages() for new content got %v, wanted [%v]", ids(got), first.ID)
+	}
+	_ = db.DeleteChannel(ctx, other.ID.String())
+	query = &search.Query{Terms: []string{"build"}, ChannelIDs: channels}
+	if got, total, _ := db.SearchMessages(ctx, query); total != 0 {
+		t.Errorf("SearchMessages() after DeleteChannel() got %v, wanted none", ids(got))
+	}
+}
+
+func testAttachments(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	attachment := &structs.Attachment{
+		ID:          uuid.New(),
+		ChannelID:   channel.ID,
+		UploaderID:  jeff.ID,
+		Filename:    "cat.png",
+		ContentType: "image/png",
+		Size:        1024,
+		Width:       640,
+		Height:      480,
+		Created:     time.Now(),
+	}
+	if _, err := db.CreateAttachment(ctx, attachment); err != nil {
+		t.Fatalf("CreateAttachment() got %v, wanted nil", err)
+	}
+	got, err := db.FindAttachmentByID(ctx, attachment.ID.String())
+	if err != nil || got.Filename != "cat.png" || got.UploaderID != jeff.ID || got.Width != 640 || !got.Created.Equal(attachment.Created) {
+		t.Errorf("FindAttachmentByID() got (%v, %v), wanted %v", got, err, attachment)
+	}
+	if _, err := db.CreateAttachment(ctx, attachment); !errors.Is(err, database.ErrConflict) {
+		t.Errorf("CreateAttachment() twice got %v, wanted %v", err, database.ErrConflict)
+	}
+	missing := *attachment
+	missing.ID, missing.ChannelID = uuid.New(), uuid.New()
+	if _, err := db.CreateAttachment(ctx, &missing); !errors.Is(err, database.ErrChannelNotFound) {
+		t.Errorf("CreateAttachment() on missing channel got %v, wanted %v", err, database.ErrChannelNotFound)
+	}
+
+	msg, err := db.CreateMessage(ctx, &structs.Message{
+		ID:          uuid.New(),
+		ChannelID:   channel.ID,
+		Author:      jeff,
+		Timestamp:   time.Now(),
+		Attachments: []*structs.Attachment{attachment},
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage() got %v, wanted nil", err)
+	}
+	found, _ := db.FindMessageByID(ctx, msg.ID.String())
+	if found == nil || len(found.Attachments) != 1 || found.Attachments[0].ID != attachment.ID || found.Attachments[0].Height != 480 {
+		t.Errorf("FindMessageByID() got %v, wanted the message with its attachment", found)
+	}
+
+	// uploads that were never sent are collected once they are old enough
+	unsent := *attachment
+	unsent.ID = uuid.New()
+	fresh := unsent
+	fresh.ID, fresh.Created = uuid.New(), time.Now().Add(time.Hour)
+	_, _ = db.CreateAttachment(ctx, &unsent)
+	_, _ = db.CreateAttachment(ctx, &fresh)
+	deleted, err := db.DeleteUnattachedAttachments(ctx, time.Now().Add(time.Minute))
+	if err != nil || len(deleted) != 1 || deleted[0].ID != unsent.ID || deleted[0].Filename != "cat.png" {
+		t.Errorf("DeleteUnattachedAttachments() got (%v, %v), wanted only the unsent attachment", deleted, err)
+	}
+	if _, err := db.FindAttachmentByID(ctx, unsent.ID.String()); !errors.Is(err, database.ErrAttachmentNotFound) {
+		t.Errorf("FindAttachmentByID() of a collected attachment got %v, wanted %v", err, database.ErrAttachmentNotFound)
+	}
+	for _, a := range []*structs.Attachment{attachment, &fresh} {
+		if _, err := db.FindAttachmentByID(ctx, a.ID.String()); err != nil {
+			t.Errorf("FindAttachmentByID() of a kept attachment got %v, wanted nil", err)
+		}
+	}
+
+	_ = db.DeleteChannel(ctx, channel.ID.String())
+	if got, err := db.FindAttachmentByID(ctx, attachment.ID.String()); !errors.Is(err, database.ErrAttachmentNotFound) {
+		t.Errorf("FindAttachmentByID() after DeleteChannel() got (%v, %v), wanted %v", got, err, database.ErrAttachmentNotFound)
+	}
+}
+
+func testSanctions(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+	expires := time.Now().Add(time.Hour)
+	mute := &structs.Sanction{
+		UserID:      jeff.ID,
+		Type:        structs.SanctionMute,
+		ModeratorID: bob.ID,
+		Reason:      "spam",
+		Created:     time.Now(),
+		Expires:     &expires,
+	}
+	ban := &structs.Sanction{UserID: jeff.ID, Type: structs.SanctionBan, ModeratorID: bob.ID, Created: time.Now()}
+	for _, sanction := range []*structs.Sanction{mute, ban} {
+		if err := db.SetSanction(ctx, sanction); err != nil {
+			t.Fatalf("SetSanction() got %v, wanted nil", err)
+		}
+	}
+
+	got, err := db.FindSanction(ctx, jeff.ID.String(), structs.SanctionMute)
+	if err != nil || got.Reason != "spam" || got.ModeratorID != bob.ID || got.Expires == nil || !got.Expires.Equal(expires) {
+		t.Errorf("FindSanction() got (%v, %v), wanted %v", got, err, mute)
+	}
+	if got, err := db.FindSanction(ctx, jeff.ID.String(), structs.SanctionBan); err != nil || got.Expires != nil {
+		t.Errorf("FindSanction() got (%v, %v), wanted a ban that never expires", got, err)
+	}
+	if got, err := db.FindSanction(ctx, bob.ID.String(), structs.SanctionBan); !errors.Is(err, database.ErrSanctionNotFound) {
+		t.Errorf("FindSanction() on a user without one got (%v, %v), wanted %v", got, err, database.ErrSanctionNotFound)
+	}
+
+	longer := *mute
+	longer.Expires = nil
+	if err := db.SetSanction(ctx, &longer); err != nil {
+		t.Errorf("SetSanction() to replace a sanction got %v, wanted nil", err)
+	}
+	if got, _ := db.FindSanction(ctx, jeff.ID.String(), structs.SanctionMute); got == nil || got.Expires != nil {
+		t.Errorf("FindSanction() after replacing got %v, wanted %v", got, &longer)
+	}
+
+	if err := db.DeleteSanction(ctx, jeff.ID.String(), structs.SanctionMute); err != nil {
+		t.Errorf("DeleteSanction() got %v, wanted nil", err)
+	}
+	if got, err := db.FindSanction(ctx, jeff.ID.String(), structs.SanctionMute); !errors.Is(err, database.ErrSanctionNotFound) {
+		t.Errorf("FindSanction() after DeleteSanction() got (%v, %v), wanted %v", got, err, database.ErrSanctionNotFound)
+	}
+	if _, err := db.FindSanction(ctx, jeff.ID.String(), structs.SanctionBan); err != nil {
+		t.Errorf("FindSanction() of the other type after DeleteSanction() got %v, wanted nil", err)
+	}
+	if err := db.DeleteSanction(ctx, jeff.ID.String(), structs.SanctionMute); !errors.Is(err, database.ErrSanctionNotFound) {
+		t.Errorf("DeleteSanction() twice got %v, wanted %v", err, database.ErrSanctionNotFound)
+	}
+	missing := &structs.Sanction{UserID: uuid.New(), Type: structs.SanctionBan, Created: time.Now()}
+	if err := db.SetSanction(ctx, missing); !errors.Is(err, database.ErrUserNotFound) {
+		t.Errorf("SetSanction() on missing user got %v, wanted %v", err, database.ErrUserNotFound)
+	}
+}
+
+func testAudit(t *testing.T, db database.DB) {
+	jeff := newUser(t, db, "jeff")
+	bob := newUser(t, db, "bob")
+	start := time.Now()
+	record := func(action structs.AuditAction, actor *structs.User, target string, offset time.Duration) *structs.AuditEntry {
+		t.Helper()
+		entry := &structs.AuditEntry{
+			ID:         uuid.New(),
+			Action:     action,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   target,
+			IP:         "127.0.0.1",
+			Timestamp:  start.Add(offset),
+			Details:    map[string]string{"action": string(action)},
+		}
+		if actor != nil {
+			entry.ActorID = &actor.ID
+		}
+		if err := db.CreateAuditEntry(ctx, entry); err != nil {
+			t.Fatalf("CreateAuditEntry() got %v, wanted nil", err)
+		}
+		return entry
+	}
+	failed := record(structs.AuditLoginFailed, nil, "", 0)
+	login := record(structs.AuditLogin, jeff, jeff.ID.String(), time.Second)
+	ban := record(structs.AuditBan, jeff, bob.ID.String(), 2*time.Second)
+	unban := record(structs.AuditUnban, jeff, bob.ID.String(), 3*time.Second)
+
+	auditIDs := func(entries []*structs.AuditEntry) string {
+		out := make([]uuid.UUID, 0, len(entries))
+		for _, entry := range entries {
+			out = append(out, entry.ID)
+		}
+		return fmt.Sprint(out)
+	}
+	tests := []struct {
+		name string
+		q    *database.AuditQuery
+		want []*structs.AuditEntry
+	}{
+		{"everything", &database.AuditQuery{}, []*structs.AuditEntry{unban, ban, login, failed}},
+		{"limit", &database.AuditQuery{Limit: 2}, []*structs.AuditEntry{unban, ban}},
+		{"before", &database.AuditQuery{Before: ban.ID.String(), Limit: 1}, []*structs.AuditEntry{login}},
+		{"action", &database.AuditQuery{Action: structs.AuditBan}, []*structs.AuditEntry{ban}},
+		{"actor", &database.AuditQuery{ActorID: jeff.ID.String()}, []*structs.AuditEntry{unban, ban, login}},
+		{"target", &database.AuditQuery{TargetID: bob.ID.String()}, []*structs.AuditEntry{unban, ban}},
+		{"target before", &database.AuditQuery{TargetID: bob.ID.String(), Before: unban.ID.String()}, []*structs.AuditEntry{ban}},
+	}
+	for _, tt := range tests {
+		got, err := db.GetAuditEntries(ctx, tt.q)
+		if err != nil || auditIDs(got) != auditIDs(tt.want) {
+			t.Errorf("GetAuditEntries() %v got (%v, %v), wanted %v", tt.name, auditIDs(got), err, auditIDs(tt.want))
+		}
+	}
+
+	got, _ := db.GetAuditEntries(ctx, &database.AuditQuery{Action: structs.AuditLogin})
+	if len(got) != 1 || got[0].ActorID == nil || *got[0].ActorID != jeff.ID || got[0].IP != "127.0.0.1" ||
+		!got[0].Timestamp.Equal(login.Timestamp) || got[0].Details["action"] != "login" {
+		t.Errorf("GetAuditEntries() got %v, wanted %v", got, login)
+	}
+	if got, _ := db.GetAuditEntries(ctx, &database.AuditQuery{Action: structs.AuditLoginFailed}); len(got) != 1 || got[0].ActorID != nil {
+		t.Errorf("GetAuditEntries() got %v, wanted an entry without an actor", got)
+	}
+	if _, err := db.GetAuditEntries(ctx, &database.AuditQuery{Before: uuid.New().String()}); !errors.Is(err, database.ErrAuditEntryNotFound) {
+		t.Errorf("GetAuditEntries() before a missing entry got %v, wanted %v", err, database.ErrAuditEntryNotFound)
+	}
+}
+
+func testConcurrency(t *testing.T, db database.DB) {
+	const (
+		writers = 8
+		each    = 25
+	)
+	channel := newChannel(t, db, structs.ChannelTypeText)
+	target := newMessage(t, db, channel.ID, nil, time.Now())
+
+	var users []*structs.User
+	for i := 0; i < writers; i++ {
+		users = append(users, newUser(t, db, fmt.Sprintf("user%d", i)))
+	}
+
+	// messages handed out are encoded while they change, like handlers do
+	// outside of any lock
+	done := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if msg, err := db.FindMessageByID(ctx, target.ID.String()); err == nil {
+				_, _ = json.Marshal(msg)
+			}
+			if msgs, err := db.GetRecentMessages(ctx, channel.ID.String(), 10); err == nil {
+				_, _ = json.Marshal(msgs)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*each*3)
+	for _, user := range users {
+		wg.Add(1)
+		go func(user *structs.User) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				_, err := db.CreateMessage(ctx, &structs.Message{
+					ID:        uuid.New(),
+					ChannelID: channel.ID,
+					Author:    user,
+					Content:   "message",
+					Timestamp: time.Now(),
+				})
+				if err != nil {
+					errs <- err
+				}
+				if _, err := db.CreateReaction(ctx, target.ID.String(), user, "👍"); err != nil {
+					errs <- err
+				}
+				// reactions that come and go change the message the most
+				if _, err := db.CreateReaction(ctx, target.ID.String(), user, "👎"); err != nil {
+					errs <- err
+				}
+				if _, err := db.DeleteReaction(ctx, target.ID.String(), user, "👎"); err != nil {
+					errs <- err
+				}
+				_, _ = db.GetRecentMessages(ctx, channel.ID.String(), 10)
+			}
+		}(user)
+	}
+	wg.Wait()
+	close(done)
+	<-read
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent write got %v, wanted nil", err)
+	}
+	if got, _ := db.GetRecentMessages(ctx, channel.ID.String(), writers*each*2); len(got) != writers*each+1 {
+		t.Errorf("len(GetRecentMessages()) got %v, wanted %v", len(got), writers*each+1)
+	}
+	got, _ := db.FindMessageByID(ctx, target.ID.String())
+	if got == nil || len(got.Reactions) != 1 || len(got.Reactions[0].Users) != writers {
+		t.Errorf("FindMessageByID().Reactions got %v, wanted one reaction by every writer", got)
+	}
+}
@@ -0,0 +1,219 @@
+package database
+
+import (
+	"time"
+
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// journalOp is a kind of change that can be made to the state of a JsonDB.
+type journalOp string
+
+const (
+	opPutUser            journalOp = "put_user"
+	opCreateChannel      journalOp = "create_channel"
+	opUpdateChannel      journalOp = "update_channel"
+	opDeleteChannel      journalOp = "delete_channel"
+	opAddMember          journalOp = "add_member"
+	opRemoveMember       journalOp = "remove_member"
+	opPutMessage         journalOp = "put_message"
+	opDeleteMessage      journalOp = "delete_message"
+	opPutRefreshToken    journalOp = "put_refresh_token"
+	opDeleteRefreshToken journalOp = "delete_refresh_token"
+	opRevokeToken        journalOp = "revoke_token"
+	opRevokeUserTokens   journalOp = "revoke_user_tokens"
+	opAddReaction        journalOp = "add_reaction"
+	opRemoveReaction     journalOp = "remove_reaction"
+	opPutReadState       journalOp = "put_read_state"
+	opPutAttachment      journalOp = "put_attachment"
+	opDeleteAttachment   journalOp = "delete_attachment"
+	opPutSanction        journalOp = "put_sanction"
+	opDeleteSanction     journalOp = "delete_sanction"
+	opAppendAudit        journalOp = "append_audit"
+)
+
+// journalEntry is a single change in the journal of a JsonDB. Which fields
+// are set depends on Op. Entries set or remove things rather than adjust
+// them, so that applying one twice does no harm.
+type journalEntry struct {
+	Seq int64     `json:"seq"`
+	Op  journalOp `json:"op"`
+
+	User         *structs.User         `json:"user,omitempty"`
+	Channel      *structs.Channel      `json:"channel,omitempty"`
+	Message      *structs.Message      `json:"message,omitempty"`
+	RefreshToken *structs.RefreshToken `json:"refresh_token,omitempty"`
+	ReadState    *structs.ReadState    `json:"read_state,omitempty"`
+	Attachment   *structs.Attachment   `json:"attachment,omitempty"`
+	Sanction     *structs.Sanction     `json:"sanction,omitempty"`
+	AuditEntry   *structs.AuditEntry   `json:"audit_entry,omitempty"`
+
+	// ID is the ID of what is deleted or changed
+	ID     string `json:"id,omitempty"`
+	UserID string `json:"user_id,omitempty"`
+	// UserIDs are the members a channel is created with
+	UserIDs []string   `json:"user_ids,omitempty"`
+	Emoji   string     `json:"emoji,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// apply makes the change an entry describes. The state must be locked.
+func (s *state) apply(e *journalEntry) {
+	switch e.Op {
+	case opPutUser:
+		s.Users[e.User.ID.String()] = e.User
+	case opCreateChannel:
+		id := e.Channel.ID.String()
+		s.Channels[id] = e.Channel
+		s.Members[id] = make(map[string]bool)
+		for _, userID := range e.UserIDs {
+			s.Members[id][userID] = true
+		}
+	case opUpdateChannel:
+		s.Channels[e.Channel.ID.String()] = e.Channel
+	case opDeleteChannel:
+		delete(s.Channels, e.ID)
+		delete(s.Members, e.ID)
+		for msgID, msg := range s.Messages {
+			if msg.ChannelID.String() == e.ID {
+				delete(s.Messages, msgID)
+			}
+		}
+		s.index.RemoveChannel(e.ID)
+		for _, states := range s.ReadStates {
+			delete(states, e.ID)
+		}
+		for id, a := range s.Attachments {
+			if a.ChannelID.String() == e.ID {
+				delete(s.Attachments, id)
+			}
+		}
+	case opAddMember:
+		if members, ok := s.Members[e.ID]; ok {
+			members[e.UserID] = true
+		}
+	case opRemoveMember:
+		delete(s.Members[e.ID], e.UserID)
+	case opPutMessage:
+		s.Messages[e.Message.ID.String()] = e.Message
+		s.index.Add(e.Message)
+	case opDeleteMessage:
+		delete(s.Messages, e.ID)
+		s.index.Remove(e.ID)
+	case opPutRefreshToken:
+		s.RefreshTokens[e.RefreshToken.Hash] = e.RefreshToken
+		// clean up while we are at it, so expired tokens do not pile up
+		for hash, t := range s.RefreshTokens {
+			if time.Now().After(t.Expires) {
+				delete(s.RefreshTokens, hash)
+			}
+		}
+	case opDeleteRefreshToken:
+		delete(s.RefreshTokens, e.ID)
+	case opRevokeToken:
+		s.Revoked[e.ID] = *e.Expires
+		for revokedID, exp := range s.Revoked {
+			if time.Now().After(exp) {
+				delete(s.Revoked, revokedID)
+			}
+		}
+	case opRevokeUserTokens:
+		s.TokenVersions[e.UserID]++
+	case opAddReaction:
+		if msg, ok := s.Messages[e.ID]; ok {
+			s.Messages[e.ID] = addReaction(msg, e.User, e.Emoji)
+		}
+	case opRemoveReaction:
+		if msg, ok := s.Messages[e.ID]; ok {
+			s.Messages[e.ID] = removeReaction(msg, e.User, e.Emoji)
+		}
+	case opPutReadState:
+		userID := e.ReadState.UserID.String()
+		if s.ReadStates[userID] == nil {
+			s.ReadStates[userID] = make(map[string]*structs.ReadState)
+		}
+		s.ReadStates[userID][e.ReadState.ChannelID.String()] = e.ReadState
+	case opPutAttachment:
+		s.Attachments[e.Attachment.ID.String()] = e.Attachment
+	case opDeleteAttachment:
+		delete(s.Attachments, e.ID)
+	case opPutSanction:
+		userID := e.Sanction.UserID.String()
+		if s.Sanctions[userID] == nil {
+			s.Sanctions[userID] = make(map[structs.SanctionType]*structs.Sanction)
+		}
+		s.Sanctions[userID][e.Sanction.Type] = e.Sanction
+	case opDeleteSanction:
+		userID := e.Sanction.UserID.String()
+		delete(s.Sanctions[userID], e.Sanction.Type)
+		if len(s.Sanctions[userID]) == 0 {
+			delete(s.Sanctions, userID)
+		}
+	case opAppendAudit:
+		s.Audit = append(s.Audit, e.AuditEntry)
+	}
+}
+
+// withReactions returns a copy of msg whose reactions can be changed without
+// affecting msg. Messages handed out by the JsonDB are read outside of its
+// lock, so they are never changed in place.
+func withReactions(msg *structs.Message) *structs.Message {
+	msgCopy := *msg
+	msgCopy.Reactions = make([]*structs.Reaction, len(msg.Reactions))
+	for i, r := range msg.Reactions {
+		msgCopy.Reactions[i] = &structs.Reaction{
+			Emoji: r.Emoji,
+			Users: append([]*structs.User(nil), r.Users...),
+		}
+	}
+	return &msgCopy
+}
+
+// addReaction returns msg with the reaction of a user added, unless it is
+// there already.
+func addReaction(msg *structs.Message, user *structs.User, emoji string) *structs.Message {
+	for _, r := range msg.Reactions {
+		if r.Emoji != emoji {
+			continue
+		}
+		for _, u := range r.Users {
+			if u.ID == user.ID {
+				return msg
+			}
+		}
+	}
+
+	msg = withReactions(msg)
+	for _, r := range msg.Reactions {
+		if r.Emoji == emoji {
+			r.Users = append(r.Users, user)
+			return msg
+		}
+	}
+	msg.Reactions = append(msg.Reactions, &structs.Reaction{Emoji: emoji, Users: []*structs.User{user}})
+	return msg
+}
+
+// removeReaction returns msg with the reaction of a user removed, if there is
+// one.
+func removeReaction(msg *structs.Message, user *structs.User, emoji string) *structs.Message {
+	for i, r := range msg.Reactions {
+		if r.Emoji != emoji {
+			continue
+		}
+		for k, u := range r.Users {
+			if u.ID != user.ID {
+				continue
+			}
+			msg = withReactions(msg)
+			r = msg.Reactions[i]
+			r.Users = append(r.Users[:k], r.Users[k+1:]...)
+			if len(r.Users) == 0 {
+				msg.Reactions = append(msg.Reactions[:i], msg.Reactions[i+1:]...)
+			}
+			return msg
+		}
+		return msg
+	}
+	return msg
+}
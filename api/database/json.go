@@ -1,46 +1,153 @@
 package database
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/search"
 	"github.com/intrntsrfr/vue-ws-test/structs"
 )
 
+// compactInterval is how often the journal is folded into the data file.
+const compactInterval = time.Minute
+
+// JsonDB keeps everything in memory, and stores it in a JSON data file.
+// Every change is appended to a journal before it is made, so that nothing
+// is lost if the process dies before the data file is written. Every so
+// often the data file is rewritten and the journal emptied.
 type JsonDB struct {
 	path  string
 	state *state
+
+	// journal is nil when the database only lives in memory
+	journal *os.File
+	// entries and size are how many entries and bytes the journal holds
+	entries int
+	size    int64
+	stop    chan struct{}
+	wg      sync.WaitGroup
 }
 
 type state struct {
 	sync.Mutex
+	// Version is the schema version of the data file
+	Version int `json:"version"`
+	// Seq is the sequence number of the last journal entry in the state
+	Seq      int64                       `json:"seq"`
 	Users    map[string]*structs.User    `json:"users"`
 	Messages map[string]*structs.Message `json:"messages"`
+	Channels map[string]*structs.Channel `json:"channels"`
+	// Members maps channel IDs to the set of user IDs that are in them
+	Members       map[string]map[string]bool       `json:"members"`
+	RefreshTokens map[string]*structs.RefreshToken `json:"refresh_tokens"`
+	// Revoked maps the IDs of revoked access tokens to when they expire
+	Revoked map[string]time.Time `json:"revoked"`
+	// TokenVersions maps user IDs to the version of their access tokens,
+	// which goes up every time all of them are revoked
+	TokenVersions map[string]int `json:"token_versions"`
+	// ReadStates maps user IDs to their read states, by channel ID
+	ReadStates  map[string]map[string]*structs.ReadState `json:"read_states"`
+	Attachments map[string]*structs.Attachment           `json:"attachments"`
+	// Sanctions maps user IDs to the sanctions on them, by type
+	Sanctions map[string]map[structs.SanctionType]*structs.Sanction `json:"sanctions"`
+	// Audit is the audit log, in the order it was recorded
+	Audit []*structs.AuditEntry `json:"audit"`
+
+	// index is the search index over Messages, which is rebuilt on load
+	// rather than stored
+	index *search.Index
+}
+
+func newState() *state {
+	return &state{
+		Version:  jsonSchemaVersion,
+		Users:    make(map[string]*structs.User),
+		Messages: make(map[string]*structs.Message),
+		Channels: make(map[string]*structs.Channel),
+		Members:  make(map[string]map[string]bool),
+
+		RefreshTokens: make(map[string]*structs.RefreshToken),
+		Revoked:       make(map[string]time.Time),
+		TokenVersions: make(map[string]int),
+		ReadStates:    make(map[string]map[string]*structs.ReadState),
+		Attachments:   make(map[string]*structs.Attachment),
+		Sanctions:     make(map[string]map[structs.SanctionType]*structs.Sanction),
+		Audit:         make([]*structs.AuditEntry, 0),
+
+		index: search.NewIndex(),
+	}
 }
 
+// Open loads the data file at path and replays its journal on top. An empty
+// path opens a database that only lives in memory.
 func Open(path string) (*JsonDB, error) {
 	var (
 		db  *JsonDB
 		err error
 	)
 	db = &JsonDB{
-		path: path,
-		state: &state{
-			Users:    make(map[string]*structs.User, 0),
-			Messages: make(map[string]*structs.Message, 0),
-		},
+		path:  path,
+		state: newState(),
 	}
 	if path != "" {
 		err = db.load(path)
 	}
-	return db, err
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := db.replay(); err != nil {
+			return nil, err
+		}
+	}
+	db.ensureDefaultChannel()
+
+	if path == "" {
+		return db, nil
+	}
+	db.journal, err = os.OpenFile(db.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// start from a clean journal, without any half written entry a crash
+	// may have left at the end
+	db.state.Lock()
+	err = db.compact()
+	db.state.Unlock()
+	if err != nil {
+		_ = db.journal.Close()
+		return nil, err
+	}
+
+	db.stop = make(chan struct{})
+	db.wg.Add(1)
+	go db.compactLoop()
+	return db, nil
 }
 
 func (j *JsonDB) Close() error {
-	return j.save()
+	if j.journal == nil {
+		return nil
+	}
+	close(j.stop)
+	j.wg.Wait()
+
+	j.state.Lock()
+	defer j.state.Unlock()
+	if err := j.compact(); err != nil {
+		return err
+	}
+	return j.journal.Close()
 }
 
 func (j *JsonDB) load(path string) error {
@@ -56,88 +163,871 @@ func (j *JsonDB) load(path string) error {
 		return err
 	}
 
-	state := &state{}
-	err = json.Unmarshal(d, &state)
+	migrated, applied, err := migrateJSON(d)
+	if err != nil {
+		return err
+	}
+	if len(applied) > 0 {
+		if err := j.backup(d, applied[0].Version-1); err != nil {
+			return err
+		}
+		for _, m := range applied {
+			fmt.Println("migrated data file to version", m)
+		}
+	}
+
+	state := newState()
+	err = json.Unmarshal(migrated, &state)
 	if err != nil {
 		return err
 	}
+	for _, msg := range state.Messages {
+		state.index.Add(msg)
+	}
 
 	j.state = state
 	return nil
 }
 
-func (j *JsonDB) save() error {
+// backup keeps a copy of the data file, and the journal if there is one, from
+// before they were migrated away from version.
+func (j *JsonDB) backup(d []byte, version int) error {
+	path := backupPath(j.path, version)
+	if err := os.WriteFile(path, d, 0644); err != nil {
+		return err
+	}
+	fmt.Println("backed up data file to", path)
+
+	journal, err := os.ReadFile(j.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".journal", journal, 0644)
+}
+
+func (j *JsonDB) journalPath() string {
+	return j.path + ".journal"
+}
+
+// compact writes the state to the data file and empties the journal. The
+// data file is replaced by renaming a new one over it, so that it is never
+// half written. The state must be locked.
+func (j *JsonDB) compact() error {
 	d, err := json.Marshal(j.state)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(j.path))
+
+	// if we die before this, the entries are skipped on replay, as the data
+	// file already has their sequence numbers
+	if err := j.journal.Truncate(0); err != nil {
+		return err
+	}
+	j.entries, j.size = 0, 0
+	return j.journal.Sync()
+}
+
+// syncDir flushes a directory, so that a rename in it survives a crash. Not
+// every platform supports this, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
 	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
+
+func (j *JsonDB) compactLoop() {
+	defer j.wg.Done()
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.state.Lock()
+			if j.entries > 0 {
+				if err := j.compact(); err != nil {
+					fmt.Println("compacting journal:", err)
+				}
+			}
+			j.state.Unlock()
+		}
+	}
+}
+
+// replay applies the journal entries that are newer than the data file. A
+// crash in the middle of writing an entry leaves it cut off at the end of
+// the journal, so such an entry is left out.
+func (j *JsonDB) replay() error {
+	f, err := os.Open(j.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = f.Write(d)
-	return err
+
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// anything left is an entry that was never finished
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("journal entry %d: %w", n, err)
+		}
+		if entry.Seq <= j.state.Seq {
+			continue
+		}
+		j.state.apply(&entry)
+		j.state.Seq = entry.Seq
+	}
+}
+
+// commit writes a change to the journal, and then makes it. The state must be
+// locked.
+func (j *JsonDB) commit(entry *journalEntry) error {
+	entry.Seq = j.state.Seq + 1
+	if j.journal != nil {
+		d, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		d = append(d, '\n')
+		if _, err := j.journal.Write(d); err != nil {
+			// do not leave half an entry for the next one to be appended to
+			_ = j.journal.Truncate(j.size)
+			return err
+		}
+		if err := j.journal.Sync(); err != nil {
+			_ = j.journal.Truncate(j.size)
+			return err
+		}
+		j.entries++
+		j.size += int64(len(d))
+	}
+	j.state.apply(entry)
+	j.state.Seq = entry.Seq
+	return nil
+}
+
+// ensureDefaultChannel creates a general channel if there are no channels,
+// and makes every existing user a member.
+func (j *JsonDB) ensureDefaultChannel() {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	if len(j.state.Channels) > 0 {
+		return
+	}
+
+	channel := &structs.Channel{
+		ID:      uuid.New(),
+		Name:    "general",
+		Created: time.Now(),
+	}
+	id := channel.ID.String()
+	j.state.Channels[id] = channel
+	j.state.Members[id] = make(map[string]bool)
+	for userID := range j.state.Users {
+		j.state.Members[id][userID] = true
+	}
+}
+
+// usernameTaken reports whether a user other than id has username. The state
+// must be locked.
+func (j *JsonDB) usernameTaken(username string, id uuid.UUID) bool {
+	for _, u := range j.state.Users {
+		if u.Username == username && u.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *JsonDB) CreateUser(_ context.Context, u *structs.User) (*structs.User, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if j.usernameTaken(u.Username, u.ID) {
+		return nil, ErrUsernameTaken
+	}
+	if err := j.commit(&journalEntry{Op: opPutUser, User: u}); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
-func (j *JsonDB) CreateUser(u *structs.User) (*structs.User, error) {
+func (j *JsonDB) UpdateUser(_ context.Context, u *structs.User) (*structs.User, error) {
 	j.state.Lock()
 	defer j.state.Unlock()
-	j.state.Users[u.ID.String()] = u
+	if _, ok := j.state.Users[u.ID.String()]; !ok {
+		return nil, ErrUserNotFound
+	}
+	if j.usernameTaken(u.Username, u.ID) {
+		return nil, ErrUsernameTaken
+	}
+	if err := j.commit(&journalEntry{Op: opPutUser, User: u}); err != nil {
+		return nil, err
+	}
 	return u, nil
 }
 
-func (j *JsonDB) FindUserByID(id string) *structs.User {
+func (j *JsonDB) FindUserByID(_ context.Context, id string) (*structs.User, error) {
 	j.state.Lock()
 	defer j.state.Unlock()
-	return j.state.Users[id]
+	u, ok := j.state.Users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return u, nil
 }
 
-func (j *JsonDB) FindUserByUsername(username string) *structs.User {
+func (j *JsonDB) FindUserByUsername(_ context.Context, username string) (*structs.User, error) {
 	j.state.Lock()
 	defer j.state.Unlock()
 	for _, u := range j.state.Users {
 		if u.Username == username {
-			return u
+			return u, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (j *JsonDB) CountUsers(_ context.Context) (int, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	return len(j.state.Users), nil
+}
+
+func (j *JsonDB) ClaimOwnership(_ context.Context, userID string) (bool, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	u, ok := j.state.Users[userID]
+	if !ok {
+		return false, ErrUserNotFound
+	}
+	for _, other := range j.state.Users {
+		if other.Role == structs.RoleOwner {
+			return false, nil
+		}
+	}
+	owner := *u
+	owner.Role = structs.RoleOwner
+	if err := j.commit(&journalEntry{Op: opPutUser, User: &owner}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (j *JsonDB) CreateChannel(_ context.Context, channel *structs.Channel) (*structs.Channel, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if err := j.commit(&journalEntry{Op: opCreateChannel, Channel: channel}); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (j *JsonDB) CreateChannelWithMembers(_ context.Context, channel *structs.Channel, memberIDs []string) (*structs.Channel, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if channel.Type == structs.ChannelTypeDM {
+		userID, otherID, err := directPair(memberIDs)
+		if err != nil {
+			return nil, err
+		}
+		if j.findDirectChannel(userID, otherID) != nil {
+			return nil, ErrDirectChannelTaken
+		}
+	}
+	if err := j.commit(&journalEntry{Op: opCreateChannel, Channel: channel, UserIDs: memberIDs}); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (j *JsonDB) UpdateChannel(_ context.Context, channel *structs.Channel) (*structs.Channel, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Channels[channel.ID.String()]; !ok {
+		return nil, ErrChannelNotFound
+	}
+	if err := j.commit(&journalEntry{Op: opUpdateChannel, Channel: channel}); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (j *JsonDB) DeleteChannel(_ context.Context, id string) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Channels[id]; !ok {
+		return ErrChannelNotFound
+	}
+	return j.commit(&journalEntry{Op: opDeleteChannel, ID: id})
+}
+
+func (j *JsonDB) FindChannelByID(_ context.Context, id string) (*structs.Channel, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	channel, ok := j.state.Channels[id]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	return channel, nil
+}
+
+func (j *JsonDB) GetChannels(_ context.Context) ([]*structs.Channel, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	channels := make([]*structs.Channel, 0, len(j.state.Channels))
+	for _, channel := range j.state.Channels {
+		if !channel.Private() {
+			channels = append(channels, channel)
+		}
+	}
+	sortChannels(channels)
+	return channels, nil
+}
+
+func (j *JsonDB) FindDirectChannel(_ context.Context, userID, otherID string) (*structs.Channel, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if channel := j.findDirectChannel(userID, otherID); channel != nil {
+		return channel, nil
+	}
+	return nil, ErrChannelNotFound
+}
+
+// findDirectChannel returns the DM channel between two users, or nil if there
+// is none. The state must be locked.
+func (j *JsonDB) findDirectChannel(userID, otherID string) *structs.Channel {
+	for id, channel := range j.state.Channels {
+		members := j.state.Members[id]
+		if channel.Type == structs.ChannelTypeDM && len(members) == 2 && members[userID] && members[otherID] {
+			return channel
 		}
 	}
 	return nil
 }
 
-func (j *JsonDB) CreateMessage(message *structs.Message) (*structs.Message, error) {
+func (j *JsonDB) AddChannelMember(_ context.Context, channelID, userID string) error {
 	j.state.Lock()
 	defer j.state.Unlock()
-	j.state.Messages[message.ID.String()] = message
+	if _, ok := j.state.Members[channelID]; !ok {
+		return ErrChannelNotFound
+	}
+	return j.commit(&journalEntry{Op: opAddMember, ID: channelID, UserID: userID})
+}
+
+func (j *JsonDB) RemoveChannelMember(_ context.Context, channelID, userID string) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Members[channelID]; !ok {
+		return ErrChannelNotFound
+	}
+	return j.commit(&journalEntry{Op: opRemoveMember, ID: channelID, UserID: userID})
+}
+
+func (j *JsonDB) IsChannelMember(_ context.Context, channelID, userID string) (bool, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	return j.state.Members[channelID][userID], nil
+}
+
+func (j *JsonDB) GetChannelMembers(_ context.Context, channelID string) ([]*structs.User, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	users := make([]*structs.User, 0, len(j.state.Members[channelID]))
+	for userID := range j.state.Members[channelID] {
+		if u, ok := j.state.Users[userID]; ok {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, k int) bool { return users[i].Username < users[k].Username })
+	return users, nil
+}
+
+func (j *JsonDB) GetUserChannels(_ context.Context, userID string) ([]*structs.Channel, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	channels := make([]*structs.Channel, 0)
+	for channelID, members := range j.state.Members {
+		if members[userID] {
+			channels = append(channels, j.state.Channels[channelID])
+		}
+	}
+	sortChannels(channels)
+	return channels, nil
+}
+
+// sortChannels sorts channels by when they were created.
+func sortChannels(channels []*structs.Channel) {
+	sort.Slice(channels, func(i, k int) bool { return channels[i].Created.Before(channels[k].Created) })
+}
+
+func (j *JsonDB) CreateMessage(_ context.Context, message *structs.Message) (*structs.Message, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if err := j.commit(&journalEntry{Op: opPutMessage, Message: message}); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (j *JsonDB) UpdateMessage(_ context.Context, message *structs.Message) (*structs.Message, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Messages[message.ID.String()]; !ok {
+		return nil, ErrMessageNotFound
+	}
+	if err := j.commit(&journalEntry{Op: opPutMessage, Message: message}); err != nil {
+		return nil, err
+	}
 	return message, nil
 }
 
-func (j *JsonDB) GetRecentMessages(limit int) []*structs.Message {
+func (j *JsonDB) DeleteMessage(_ context.Context, id string) error {
 	j.state.Lock()
 	defer j.state.Unlock()
+	if _, ok := j.state.Messages[id]; !ok {
+		return ErrMessageNotFound
+	}
+	return j.commit(&journalEntry{Op: opDeleteMessage, ID: id})
+}
+
+func (j *JsonDB) FindMessageByID(_ context.Context, id string) (*structs.Message, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	msg, ok := j.state.Messages[id]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	return msg, nil
+}
 
-	var messages []*structs.Message
+// sortedMessages returns all messages in a channel, oldest first. The state
+// must be locked.
+func (j *JsonDB) sortedMessages(channelID string) []*structs.Message {
+	messages := make([]*structs.Message, 0)
 	for _, msg := range j.state.Messages {
-		messages = append(messages, msg)
+		if msg.ChannelID.String() == channelID {
+			messages = append(messages, msg)
+		}
 	}
 	sort.Sort(structs.ByTime{Messages: messages})
+	return messages
+}
+
+func (j *JsonDB) GetRecentMessages(_ context.Context, channelID string, limit int) ([]*structs.Message, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	messages := j.sortedMessages(channelID)
+	return tail(messages, limit), nil
+}
+
+// compareCursor returns -1 if msg comes before the cursor, 1 if it comes
+// after it, and 0 if it is at it.
+func compareCursor(msg *structs.Message, cursor MessageCursor) int {
+	switch {
+	case msg.Timestamp.Before(cursor.Timestamp):
+		return -1
+	case msg.Timestamp.After(cursor.Timestamp):
+		return 1
+	case cursor.ID == "":
+		return 0
+	}
+	return strings.Compare(msg.ID.String(), cursor.ID)
+}
+
+func (j *JsonDB) GetMessagesBefore(_ context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	messages := j.sortedMessages(channelID)
+	i := sort.Search(len(messages), func(i int) bool { return compareCursor(messages[i], cursor) >= 0 })
+	return tail(messages[:i], limit), nil
+}
+
+func (j *JsonDB) GetMessagesAfter(_ context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	messages := j.sortedMessages(channelID)
+	i := sort.Search(len(messages), func(i int) bool { return compareCursor(messages[i], cursor) > 0 })
+	return head(messages[i:], limit), nil
+}
+
+func (j *JsonDB) GetMessagesAround(_ context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	messages := j.sortedMessages(channelID)
+	i := sort.Search(len(messages), func(i int) bool { return compareCursor(messages[i], cursor) >= 0 })
+	before := tail(messages[:i], limit/2)
+	after := head(messages[i:], limit-len(before))
+	return append(before, after...), nil
+}
+
+// head returns a copy of the first n messages.
+func head(messages []*structs.Message, n int) []*structs.Message {
+	if n > len(messages) {
+		n = len(messages)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return append([]*structs.Message{}, messages[:n]...)
+}
 
-	recent := make([]*structs.Message, 0)
-	for i, msg := range messages {
-		if i >= limit {
-			break
+// tail returns a copy of the last n messages.
+func tail(messages []*structs.Message, n int) []*structs.Message {
+	if n > len(messages) {
+		n = len(messages)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return append([]*structs.Message{}, messages[len(messages)-n:]...)
+}
+
+func (j *JsonDB) CreateRefreshToken(_ context.Context, token *structs.RefreshToken) (*structs.RefreshToken, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if err := j.commit(&journalEntry{Op: opPutRefreshToken, RefreshToken: token}); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (j *JsonDB) FindRefreshToken(_ context.Context, hash string) (*structs.RefreshToken, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	token, ok := j.state.RefreshTokens[hash]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func (j *JsonDB) DeleteRefreshToken(_ context.Context, hash string) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.RefreshTokens[hash]; !ok {
+		return ErrTokenNotFound
+	}
+	return j.commit(&journalEntry{Op: opDeleteRefreshToken, ID: hash})
+}
+
+func (j *JsonDB) DeleteUserRefreshTokens(_ context.Context, userID string) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	for hash, token := range j.state.RefreshTokens {
+		if token.UserID.String() != userID {
+			continue
+		}
+		if err := j.commit(&journalEntry{Op: opDeleteRefreshToken, ID: hash}); err != nil {
+			return err
 		}
-		recent = append(recent, msg)
 	}
-	return recent
+	return nil
+}
+
+func (j *JsonDB) RevokeToken(_ context.Context, id string, expires time.Time) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	return j.commit(&journalEntry{Op: opRevokeToken, ID: id, Expires: &expires})
+}
+
+func (j *JsonDB) IsTokenRevoked(_ context.Context, id string) (bool, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	_, ok := j.state.Revoked[id]
+	return ok, nil
+}
+
+func (j *JsonDB) RevokeUserTokens(_ context.Context, userID string) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	return j.commit(&journalEntry{Op: opRevokeUserTokens, UserID: userID})
+}
+
+func (j *JsonDB) UserTokenVersion(_ context.Context, userID string) (int, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	return j.state.TokenVersions[userID], nil
 }
 
-func (j *JsonDB) CreateReaction(messageID string, emoji rune) error {
-	//TODO implement me
-	panic("implement me")
+func (j *JsonDB) CreateReaction(_ context.Context, messageID string, user *structs.User, emoji string) (bool, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	msg, ok := j.state.Messages[messageID]
+	if !ok {
+		return false, ErrMessageNotFound
+	}
+	if hasReaction(msg, user, emoji) {
+		return false, nil
+	}
+	if err := j.commit(&journalEntry{Op: opAddReaction, ID: messageID, User: user, Emoji: emoji}); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (j *JsonDB) DeleteReaction(messageID string, emoji rune) error {
-	//TODO implement me
-	panic("implement me")
+func (j *JsonDB) DeleteReaction(_ context.Context, messageID string, user *structs.User, emoji string) (bool, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	msg, ok := j.state.Messages[messageID]
+	if !ok {
+		return false, ErrMessageNotFound
+	}
+	if !hasReaction(msg, user, emoji) {
+		return false, nil
+	}
+	if err := j.commit(&journalEntry{Op: opRemoveReaction, ID: messageID, User: user, Emoji: emoji}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hasReaction reports whether a user has reacted to a message with emoji.
+func hasReaction(msg *structs.Message, user *structs.User, emoji string) bool {
+	for _, r := range msg.Reactions {
+		if r.Emoji != emoji {
+			continue
+		}
+		for _, u := range r.Users {
+			if u.ID == user.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (j *JsonDB) SetReadState(_ context.Context, state *structs.ReadState) (bool, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Channels[state.ChannelID.String()]; !ok {
+		return false, ErrChannelNotFound
+	}
+	if prev, ok := j.state.ReadStates[state.UserID.String()][state.ChannelID.String()]; ok && !state.Timestamp.After(prev.Timestamp) {
+		return false, nil
+	}
+	if err := j.commit(&journalEntry{Op: opPutReadState, ReadState: state}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (j *JsonDB) GetReadStates(_ context.Context, userID string) ([]*structs.ReadState, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	states := make([]*structs.ReadState, 0, len(j.state.ReadStates[userID]))
+	for _, state := range j.state.ReadStates[userID] {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, k int) bool { return states[i].ChannelID.String() < states[k].ChannelID.String() })
+	return states, nil
+}
+
+func (j *JsonDB) CountMessagesAfter(_ context.Context, channelID, userID string, t time.Time, mention string) (count, mentions int, err error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	for _, msg := range j.state.Messages {
+		if msg.ChannelID.String() != channelID || !msg.Timestamp.After(t) {
+			continue
+		}
+		if msg.Author != nil && msg.Author.ID.String() == userID {
+			continue
+		}
+		count++
+		if search.Mentions(msg.Content, mention) {
+			mentions++
+		}
+	}
+	return count, mentions, nil
+}
+
+func (j *JsonDB) CreateAttachment(_ context.Context, attachment *structs.Attachment) (*structs.Attachment, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Channels[attachment.ChannelID.String()]; !ok {
+		return nil, ErrChannelNotFound
+	}
+	if _, ok := j.state.Attachments[attachment.ID.String()]; ok {
+		return nil, ErrConflict
+	}
+	if err := j.commit(&journalEntry{Op: opPutAttachment, Attachment: attachment}); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+func (j *JsonDB) FindAttachmentByID(_ context.Context, id string) (*structs.Attachment, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	a, ok := j.state.Attachments[id]
+	if !ok {
+		return nil, ErrAttachmentNotFound
+	}
+	return a, nil
+}
+
+func (j *JsonDB) DeleteUnattachedAttachments(_ context.Context, before time.Time) ([]*structs.Attachment, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	attached := make(map[uuid.UUID]bool)
+	for _, msg := range j.state.Messages {
+		for _, a := range msg.Attachments {
+			attached[a.ID] = true
+		}
+	}
+
+	deleted := make([]*structs.Attachment, 0)
+	for id, a := range j.state.Attachments {
+		if attached[a.ID] || !a.Created.Before(before) {
+			continue
+		}
+		if err := j.commit(&journalEntry{Op: opDeleteAttachment, ID: id}); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, a)
+	}
+	return deleted, nil
+}
+
+func (j *JsonDB) SetSanction(_ context.Context, sanction *structs.Sanction) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	if _, ok := j.state.Users[sanction.UserID.String()]; !ok {
+		return ErrUserNotFound
+	}
+	return j.commit(&journalEntry{Op: opPutSanction, Sanction: sanction})
+}
+
+func (j *JsonDB) FindSanction(_ context.Context, userID string, sanctionType structs.SanctionType) (*structs.Sanction, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	sanction, ok := j.state.Sanctions[userID][sanctionType]
+	if !ok {
+		return nil, ErrSanctionNotFound
+	}
+	return sanction, nil
+}
+
+func (j *JsonDB) DeleteSanction(_ context.Context, userID string, sanctionType structs.SanctionType) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	sanction, ok := j.state.Sanctions[userID][sanctionType]
+	if !ok {
+		return ErrSanctionNotFound
+	}
+	return j.commit(&journalEntry{Op: opDeleteSanction, Sanction: sanction})
+}
+
+func (j *JsonDB) CreateAuditEntry(_ context.Context, entry *structs.AuditEntry) error {
+	j.state.Lock()
+	defer j.state.Unlock()
+	return j.commit(&journalEntry{Op: opAppendAudit, AuditEntry: entry})
+}
+
+// auditNewer orders audit log entries newest first, falling back to the ID for
+// entries recorded at the same instant.
+func auditNewer(a, b *structs.AuditEntry) bool {
+	if a.Timestamp.Equal(b.Timestamp) {
+		return a.ID.String() > b.ID.String()
+	}
+	return a.Timestamp.After(b.Timestamp)
+}
+
+func (j *JsonDB) GetAuditEntries(_ context.Context, q *AuditQuery) ([]*structs.AuditEntry, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+
+	var before *structs.AuditEntry
+	if q.Before != "" {
+		for _, entry := range j.state.Audit {
+			if entry.ID.String() == q.Before {
+				before = entry
+				break
+			}
+		}
+		if before == nil {
+			return nil, ErrAuditEntryNotFound
+		}
+	}
+
+	entries := make([]*structs.AuditEntry, 0)
+	for _, entry := range j.state.Audit {
+		if q.Action != "" && entry.Action != q.Action {
+			continue
+		}
+		if q.ActorID != "" && (entry.ActorID == nil || entry.ActorID.String() != q.ActorID) {
+			continue
+		}
+		if q.TargetID != "" && entry.TargetID != q.TargetID {
+			continue
+		}
+		if before != nil && !auditNewer(before, entry) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, k int) bool { return auditNewer(entries[i], entries[k]) })
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
+
+func (j *JsonDB) SearchMessages(_ context.Context, q *search.Query) ([]*structs.Message, int, error) {
+	j.state.Lock()
+	defer j.state.Unlock()
+	ids, total := j.state.index.Search(q)
+	messages := make([]*structs.Message, 0, len(ids))
+	for _, id := range ids {
+		if msg, ok := j.state.Messages[id]; ok {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, total, nil
 }
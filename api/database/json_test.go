@@ -1,13 +1,19 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"github.com/google/uuid"
 	"github.com/intrntsrfr/vue-ws-test/structs"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 )
 
+var ctx = context.Background()
+
 func TestJsonDB_CreateMessage(t *testing.T) {
 	db, err := Open("")
 	if err != nil {
@@ -22,7 +28,7 @@ func TestJsonDB_CreateMessage(t *testing.T) {
 		Reactions: nil,
 	}
 
-	msg, err = db.CreateMessage(msg)
+	msg, err = db.CreateMessage(ctx, msg)
 	if err != nil {
 		t.Errorf("encountered error: %v", err)
 	}
@@ -53,7 +59,7 @@ func TestJsonDB_CreateUser(t *testing.T) {
 		Created:  time.Now(),
 	}
 
-	user, err = db.CreateUser(user)
+	user, err = db.CreateUser(ctx, user)
 	if err != nil {
 		t.Errorf("encountered error: %v", err)
 	}
@@ -94,7 +100,7 @@ func TestJsonDB_FindUserByID(t *testing.T) {
 				path:  tt.fields.path,
 				state: tt.fields.state,
 			}
-			if got := j.FindUserByID(tt.args.id); !reflect.DeepEqual(got, tt.want) {
+			if got, _ := j.FindUserByID(ctx, tt.args.id); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("FindUserByID() = %v, want %v", got, tt.want)
 			}
 		})
@@ -123,7 +129,7 @@ func TestJsonDB_FindUserByUsername(t *testing.T) {
 				path:  tt.fields.path,
 				state: tt.fields.state,
 			}
-			if got := j.FindUserByUsername(tt.args.username); !reflect.DeepEqual(got, tt.want) {
+			if got, _ := j.FindUserByUsername(ctx, tt.args.username); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("FindUserByUsername() = %v, want %v", got, tt.want)
 			}
 		})
@@ -136,7 +142,8 @@ func TestJsonDB_GetRecentMessages(t *testing.T) {
 		state *state
 	}
 	type args struct {
-		limit int
+		channelID string
+		limit     int
 	}
 	tests := []struct {
 		name   string
@@ -152,9 +159,284 @@ func TestJsonDB_GetRecentMessages(t *testing.T) {
 				path:  tt.fields.path,
 				state: tt.fields.state,
 			}
-			if got := j.GetRecentMessages(tt.args.limit); !reflect.DeepEqual(got, tt.want) {
+			if got, _ := j.GetRecentMessages(ctx, tt.args.channelID, tt.args.limit); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("GetRecentMessages() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestJsonDB_Reactions(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+
+	msg, _ := db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), Content: "message", Timestamp: time.Now()})
+	jeff := &structs.User{ID: uuid.New(), Username: "jeff"}
+	bob := &structs.User{ID: uuid.New(), Username: "bob"}
+
+	if added, err := db.CreateReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || !added {
+		t.Errorf("CreateReaction() got (%v, %v), wanted (true, nil)", added, err)
+	}
+	if added, err := db.CreateReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || added {
+		t.Errorf("CreateReaction() twice got (%v, %v), wanted (false, nil)", added, err)
+	}
+	_, _ = db.CreateReaction(ctx, msg.ID.String(), bob, "👍🏽")
+
+	// messages already handed out are left alone, since they can be read
+	// outside of the lock
+	if len(msg.Reactions) != 0 {
+		t.Errorf("msg.Reactions of the created message got %v, wanted it unchanged", msg.Reactions)
+	}
+	found, _ := db.FindMessageByID(ctx, msg.ID.String())
+	if len(found.Reactions) != 1 || len(found.Reactions[0].Users) != 2 {
+		t.Fatalf("Reactions got %v, wanted one reaction with two users", found.Reactions)
+	}
+
+	if removed, err := db.DeleteReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || !removed {
+		t.Errorf("DeleteReaction() got (%v, %v), wanted (true, nil)", removed, err)
+	}
+	if removed, err := db.DeleteReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || removed {
+		t.Errorf("DeleteReaction() twice got (%v, %v), wanted (false, nil)", removed, err)
+	}
+	_, _ = db.DeleteReaction(ctx, msg.ID.String(), bob, "👍🏽")
+
+	if len(found.Reactions) != 1 || len(found.Reactions[0].Users) != 2 {
+		t.Errorf("Reactions of the found message got %v, wanted them unchanged", found.Reactions)
+	}
+	found, _ = db.FindMessageByID(ctx, msg.ID.String())
+	if len(found.Reactions) != 0 {
+		t.Errorf("len(Reactions) got %v, wanted 0", len(found.Reactions))
+	}
+
+	if _, err := db.CreateReaction(ctx, uuid.New().String(), jeff, "👍🏽"); err != ErrMessageNotFound {
+		t.Errorf("CreateReaction() on missing message got %v, wanted %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestJsonDB_UpdateDeleteMessage(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+
+	msg, _ := db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), Content: "message", Timestamp: time.Now()})
+
+	msgCopy := *msg
+	msgCopy.Content = "edited"
+	if _, err := db.UpdateMessage(ctx, &msgCopy); err != nil {
+		t.Errorf("UpdateMessage() got %v, wanted nil", err)
+	}
+	if got, _ := db.FindMessageByID(ctx, msg.ID.String()); got == nil || got.Content != "edited" {
+		t.Errorf("FindMessageByID() got %v, wanted edited message", got)
+	}
+
+	if err := db.DeleteMessage(ctx, msg.ID.String()); err != nil {
+		t.Errorf("DeleteMessage() got %v, wanted nil", err)
+	}
+	if got, _ := db.FindMessageByID(ctx, msg.ID.String()); got != nil {
+		t.Errorf("FindMessageByID() got %v, wanted nil", got)
+	}
+	if err := db.DeleteMessage(ctx, msg.ID.String()); err != ErrMessageNotFound {
+		t.Errorf("DeleteMessage() twice got %v, wanted %v", err, ErrMessageNotFound)
+	}
+	if _, err := db.UpdateMessage(ctx, &msgCopy); err != ErrMessageNotFound {
+		t.Errorf("UpdateMessage() on missing message got %v, wanted %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestJsonDB_MessagePagination(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+
+	channel, _ := db.CreateChannel(ctx, &structs.Channel{ID: uuid.New(), Name: "test"})
+	id := channel.ID.String()
+
+	start := time.Now()
+	var msgs []*structs.Message
+	for i := 0; i < 10; i++ {
+		msg, _ := db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), ChannelID: channel.ID, Timestamp: start.Add(time.Duration(i) * time.Second)})
+		msgs = append(msgs, msg)
+	}
+
+	messages := func(msgs []*structs.Message, _ error) []*structs.Message { return msgs }
+	at := func(msg *structs.Message) MessageCursor {
+		return MessageCursor{Timestamp: msg.Timestamp, ID: msg.ID.String()}
+	}
+	tests := []struct {
+		name string
+		got  []*structs.Message
+		want []*structs.Message
+	}{
+		{"recent", messages(db.GetRecentMessages(ctx, id, 3)), msgs[7:]},
+		{"recent over limit", messages(db.GetRecentMessages(ctx, id, 20)), msgs},
+		{"before", messages(db.GetMessagesBefore(ctx, id, at(msgs[5]), 3)), msgs[2:5]},
+		{"before start", messages(db.GetMessagesBefore(ctx, id, at(msgs[0]), 3)), []*structs.Message{}},
+		{"after", messages(db.GetMessagesAfter(ctx, id, at(msgs[5]), 3)), msgs[6:9]},
+		{"after end", messages(db.GetMessagesAfter(ctx, id, at(msgs[9]), 3)), []*structs.Message{}},
+		{"around", messages(db.GetMessagesAround(ctx, id, at(msgs[5]), 4)), msgs[3:7]},
+		{"around start", messages(db.GetMessagesAround(ctx, id, at(msgs[0]), 4)), msgs[0:4]},
+		{"after timestamp", messages(db.GetMessagesAfter(ctx, id, MessageCursor{Timestamp: msgs[5].Timestamp}, 3)), msgs[6:9]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("got %v messages, want %v", len(tt.got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestJsonDB_Channels(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+
+	if len(db.state.Channels) != 1 {
+		t.Fatalf("len(state.Channels) got %v, wanted a default channel", len(db.state.Channels))
+	}
+
+	user, _ := db.CreateUser(ctx, &structs.User{ID: uuid.New(), Username: "jeff"})
+	channel, _ := db.CreateChannel(ctx, &structs.Channel{ID: uuid.New(), Name: "memes", Created: time.Now()})
+	channelID, userID := channel.ID.String(), user.ID.String()
+
+	if err := db.AddChannelMember(ctx, channelID, userID); err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+	if ok, _ := db.IsChannelMember(ctx, channelID, userID); !ok {
+		t.Errorf("IsChannelMember() got false, wanted true")
+	}
+	if channels, _ := db.GetUserChannels(ctx, userID); len(channels) != 1 || channels[0] != channel {
+		t.Errorf("GetUserChannels() got %v, wanted [%v]", channels, channel)
+	}
+
+	_, _ = db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), ChannelID: channel.ID, Timestamp: time.Now()})
+	if msgs, _ := db.GetRecentMessages(ctx, channelID, 50); len(msgs) != 1 {
+		t.Errorf("len(GetRecentMessages()) got %v, wanted 1", len(msgs))
+	}
+
+	if err := db.DeleteChannel(ctx, channelID); err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+	if ok, _ := db.IsChannelMember(ctx, channelID, userID); ok || len(db.state.Messages) != 0 {
+		t.Errorf("DeleteChannel() left members or messages behind")
+	}
+	if err := db.AddChannelMember(ctx, channelID, userID); err != ErrChannelNotFound {
+		t.Errorf("AddChannelMember() on deleted channel got %v, wanted %v", err, ErrChannelNotFound)
+	}
+}
+
+func TestJsonDB_FindDirectChannel(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+
+	jeff, bob, alice := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	dm, _ := db.CreateChannel(ctx, &structs.Channel{ID: uuid.New(), Type: structs.ChannelTypeDM})
+	_ = db.AddChannelMember(ctx, dm.ID.String(), jeff)
+	_ = db.AddChannelMember(ctx, dm.ID.String(), bob)
+	group, _ := db.CreateChannel(ctx, &structs.Channel{ID: uuid.New(), Type: structs.ChannelTypeGroup})
+	_ = db.AddChannelMember(ctx, group.ID.String(), jeff)
+	_ = db.AddChannelMember(ctx, group.ID.String(), alice)
+
+	if got, _ := db.FindDirectChannel(ctx, bob, jeff); got != dm {
+		t.Errorf("FindDirectChannel() got %v, wanted %v", got, dm)
+	}
+	if got, err := db.FindDirectChannel(ctx, jeff, alice); !errors.Is(err, ErrChannelNotFound) {
+		t.Errorf("FindDirectChannel() got (%v, %v), wanted %v", got, err, ErrChannelNotFound)
+	}
+	channels, _ := db.GetChannels(ctx)
+	for _, channel := range channels {
+		if channel.Private() {
+			t.Errorf("GetChannels() returned private channel %v", channel.ID)
+		}
+	}
+}
+
+func TestJsonDB_RevokeToken(t *testing.T) {
+	db, err := Open("")
+	if err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+
+	_ = db.RevokeToken(ctx, "expired", time.Now().Add(-time.Minute))
+	_ = db.RevokeToken(ctx, "live", time.Now().Add(time.Minute))
+
+	if ok, _ := db.IsTokenRevoked(ctx, "live"); !ok {
+		t.Errorf("IsTokenRevoked() got false, wanted true")
+	}
+	if ok, _ := db.IsTokenRevoked(ctx, "expired"); ok {
+		t.Errorf("expired revocation was not cleaned up")
+	}
+}
+
+func TestJsonDB_Journal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+
+	user := &structs.User{ID: uuid.New(), Username: "jeff", Created: time.Now()}
+	_, _ = db.CreateUser(ctx, user)
+	msg, _ := db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), Content: "message", Timestamp: time.Now()})
+	_, _ = db.CreateReaction(ctx, msg.ID.String(), user, "👍🏽")
+	gone, _ := db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), Content: "gone", Timestamp: time.Now()})
+	_ = db.DeleteMessage(ctx, gone.ID.String())
+
+	// pretend the process died without closing, with half an entry written
+	_, _ = db.journal.Write([]byte(`{"seq":99,"op":"put_us`))
+
+	db2, err := Open(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db2.Close()
+
+	if got, _ := db2.FindUserByID(ctx, user.ID.String()); got == nil || got.Username != "jeff" {
+		t.Errorf("FindUserByID() got %v, wanted jeff", got)
+	}
+	if got, _ := db2.FindMessageByID(ctx, msg.ID.String()); got == nil || len(got.Reactions) != 1 {
+		t.Errorf("FindMessageByID() got %v, wanted message with one reaction", got)
+	}
+	if got, _ := db2.FindMessageByID(ctx, gone.ID.String()); got != nil {
+		t.Errorf("FindMessageByID() got %v, wanted nil", got)
+	}
+
+	if info, err := os.Stat(path + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("journal was not compacted on open")
+	}
+}
+
+func TestJsonDB_JournalSkipsCompacted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	msg, _ := db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), Content: "message", Timestamp: time.Now()})
+	journal, _ := os.ReadFile(path + ".journal")
+
+	// compacting and then dying before the journal is emptied leaves the
+	// same entries in both places
+	_ = db.DeleteMessage(ctx, msg.ID.String())
+	db.state.Lock()
+	_ = db.compact()
+	db.state.Unlock()
+	_ = os.WriteFile(path+".journal", journal, 0644)
+
+	db2, err := Open(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db2.Close()
+
+	if got, _ := db2.FindMessageByID(ctx, msg.ID.String()); got != nil {
+		t.Errorf("FindMessageByID() got %v, wanted nil", got)
+	}
+}
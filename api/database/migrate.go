@@ -0,0 +1,255 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// Migration is a step that brings stored data from one schema version to the
+// next. Version is the version the data is at once the step is done.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%d: %s", m.Version, m.Description)
+}
+
+// jsonDocument is a data file decoded just far enough to be migrated, as
+// older versions do not fit the current state.
+type jsonDocument map[string]json.RawMessage
+
+type jsonMigration struct {
+	Migration
+	apply func(doc jsonDocument) error
+}
+
+// jsonMigrations are the steps a data file goes through to reach the current
+// version, in order. Files from before versioning are at version 0. Steps
+// must never change once released; add a new one instead.
+var jsonMigrations = []jsonMigration{
+	{Migration{1, "move messages into a general channel"}, migrateChannels},
+	{Migration{2, "add refresh tokens and revoked access tokens"}, migrateTokens},
+	{Migration{3, "add read states"}, migrateReadStates},
+	{Migration{4, "add attachments"}, migrateAttachments},
+	{Migration{5, "add roles"}, migrateRoles},
+	{Migration{6, "add sanctions"}, migrateSanctions},
+	{Migration{7, "add the audit log"}, migrateAudit},
+	{Migration{8, "add revoking every token of a user"}, migrateTokenVersions},
+}
+
+// jsonSchemaVersion is the version data files are written at.
+var jsonSchemaVersion = len(jsonMigrations)
+
+// migrateJSON brings the contents of a data file up to the current version,
+// and returns the migrations that were needed.
+func migrateJSON(d []byte) ([]byte, []Migration, error) {
+	var doc jsonDocument
+	if err := json.Unmarshal(d, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	version := 0
+	if raw, ok := doc["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, nil, err
+		}
+	}
+	if version > jsonSchemaVersion {
+		return nil, nil, fmt.Errorf("%w: data file is at version %d, wanted at most %d", ErrSchemaTooNew, version, jsonSchemaVersion)
+	}
+
+	var applied []Migration
+	for _, m := range jsonMigrations[version:] {
+		if err := m.apply(doc); err != nil {
+			return nil, nil, fmt.Errorf("migration %v: %w", m.Migration, err)
+		}
+		doc["version"] = json.RawMessage(fmt.Sprint(m.Version))
+		applied = append(applied, m.Migration)
+	}
+	if len(applied) == 0 {
+		return d, nil, nil
+	}
+
+	d, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, applied, nil
+}
+
+// set stores v under key in the document.
+func (doc jsonDocument) set(key string, v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	doc[key] = d
+	return nil
+}
+
+// get decodes the value under key into v. A missing key leaves v alone.
+func (doc jsonDocument) get(key string, v interface{}) error {
+	raw, ok := doc[key]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// migrateChannels creates a general channel for data files from before
+// channels existed. Every user is made a member, and every message is moved
+// into it.
+func migrateChannels(doc jsonDocument) error {
+	if _, ok := doc["channels"]; ok {
+		return nil
+	}
+
+	var (
+		users    map[string]json.RawMessage
+		messages map[string]map[string]json.RawMessage
+	)
+	if err := doc.get("users", &users); err != nil {
+		return err
+	}
+	if err := doc.get("messages", &messages); err != nil {
+		return err
+	}
+
+	channel := &structs.Channel{
+		ID:      uuid.New(),
+		Name:    "general",
+		Created: time.Now(),
+	}
+	id := channel.ID.String()
+	members := map[string]bool{}
+	for userID := range users {
+		members[userID] = true
+	}
+	channelID, err := json.Marshal(channel.ID)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		msg["channel_id"] = channelID
+	}
+
+	if err := doc.set("channels", map[string]*structs.Channel{id: channel}); err != nil {
+		return err
+	}
+	if err := doc.set("members", map[string]map[string]bool{id: members}); err != nil {
+		return err
+	}
+	if messages != nil {
+		return doc.set("messages", messages)
+	}
+	return nil
+}
+
+// migrateTokens adds the refresh tokens and revoked access tokens that came
+// with token revocation.
+func migrateTokens(doc jsonDocument) error {
+	for _, key := range []string{"refresh_tokens", "revoked"} {
+		if raw, ok := doc[key]; !ok || string(raw) == "null" {
+			doc[key] = json.RawMessage("{}")
+		}
+	}
+	return nil
+}
+
+// migrateReadStates adds the read states that came with read receipts.
+func migrateReadStates(doc jsonDocument) error {
+	if raw, ok := doc["read_states"]; !ok || string(raw) == "null" {
+		doc["read_states"] = json.RawMessage("{}")
+	}
+	return nil
+}
+
+// migrateAttachments adds the uploads that came with attachments.
+func migrateAttachments(doc jsonDocument) error {
+	if raw, ok := doc["attachments"]; !ok || string(raw) == "null" {
+		doc["attachments"] = json.RawMessage("{}")
+	}
+	return nil
+}
+
+// migrateRoles gives every user the member role, except for the first user to
+// have registered, who becomes the owner.
+func migrateRoles(doc jsonDocument) error {
+	var users map[string]*structs.User
+	if err := doc.get("users", &users); err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	var first *structs.User
+	for _, u := range users {
+		u.Role = structs.RoleMember
+		if first == nil || u.Created.Before(first.Created) ||
+			u.Created.Equal(first.Created) && u.ID.String() < first.ID.String() {
+			first = u
+		}
+	}
+	first.Role = structs.RoleOwner
+	return doc.set("users", users)
+}
+
+// migrateSanctions adds the bans and mutes that came with moderation.
+func migrateSanctions(doc jsonDocument) error {
+	if raw, ok := doc["sanctions"]; !ok || string(raw) == "null" {
+		doc["sanctions"] = json.RawMessage("{}")
+	}
+	return nil
+}
+
+// migrateAudit adds the audit log.
+func migrateAudit(doc jsonDocument) error {
+	if raw, ok := doc["audit"]; !ok || string(raw) == "null" {
+		doc["audit"] = json.RawMessage("[]")
+	}
+	return nil
+}
+
+// migrateTokenVersions adds the token versions of users, which came with
+// bans revoking every token of a user.
+func migrateTokenVersions(doc jsonDocument) error {
+	if raw, ok := doc["token_versions"]; !ok || string(raw) == "null" {
+		doc["token_versions"] = json.RawMessage("{}")
+	}
+	return nil
+}
+
+// DryRunJSON reports the migrations the data file at path needs, without
+// changing anything. The migrations are run in memory, so that any of them
+// failing is reported as well.
+func DryRunJSON(path string) ([]Migration, error) {
+	d, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	d, applied, err := migrateJSON(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(d, newState()); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// backupPath returns where to keep a copy of the file at path, from before it
+// was migrated away from version.
+func backupPath(path string, version int) string {
+	return fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().Format("20060102150405"))
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// legacyDataFile is a data file from before channels and versions existed.
+const legacyDataFile = `{
+	"users": {"5b4b4b8e-7a8f-4bd7-9d58-2b8b1f1b2c11": {"id": "5b4b4b8e-7a8f-4bd7-9d58-2b8b1f1b2c11", "username": "jeff", "password": "hunter2"}},
+	"messages": {"0f8e7a5e-2a5e-4c6f-8d5b-6c7c1a3d9e21": {"id": "0f8e7a5e-2a5e-4c6f-8d5b-6c7c1a3d9e21", "content": "message", "timestamp": "2023-01-01T00:00:00Z"}}
+}`
+
+func backups(t *testing.T, path string) []string {
+	matches, err := filepath.Glob(path + ".v*.bak")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	return matches
+}
+
+func TestMigrateJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	_ = os.WriteFile(path, []byte(legacyDataFile), 0644)
+
+	migrations, err := DryRunJSON(path)
+	if err != nil || len(migrations) != jsonSchemaVersion {
+		t.Errorf("DryRunJSON() got (%v, %v), wanted %v migrations", migrations, err, jsonSchemaVersion)
+	}
+	if d, _ := os.ReadFile(path); string(d) != legacyDataFile {
+		t.Errorf("DryRunJSON() changed the data file")
+	}
+	if got := backups(t, path); len(got) != 0 {
+		t.Errorf("DryRunJSON() made backups %v", got)
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+
+	channels, _ := db.GetChannels(ctx)
+	if len(channels) != 1 || channels[0].Name != "general" {
+		t.Fatalf("GetChannels() got %v, wanted the general channel", channels)
+	}
+	if ok, _ := db.IsChannelMember(ctx, channels[0].ID.String(), "5b4b4b8e-7a8f-4bd7-9d58-2b8b1f1b2c11"); !ok {
+		t.Errorf("IsChannelMember() got false, wanted existing users to be members")
+	}
+	if got, _ := db.GetRecentMessages(ctx, channels[0].ID.String(), 10); len(got) != 1 {
+		t.Errorf("len(GetRecentMessages()) got %v, wanted 1", len(got))
+	}
+	if got, _ := db.FindUserByID(ctx, "5b4b4b8e-7a8f-4bd7-9d58-2b8b1f1b2c11"); got == nil || got.Role != structs.RoleOwner {
+		t.Errorf("FindUserByID() got %v, wanted the only user to be the owner", got)
+	}
+	if db.state.Version != jsonSchemaVersion {
+		t.Errorf("state.Version got %v, wanted %v", db.state.Version, jsonSchemaVersion)
+	}
+
+	got := backups(t, path)
+	if len(got) != 1 || !strings.Contains(got[0], ".v0-") {
+		t.Fatalf("backups got %v, wanted one from version 0", got)
+	}
+	if d, _ := os.ReadFile(got[0]); string(d) != legacyDataFile {
+		t.Errorf("backup does not hold the original data file")
+	}
+
+	if migrations, err := DryRunJSON(path); err != nil || len(migrations) != 0 {
+		t.Errorf("DryRunJSON() after migrating got (%v, %v), wanted no migrations", migrations, err)
+	}
+}
+
+func TestMigrateJSON_TooNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	_ = os.WriteFile(path, []byte(`{"version": 1000}`), 0644)
+
+	if _, err := Open(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Open() got %v, wanted %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	if migrations, err := DryRunSQLite(path); err != nil || len(migrations) != len(sqliteMigrations) {
+		t.Errorf("DryRunSQLite() got (%v, %v), wanted %v migrations", migrations, err, len(sqliteMigrations))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("DryRunSQLite() created the database")
+	}
+
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	_ = db.Close()
+	if got := backups(t, path); len(got) != 0 {
+		t.Errorf("backups of a new database got %v, wanted none", got)
+	}
+
+	released := sqliteMigrations
+	defer func() { sqliteMigrations = released }()
+	sqliteMigrations = append(append([]sqliteMigration{}, released...), sqliteMigration{
+		Migration{len(released) + 1, "add a test table"},
+		"CREATE TABLE test (id TEXT PRIMARY KEY);",
+	})
+
+	if migrations, err := DryRunSQLite(path); err != nil || len(migrations) != 1 {
+		t.Errorf("DryRunSQLite() got (%v, %v), wanted 1 migration", migrations, err)
+	}
+	if migrations, _ := DryRunSQLite(path); len(migrations) != 1 {
+		t.Errorf("DryRunSQLite() applied its migrations")
+	}
+
+	db, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.db.Exec("INSERT INTO test (id) VALUES ('x')"); err != nil {
+		t.Errorf("migration was not applied: %v", err)
+	}
+	if got := backups(t, path); len(got) != 1 {
+		t.Errorf("backups got %v, wanted one", got)
+	}
+}
+
+func TestMigrateSQLite_DirectChannels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	released := sqliteMigrations
+	defer func() { sqliteMigrations = released }()
+	sqliteMigrations = released[:6]
+
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	jeff := &structs.User{ID: uuid.New(), Username: "jeff"}
+	bob := &structs.User{ID: uuid.New(), Username: "bob"}
+	_, _ = db.CreateUser(ctx, jeff)
+	_, _ = db.CreateUser(ctx, bob)
+	// the same DM opened twice at once, before it had to be unique
+	var dms []*structs.Channel
+	for i := 0; i < 2; i++ {
+		dm, _ := db.CreateChannel(ctx, &structs.Channel{ID: uuid.New(), Type: structs.ChannelTypeDM, Created: time.Now()})
+		_ = db.AddChannelMember(ctx, dm.ID.String(), jeff.ID.String())
+		_ = db.AddChannelMember(ctx, dm.ID.String(), bob.ID.String())
+		dms = append(dms, dm)
+	}
+	_ = db.Close()
+
+	sqliteMigrations = released
+	db, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+	if got, _ := db.FindDirectChannel(ctx, bob.ID.String(), jeff.ID.String()); got == nil || got.ID != dms[0].ID {
+		t.Errorf("FindDirectChannel() after migrating got %v, wanted the oldest DM %v", got, dms[0])
+	}
+}
@@ -0,0 +1,1384 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/search"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+
+	// also registers the pure Go "sqlite" driver
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDB stores everything in a SQLite database. Timestamps are stored as
+// unix nanoseconds, so that they sort and compare as integers.
+type SQLiteDB struct {
+	db   *sql.DB
+	path string
+	// index is the search index over the messages, which is built when the
+	// database is opened and kept up to date as messages change
+	index *search.Index
+}
+
+type sqliteMigration struct {
+	Migration
+	statements string
+}
+
+// sqliteMigrations are the steps that bring the schema from one version to
+// the next. The version of a database is kept in its user_version, which is
+// the number of migrations applied to it. Migrations must never change once
+// released; add a new one instead.
+var sqliteMigrations = []sqliteMigration{
+	{Migration{1, "create the initial schema"}, `CREATE TABLE users (
+		id       TEXT PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL DEFAULT '',
+		created  INTEGER NOT NULL
+	);
+
+	CREATE TABLE channels (
+		id       TEXT PRIMARY KEY,
+		type     INTEGER NOT NULL,
+		name     TEXT NOT NULL DEFAULT '',
+		topic    TEXT NOT NULL DEFAULT '',
+		owner_id TEXT NOT NULL,
+		created  INTEGER NOT NULL
+	);
+	CREATE INDEX channels_type ON channels (type);
+
+	CREATE TABLE channel_members (
+		channel_id TEXT NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+		user_id    TEXT NOT NULL,
+		PRIMARY KEY (channel_id, user_id)
+	);
+	CREATE INDEX channel_members_user ON channel_members (user_id);
+
+	CREATE TABLE messages (
+		id               TEXT PRIMARY KEY,
+		channel_id       TEXT NOT NULL,
+		author_id        TEXT,
+		content          TEXT NOT NULL,
+		timestamp        INTEGER NOT NULL,
+		edited_timestamp INTEGER,
+		history          TEXT
+	);
+	CREATE INDEX messages_channel_timestamp ON messages (channel_id, timestamp, id);
+
+	CREATE TABLE reactions (
+		message_id TEXT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		emoji      TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		PRIMARY KEY (message_id, emoji, user_id)
+	);
+
+	CREATE TABLE refresh_tokens (
+		hash    TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		expires INTEGER NOT NULL
+	);
+	CREATE INDEX refresh_tokens_expires ON refresh_tokens (expires);
+
+	CREATE TABLE revoked_tokens (
+		id      TEXT PRIMARY KEY,
+		expires INTEGER NOT NULL
+	);
+	CREATE INDEX revoked_tokens_expires ON revoked_tokens (expires);`},
+	{Migration{2, "add read states"}, `CREATE TABLE read_states (
+		user_id    TEXT NOT NULL,
+		channel_id TEXT NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+		message_id TEXT NOT NULL,
+		timestamp  INTEGER NOT NULL,
+		PRIMARY KEY (user_id, channel_id)
+	);`},
+	{Migration{3, "add attachments"}, `CREATE TABLE attachments (
+		id           TEXT PRIMARY KEY,
+		channel_id   TEXT NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+		uploader_id  TEXT NOT NULL,
+		filename     TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size         INTEGER NOT NULL,
+		width        INTEGER NOT NULL DEFAULT 0,
+		height       INTEGER NOT NULL DEFAULT 0,
+		created      INTEGER NOT NULL
+	);
+
+	ALTER TABLE messages ADD COLUMN attachments TEXT;`},
+	{Migration{4, "add roles and permission overrides"}, `ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'member';
+	UPDATE users SET role = 'owner' WHERE id = (SELECT id FROM users ORDER BY created, id LIMIT 1);
+
+	ALTER TABLE channels ADD COLUMN overrides TEXT;`},
+	{Migration{5, "add sanctions"}, `CREATE TABLE sanctions (
+		user_id      TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		type         TEXT NOT NULL,
+		moderator_id TEXT NOT NULL,
+		reason       TEXT NOT NULL DEFAULT '',
+		created      INTEGER NOT NULL,
+		expires      INTEGER,
+		PRIMARY KEY (user_id, type)
+	);`},
+	{Migration{6, "add the audit log"}, `CREATE TABLE audit_log (
+		id          TEXT PRIMARY KEY,
+		action      TEXT NOT NULL,
+		actor_id    TEXT,
+		target_type TEXT NOT NULL DEFAULT '',
+		target_id   TEXT NOT NULL DEFAULT '',
+		ip          TEXT NOT NULL DEFAULT '',
+		timestamp   INTEGER NOT NULL,
+		details     TEXT
+	);
+	CREATE INDEX audit_log_timestamp ON audit_log (timestamp, id);
+
+	CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'the audit log can not be changed'); END;
+	CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN SELECT RAISE(ABORT, 'the audit log can not be changed'); END;`},
+	// DMs opened twice at once could be created twice before, in which case
+	// the oldest is kept as the one between the two
+	{Migration{7, "make DMs unique per pair of users"}, `CREATE TABLE direct_channels (
+		user_id    TEXT NOT NULL,
+		other_id   TEXT NOT NULL,
+		channel_id TEXT NOT NULL UNIQUE REFERENCES channels (id) ON DELETE CASCADE,
+		PRIMARY KEY (user_id, other_id)
+	);
+	INSERT OR IGNORE INTO direct_channels (user_id, other_id, channel_id)
+		SELECT MIN(m.user_id), MAX(m.user_id), c.id FROM channels c
+		JOIN channel_members m ON m.channel_id = c.id
+		WHERE c.type = 1 -- structs.ChannelTypeDM
+		GROUP BY c.id HAVING COUNT(*) = 2
+		ORDER BY c.created, c.id;`},
+	{Migration{8, "add revoking every token of a user"}, `CREATE TABLE token_versions (
+		user_id TEXT PRIMARY KEY,
+		version INTEGER NOT NULL
+	);`},
+}
+
+// OpenSQLite opens the SQLite database at path, creating it if it does not
+// exist, and migrates it to the latest schema. An empty path opens a
+// database that only lives in memory.
+func OpenSQLite(path string) (*SQLiteDB, error) {
+	memory := path == ""
+	if memory {
+		path = ":memory:"
+	}
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only has one writer at a time anyway, and an in-memory
+	// database is private to the connection that opened it
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteDB{db: db, index: search.NewIndex()}
+	if !memory {
+		s.path = path
+	}
+	if err := s.migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := s.ensureDefaultChannel(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := s.buildIndex(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// buildIndex adds every stored message to the search index.
+func (s *SQLiteDB) buildIndex() error {
+	rows, err := s.db.Query(messageQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		s.index.Add(msg)
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// schemaVersion returns the version of the schema of a database, and the
+// migrations it needs to reach the current one.
+func schemaVersion(db *sql.DB) (int, []sqliteMigration, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, nil, err
+	}
+	if version > len(sqliteMigrations) {
+		return 0, nil, fmt.Errorf("%w: database is at version %d, wanted at most %d", ErrSchemaTooNew, version, len(sqliteMigrations))
+	}
+	return version, sqliteMigrations[version:], nil
+}
+
+// applyMigration runs a migration in tx, and bumps the schema version.
+func applyMigration(tx *sql.Tx, m sqliteMigration) error {
+	if _, err := tx.Exec(m.statements); err != nil {
+		return fmt.Errorf("migration %v: %w", m.Migration, err)
+	}
+	// PRAGMA does not take parameters
+	_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.Version))
+	return err
+}
+
+// migrate applies the migrations the database has not seen yet, each in its
+// own transaction. A database that already has data in it is backed up
+// first.
+func (s *SQLiteDB) migrate() error {
+	version, pending, err := schemaVersion(s.db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 && version > 0 && s.path != "" {
+		path := backupPath(s.path, version)
+		if _, err := s.db.Exec("VACUUM INTO ?", path); err != nil {
+			return err
+		}
+		fmt.Println("backed up database to", path)
+	}
+
+	for _, m := range pending {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(tx, m); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Println("migrated database to version", m.Migration)
+	}
+	return nil
+}
+
+// DryRunSQLite reports the migrations the database at path needs, without
+// changing anything. The migrations are run in a transaction that is rolled
+// back, so that any of them failing is reported as well.
+func DryRunSQLite(path string) ([]Migration, error) {
+	var migrations []Migration
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// a new database would be created at the latest version
+		for _, m := range sqliteMigrations {
+			migrations = append(migrations, m.Migration)
+		}
+		return migrations, nil
+	}
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)", path))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, pending, err := schemaVersion(db)
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, m := range pending {
+		if err := applyMigration(tx, m); err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, m.Migration)
+	}
+	return migrations, nil
+}
+
+// ensureDefaultChannel creates a general channel if there are no channels,
+// the same way JsonDB does.
+func (s *SQLiteDB) ensureDefaultChannel() error {
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM channels").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	channel := &structs.Channel{
+		ID:      uuid.New(),
+		Name:    "general",
+		Created: time.Now(),
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertChannel(tx, channel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO channel_members (channel_id, user_id) SELECT ?, id FROM users", channel.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanner is either a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// execer is either a *sql.DB or *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func unixNano(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	return time.Unix(0, n)
+}
+
+// orNotFound returns notFound in place of sql.ErrNoRows.
+func orNotFound(err, notFound error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound
+	}
+	return err
+}
+
+// orConflict returns conflict in place of errors about a row clashing with
+// one that is already there.
+func orConflict(err, conflict error) error {
+	var e *sqlite.Error
+	if errors.As(err, &e) && (e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+		return conflict
+	}
+	return err
+}
+
+// affected returns notFound if res did not touch any rows.
+func affected(res sql.Result, notFound error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+const userColumns = "id, username, password, created, role"
+
+func scanUser(row scanner) (*structs.User, error) {
+	var (
+		u       structs.User
+		created int64
+	)
+	if err := row.Scan(&u.ID, &u.Username, &u.Password, &created, &u.Role); err != nil {
+		return nil, err
+	}
+	u.Created = fromUnixNano(created)
+	return &u, nil
+}
+
+// userRole returns the role a user is stored with.
+func userRole(u *structs.User) structs.Role {
+	if !u.Role.Valid() {
+		return structs.RoleMember
+	}
+	return u.Role
+}
+
+func (s *SQLiteDB) CreateUser(ctx context.Context, u *structs.User) (*structs.User, error) {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?)",
+		u.ID, u.Username, u.Password, unixNano(u.Created), userRole(u))
+	if err != nil {
+		return nil, orConflict(err, ErrUsernameTaken)
+	}
+	return u, nil
+}
+
+func (s *SQLiteDB) UpdateUser(ctx context.Context, u *structs.User) (*structs.User, error) {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET username = ?, password = ?, created = ?, role = ? WHERE id = ?",
+		u.Username, u.Password, unixNano(u.Created), userRole(u), u.ID)
+	if err != nil {
+		return nil, orConflict(err, ErrUsernameTaken)
+	}
+	if err := affected(res, ErrUserNotFound); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *SQLiteDB) FindUserByID(ctx context.Context, id string) (*structs.User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return nil, orNotFound(err, ErrUserNotFound)
+	}
+	return u, nil
+}
+
+func (s *SQLiteDB) CountUsers(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+func (s *SQLiteDB) ClaimOwnership(ctx context.Context, userID string) (bool, error) {
+	if _, err := s.FindUserByID(ctx, userID); err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET role = ? WHERE id = ?
+		AND NOT EXISTS (SELECT 1 FROM users WHERE role = ?)`, structs.RoleOwner, userID, structs.RoleOwner)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteDB) FindUserByUsername(ctx context.Context, username string) (*structs.User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if err != nil {
+		return nil, orNotFound(err, ErrUserNotFound)
+	}
+	return u, nil
+}
+
+const channelColumns = "id, type, name, topic, owner_id, created, overrides"
+
+func scanChannel(row scanner) (*structs.Channel, error) {
+	var (
+		channel   structs.Channel
+		created   int64
+		overrides sql.NullString
+	)
+	if err := row.Scan(&channel.ID, &channel.Type, &channel.Name, &channel.Topic, &channel.OwnerID, &created, &overrides); err != nil {
+		return nil, err
+	}
+	channel.Created = fromUnixNano(created)
+	if overrides.Valid && overrides.String != "" {
+		if err := json.Unmarshal([]byte(overrides.String), &channel.Overrides); err != nil {
+			return nil, err
+		}
+	}
+	return &channel, nil
+}
+
+// channelValues returns the columns of a channel in the order of
+// channelColumns.
+func channelValues(channel *structs.Channel) ([]interface{}, error) {
+	var overrides interface{}
+	if len(channel.Overrides) > 0 {
+		d, err := json.Marshal(channel.Overrides)
+		if err != nil {
+			return nil, err
+		}
+		overrides = string(d)
+	}
+	return []interface{}{channel.ID, channel.Type, channel.Name, channel.Topic, channel.OwnerID, unixNano(channel.Created), overrides}, nil
+}
+
+func (s *SQLiteDB) queryChannels(ctx context.Context, query string, args ...interface{}) ([]*structs.Channel, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := make([]*structs.Channel, 0)
+	for rows.Next() {
+		channel, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, rows.Err()
+}
+
+func insertChannel(db execer, channel *structs.Channel) error {
+	values, err := channelValues(channel)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO channels ("+channelColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)", values...)
+	return err
+}
+
+func (s *SQLiteDB) CreateChannel(ctx context.Context, channel *structs.Channel) (*structs.Channel, error) {
+	values, err := channelValues(channel)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, "INSERT INTO channels ("+channelColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)", values...)
+	if err != nil {
+		return nil, orConflict(err, ErrConflict)
+	}
+	return channel, nil
+}
+
+func (s *SQLiteDB) CreateChannelWithMembers(ctx context.Context, channel *structs.Channel, memberIDs []string) (*structs.Channel, error) {
+	values, err := channelValues(channel)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO channels ("+channelColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)", values...); err != nil {
+		return nil, orConflict(err, ErrConflict)
+	}
+	for _, userID := range memberIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO channel_members (channel_id, user_id) VALUES (?, ?)", channel.ID, userID); err != nil {
+			return nil, err
+		}
+	}
+	if channel.Type == structs.ChannelTypeDM {
+		userID, otherID, err := directPair(memberIDs)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO direct_channels (user_id, other_id, channel_id) VALUES (?, ?, ?)", userID, otherID, channel.ID)
+		if err != nil {
+			return nil, orConflict(err, ErrDirectChannelTaken)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (s *SQLiteDB) UpdateChannel(ctx context.Context, channel *structs.Channel) (*structs.Channel, error) {
+	values, err := channelValues(channel)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.db.ExecContext(ctx, "UPDATE channels SET type = ?, name = ?, topic = ?, owner_id = ?, created = ?, overrides = ? WHERE id = ?",
+		append(values[1:], channel.ID)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := affected(res, ErrChannelNotFound); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (s *SQLiteDB) DeleteChannel(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// members and reactions go with their channel and messages
+	res, err := tx.ExecContext(ctx, "DELETE FROM channels WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if err := affected(res, ErrChannelNotFound); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE channel_id = ?", id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.index.RemoveChannel(id)
+	return nil
+}
+
+func (s *SQLiteDB) FindChannelByID(ctx context.Context, id string) (*structs.Channel, error) {
+	channel, err := scanChannel(s.db.QueryRowContext(ctx, "SELECT "+channelColumns+" FROM channels WHERE id = ?", id))
+	if err != nil {
+		return nil, orNotFound(err, ErrChannelNotFound)
+	}
+	return channel, nil
+}
+
+func (s *SQLiteDB) GetChannels(ctx context.Context) ([]*structs.Channel, error) {
+	return s.queryChannels(ctx, "SELECT "+channelColumns+" FROM channels WHERE type = ? ORDER BY created",
+		structs.ChannelTypeText)
+}
+
+func (s *SQLiteDB) FindDirectChannel(ctx context.Context, userID, otherID string) (*structs.Channel, error) {
+	userID, otherID, err := directPair([]string{userID, otherID})
+	if err != nil {
+		return nil, ErrChannelNotFound
+	}
+	channel, err := scanChannel(s.db.QueryRowContext(ctx, `SELECT `+channelColumns+` FROM channels c
+		JOIN direct_channels d ON d.channel_id = c.id
+		WHERE d.user_id = ? AND d.other_id = ?`, userID, otherID))
+	if err != nil {
+		return nil, orNotFound(err, ErrChannelNotFound)
+	}
+	return channel, nil
+}
+
+func (s *SQLiteDB) AddChannelMember(ctx context.Context, channelID, userID string) error {
+	if _, err := s.FindChannelByID(ctx, channelID); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO channel_members (channel_id, user_id) VALUES (?, ?)", channelID, userID)
+	return err
+}
+
+func (s *SQLiteDB) RemoveChannelMember(ctx context.Context, channelID, userID string) error {
+	if _, err := s.FindChannelByID(ctx, channelID); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, "DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?", channelID, userID)
+	return err
+}
+
+func (s *SQLiteDB) IsChannelMember(ctx context.Context, channelID, userID string) (bool, error) {
+	var one int
+	err := s.db.QueryRowContext(ctx, "SELECT 1 FROM channel_members WHERE channel_id = ? AND user_id = ?", channelID, userID).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLiteDB) GetChannelMembers(ctx context.Context, channelID string) ([]*structs.User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT u.id, u.username, u.password, u.created, u.role FROM channel_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.channel_id = ?
+		ORDER BY u.username`, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*structs.User, 0)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteDB) GetUserChannels(ctx context.Context, userID string) ([]*structs.Channel, error) {
+	return s.queryChannels(ctx, `SELECT c.id, c.type, c.name, c.topic, c.owner_id, c.created, c.overrides FROM channel_members m
+		JOIN channels c ON c.id = m.channel_id
+		WHERE m.user_id = ?
+		ORDER BY c.created`, userID)
+}
+
+// messageQuery selects messages along with their authors. Authors that no
+// longer exist are left with only their ID.
+const messageQuery = `SELECT m.id, m.channel_id, m.author_id, u.username, u.created,
+	m.content, m.timestamp, m.edited_timestamp, m.history, m.attachments
+	FROM messages m LEFT JOIN users u ON u.id = m.author_id`
+
+func scanMessage(row scanner) (*structs.Message, error) {
+	var (
+		msg         structs.Message
+		authorID    sql.NullString
+		username    sql.NullString
+		created     sql.NullInt64
+		timestamp   int64
+		edited      sql.NullInt64
+		history     sql.NullString
+		attachments sql.NullString
+	)
+	err := row.Scan(&msg.ID, &msg.ChannelID, &authorID, &username, &created,
+		&msg.Content, &timestamp, &edited, &history, &attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	if authorID.Valid {
+		id, err := uuid.Parse(authorID.String)
+		if err != nil {
+			return nil, err
+		}
+		msg.Author = &structs.User{ID: id, Username: username.String}
+		if created.Valid {
+			msg.Author.Created = fromUnixNano(created.Int64)
+		}
+	}
+	msg.Timestamp = fromUnixNano(timestamp)
+	if edited.Valid {
+		t := fromUnixNano(edited.Int64)
+		msg.EditedTimestamp = &t
+	}
+	if history.Valid && history.String != "" {
+		if err := json.Unmarshal([]byte(history.String), &msg.History); err != nil {
+			return nil, err
+		}
+	}
+	if attachments.Valid && attachments.String != "" {
+		if err := json.Unmarshal([]byte(attachments.String), &msg.Attachments); err != nil {
+			return nil, err
+		}
+	}
+	return &msg, nil
+}
+
+// messageValues returns the columns of a message that are stored as they
+// are, in the order author_id, content, timestamp, edited_timestamp, history,
+// attachments.
+func messageValues(message *structs.Message) ([]interface{}, error) {
+	var authorID interface{}
+	if message.Author != nil {
+		authorID = message.Author.ID
+	}
+	var edited interface{}
+	if message.EditedTimestamp != nil {
+		edited = unixNano(*message.EditedTimestamp)
+	}
+	var history interface{}
+	if len(message.History) > 0 {
+		d, err := json.Marshal(message.History)
+		if err != nil {
+			return nil, err
+		}
+		history = string(d)
+	}
+	var attachments interface{}
+	if len(message.Attachments) > 0 {
+		d, err := json.Marshal(message.Attachments)
+		if err != nil {
+			return nil, err
+		}
+		attachments = string(d)
+	}
+	return []interface{}{authorID, message.Content, unixNano(message.Timestamp), edited, history, attachments}, nil
+}
+
+func (s *SQLiteDB) CreateMessage(ctx context.Context, message *structs.Message) (*structs.Message, error) {
+	values, err := messageValues(message)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO messages (id, channel_id, author_id, content, timestamp, edited_timestamp, history, attachments)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, append([]interface{}{message.ID, message.ChannelID}, values...)...)
+	if err != nil {
+		return nil, orConflict(err, ErrConflict)
+	}
+	s.index.Add(message)
+	return message, nil
+}
+
+// UpdateMessage stores everything about a message except its reactions,
+// which are changed through CreateReaction and DeleteReaction.
+func (s *SQLiteDB) UpdateMessage(ctx context.Context, message *structs.Message) (*structs.Message, error) {
+	values, err := messageValues(message)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE messages SET author_id = ?, content = ?, timestamp = ?, edited_timestamp = ?, history = ?,
+		attachments = ? WHERE id = ?`, append(values, message.ID)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := affected(res, ErrMessageNotFound); err != nil {
+		return nil, err
+	}
+	s.index.Add(message)
+	return message, nil
+}
+
+func (s *SQLiteDB) DeleteMessage(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM messages WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if err := affected(res, ErrMessageNotFound); err != nil {
+		return err
+	}
+	s.index.Remove(id)
+	return nil
+}
+
+func (s *SQLiteDB) FindMessageByID(ctx context.Context, id string) (*structs.Message, error) {
+	msg, err := scanMessage(s.db.QueryRowContext(ctx, messageQuery+" WHERE m.id = ?", id))
+	if err != nil {
+		return nil, orNotFound(err, ErrMessageNotFound)
+	}
+	if err := s.loadReactions(ctx, []*structs.Message{msg}); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// queryMessages returns the messages a query selects, with their reactions.
+// If newestFirst is set, the query orders them newest first, and they are
+// reversed before returning.
+func (s *SQLiteDB) queryMessages(ctx context.Context, newestFirst bool, query string, args ...interface{}) ([]*structs.Message, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*structs.Message, 0)
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if newestFirst {
+		for i, k := 0, len(messages)-1; i < k; i, k = i+1, k-1 {
+			messages[i], messages[k] = messages[k], messages[i]
+		}
+	}
+	if err := s.loadReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// loadReactions fills in the reactions of messages. Reactions, and the users
+// in them, are in the order they were added.
+func (s *SQLiteDB) loadReactions(ctx context.Context, messages []*structs.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*structs.Message, len(messages))
+	args := make([]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID.String()] = msg
+		args = append(args, msg.ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messages)), ", ")
+
+	rows, err := s.db.QueryContext(ctx, `SELECT r.message_id, r.emoji, r.user_id, u.username, u.created FROM reactions r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.message_id IN (`+placeholders+`)
+		ORDER BY r.rowid`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID, emoji string
+			user             structs.User
+			username         sql.NullString
+			created          sql.NullInt64
+		)
+		if err := rows.Scan(&messageID, &emoji, &user.ID, &username, &created); err != nil {
+			return err
+		}
+		user.Username = username.String
+		if created.Valid {
+			user.Created = fromUnixNano(created.Int64)
+		}
+
+		msg := byID[messageID]
+		var reaction *structs.Reaction
+		for _, r := range msg.Reactions {
+			if r.Emoji == emoji {
+				reaction = r
+				break
+			}
+		}
+		if reaction == nil {
+			reaction = &structs.Reaction{Emoji: emoji}
+			msg.Reactions = append(msg.Reactions, reaction)
+		}
+		reaction.Users = append(reaction.Users, &user)
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteDB) GetRecentMessages(ctx context.Context, channelID string, limit int) ([]*structs.Message, error) {
+	return s.queryMessages(ctx, true, messageQuery+` WHERE m.channel_id = ?
+		ORDER BY m.timestamp DESC, m.id DESC LIMIT ?`, channelID, limit)
+}
+
+// cursorCondition returns the condition for the messages on one side of a
+// cursor, where op is <, > or >=, along with its arguments.
+func cursorCondition(op string, cursor MessageCursor) (string, []interface{}) {
+	t := unixNano(cursor.Timestamp)
+	if cursor.ID == "" {
+		return "m.timestamp " + op + " ?", []interface{}{t}
+	}
+	strict := strings.TrimSuffix(op, "=")
+	return "(m.timestamp " + strict + " ? OR (m.timestamp = ? AND m.id " + op + " ?))", []interface{}{t, t, cursor.ID}
+}
+
+func (s *SQLiteDB) GetMessagesBefore(ctx context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error) {
+	cond, args := cursorCondition("<", cursor)
+	args = append([]interface{}{channelID}, append(args, limit)...)
+	return s.queryMessages(ctx, true, messageQuery+` WHERE m.channel_id = ? AND `+cond+`
+		ORDER BY m.timestamp DESC, m.id DESC LIMIT ?`, args...)
+}
+
+func (s *SQLiteDB) GetMessagesAfter(ctx context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error) {
+	cond, args := cursorCondition(">", cursor)
+	args = append([]interface{}{channelID}, append(args, limit)...)
+	return s.queryMessages(ctx, false, messageQuery+` WHERE m.channel_id = ? AND `+cond+`
+		ORDER BY m.timestamp, m.id LIMIT ?`, args...)
+}
+
+func (s *SQLiteDB) GetMessagesAround(ctx context.Context, channelID string, cursor MessageCursor, limit int) ([]*structs.Message, error) {
+	before, err := s.GetMessagesBefore(ctx, channelID, cursor, limit/2)
+	if err != nil {
+		return nil, err
+	}
+	cond, args := cursorCondition(">=", cursor)
+	args = append([]interface{}{channelID}, append(args, limit-len(before))...)
+	after, err := s.queryMessages(ctx, false, messageQuery+` WHERE m.channel_id = ? AND `+cond+`
+		ORDER BY m.timestamp, m.id LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return append(before, after...), nil
+}
+
+func (s *SQLiteDB) CreateRefreshToken(ctx context.Context, token *structs.RefreshToken) (*structs.RefreshToken, error) {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO refresh_tokens (hash, user_id, created, expires) VALUES (?, ?, ?, ?)",
+		token.Hash, token.UserID, unixNano(token.Created), unixNano(token.Expires))
+	if err != nil {
+		return nil, orConflict(err, ErrConflict)
+	}
+
+	// clean up while we are at it, so expired tokens do not pile up
+	_, _ = s.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE expires < ?", unixNano(time.Now()))
+	return token, nil
+}
+
+func (s *SQLiteDB) FindRefreshToken(ctx context.Context, hash string) (*structs.RefreshToken, error) {
+	var (
+		token            structs.RefreshToken
+		created, expires int64
+	)
+	err := s.db.QueryRowContext(ctx, "SELECT hash, user_id, created, expires FROM refresh_tokens WHERE hash = ?", hash).
+		Scan(&token.Hash, &token.UserID, &created, &expires)
+	if err != nil {
+		return nil, orNotFound(err, ErrTokenNotFound)
+	}
+	token.Created = fromUnixNano(created)
+	token.Expires = fromUnixNano(expires)
+	return &token, nil
+}
+
+func (s *SQLiteDB) DeleteRefreshToken(ctx context.Context, hash string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE hash = ?", hash)
+	if err != nil {
+		return err
+	}
+	return affected(res, ErrTokenNotFound)
+}
+
+func (s *SQLiteDB) DeleteUserRefreshTokens(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE user_id = ?", userID)
+	return err
+}
+
+func (s *SQLiteDB) RevokeToken(ctx context.Context, id string, expires time.Time) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO revoked_tokens (id, expires) VALUES (?, ?)", id, unixNano(expires))
+	if err != nil {
+		return err
+	}
+
+	_, _ = s.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires < ?", unixNano(time.Now()))
+	return nil
+}
+
+func (s *SQLiteDB) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	var one int
+	err := s.db.QueryRowContext(ctx, "SELECT 1 FROM revoked_tokens WHERE id = ?", id).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLiteDB) RevokeUserTokens(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO token_versions (user_id, version) VALUES (?, 1)
+		ON CONFLICT (user_id) DO UPDATE SET version = version + 1`, userID)
+	return err
+}
+
+func (s *SQLiteDB) UserTokenVersion(ctx context.Context, userID string) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, "SELECT version FROM token_versions WHERE user_id = ?", userID).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+// messageExists returns ErrMessageNotFound if there is no message with id.
+func (s *SQLiteDB) messageExists(ctx context.Context, id string) error {
+	var one int
+	err := s.db.QueryRowContext(ctx, "SELECT 1 FROM messages WHERE id = ?", id).Scan(&one)
+	return orNotFound(err, ErrMessageNotFound)
+}
+
+func (s *SQLiteDB) CreateReaction(ctx context.Context, messageID string, user *structs.User, emoji string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO reactions (message_id, emoji, user_id) VALUES (?, ?, ?)",
+		messageID, emoji, user.ID)
+	if err != nil {
+		// the foreign key fails when the message does not exist
+		if err := s.messageExists(ctx, messageID); err != nil {
+			return false, err
+		}
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteDB) DeleteReaction(ctx context.Context, messageID string, user *structs.User, emoji string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM reactions WHERE message_id = ? AND emoji = ? AND user_id = ?",
+		messageID, emoji, user.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, s.messageExists(ctx, messageID)
+	}
+	return true, nil
+}
+
+func (s *SQLiteDB) SetReadState(ctx context.Context, state *structs.ReadState) (bool, error) {
+	if _, err := s.FindChannelByID(ctx, state.ChannelID.String()); err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO read_states (user_id, channel_id, message_id, timestamp)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, channel_id) DO UPDATE SET message_id = excluded.message_id, timestamp = excluded.timestamp
+		WHERE excluded.timestamp > read_states.timestamp`,
+		state.UserID, state.ChannelID, state.MessageID, unixNano(state.Timestamp))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteDB) GetReadStates(ctx context.Context, userID string) ([]*structs.ReadState, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id, channel_id, message_id, timestamp FROM read_states
+		WHERE user_id = ? ORDER BY channel_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make([]*structs.ReadState, 0)
+	for rows.Next() {
+		var (
+			state     structs.ReadState
+			timestamp int64
+		)
+		if err := rows.Scan(&state.UserID, &state.ChannelID, &state.MessageID, &timestamp); err != nil {
+			return nil, err
+		}
+		state.Timestamp = fromUnixNano(timestamp)
+		states = append(states, &state)
+	}
+	return states, rows.Err()
+}
+
+func (s *SQLiteDB) CountMessagesAfter(ctx context.Context, channelID, userID string, t time.Time, mention string) (count, mentions int, err error) {
+	const unread = `FROM messages WHERE channel_id = ? AND timestamp > ? AND (author_id IS NULL OR author_id != ?)`
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) "+unread, channelID, unixNano(t), userID).Scan(&count)
+	if err != nil || mention == "" {
+		return count, 0, err
+	}
+
+	// instr finds the messages that might mention someone, and Go decides
+	// which of them mention them as a word of its own
+	rows, err := s.db.QueryContext(ctx, "SELECT content "+unread+" AND instr(content, ?) > 0",
+		channelID, unixNano(t), userID, mention)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			return 0, 0, err
+		}
+		if search.Mentions(content, mention) {
+			mentions++
+		}
+	}
+	return count, mentions, rows.Err()
+}
+
+func (s *SQLiteDB) CreateAttachment(ctx context.Context, attachment *structs.Attachment) (*structs.Attachment, error) {
+	if _, err := s.FindChannelByID(ctx, attachment.ChannelID.String()); err != nil {
+		return nil, err
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO attachments (id, channel_id, uploader_id, filename, content_type, size, width, height, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, attachment.ID, attachment.ChannelID, attachment.UploaderID, attachment.Filename,
+		attachment.ContentType, attachment.Size, attachment.Width, attachment.Height, unixNano(attachment.Created))
+	if err != nil {
+		return nil, orConflict(err, ErrConflict)
+	}
+	return attachment, nil
+}
+
+func (s *SQLiteDB) FindAttachmentByID(ctx context.Context, id string) (*structs.Attachment, error) {
+	var (
+		a       structs.Attachment
+		created int64
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT id, channel_id, uploader_id, filename, content_type, size, width, height, created
+		FROM attachments WHERE id = ?`, id).Scan(&a.ID, &a.ChannelID, &a.UploaderID, &a.Filename, &a.ContentType,
+		&a.Size, &a.Width, &a.Height, &created)
+	if err != nil {
+		return nil, orNotFound(err, ErrAttachmentNotFound)
+	}
+	a.Created = fromUnixNano(created)
+	return &a, nil
+}
+
+func (s *SQLiteDB) DeleteUnattachedAttachments(ctx context.Context, before time.Time) ([]*structs.Attachment, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// messages keep their attachments as JSON, so they are looked through
+	// in the same transaction as the delete to not race new messages
+	rows, err := tx.QueryContext(ctx, `SELECT id, channel_id, uploader_id, filename, content_type, size, width, height, created
+		FROM attachments a WHERE created < ? AND NOT EXISTS (
+			SELECT 1 FROM messages m, json_each(m.attachments) j
+			WHERE m.channel_id = a.channel_id AND json_extract(j.value, '$.id') = a.id
+		)`, unixNano(before))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deleted := make([]*structs.Attachment, 0)
+	for rows.Next() {
+		var (
+			a       structs.Attachment
+			created int64
+		)
+		if err := rows.Scan(&a.ID, &a.ChannelID, &a.UploaderID, &a.Filename, &a.ContentType,
+			&a.Size, &a.Width, &a.Height, &created); err != nil {
+			return nil, err
+		}
+		a.Created = fromUnixNano(created)
+		deleted = append(deleted, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	_ = rows.Close()
+
+	for _, a := range deleted {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM attachments WHERE id = ?", a.ID); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, tx.Commit()
+}
+
+func (s *SQLiteDB) SetSanction(ctx context.Context, sanction *structs.Sanction) error {
+	if _, err := s.FindUserByID(ctx, sanction.UserID.String()); err != nil {
+		return err
+	}
+	var expires interface{}
+	if sanction.Expires != nil {
+		expires = unixNano(*sanction.Expires)
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO sanctions (user_id, type, moderator_id, reason, created, expires)
+		VALUES (?, ?, ?, ?, ?, ?)`, sanction.UserID, sanction.Type, sanction.ModeratorID, sanction.Reason,
+		unixNano(sanction.Created), expires)
+	return err
+}
+
+func (s *SQLiteDB) FindSanction(ctx context.Context, userID string, sanctionType structs.SanctionType) (*structs.Sanction, error) {
+	var (
+		sanction structs.Sanction
+		created  int64
+		expires  sql.NullInt64
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT user_id, type, moderator_id, reason, created, expires FROM sanctions
+		WHERE user_id = ? AND type = ?`, userID, sanctionType).Scan(&sanction.UserID, &sanction.Type,
+		&sanction.ModeratorID, &sanction.Reason, &created, &expires)
+	if err != nil {
+		return nil, orNotFound(err, ErrSanctionNotFound)
+	}
+	sanction.Created = fromUnixNano(created)
+	if expires.Valid {
+		t := fromUnixNano(expires.Int64)
+		sanction.Expires = &t
+	}
+	return &sanction, nil
+}
+
+func (s *SQLiteDB) DeleteSanction(ctx context.Context, userID string, sanctionType structs.SanctionType) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM sanctions WHERE user_id = ? AND type = ?", userID, sanctionType)
+	if err != nil {
+		return err
+	}
+	return affected(res, ErrSanctionNotFound)
+}
+
+func (s *SQLiteDB) CreateAuditEntry(ctx context.Context, entry *structs.AuditEntry) error {
+	var actorID, details interface{}
+	if entry.ActorID != nil {
+		actorID = *entry.ActorID
+	}
+	if len(entry.Details) > 0 {
+		d, err := json.Marshal(entry.Details)
+		if err != nil {
+			return err
+		}
+		details = string(d)
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO audit_log (id, action, actor_id, target_type, target_id, ip, timestamp, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, entry.ID, entry.Action, actorID, entry.TargetType, entry.TargetID, entry.IP,
+		unixNano(entry.Timestamp), details)
+	return orConflict(err, ErrConflict)
+}
+
+func (s *SQLiteDB) GetAuditEntries(ctx context.Context, q *AuditQuery) ([]*structs.AuditEntry, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if q.Before != "" {
+		var timestamp int64
+		err := s.db.QueryRowContext(ctx, "SELECT timestamp FROM audit_log WHERE id = ?", q.Before).Scan(&timestamp)
+		if err != nil {
+			return nil, orNotFound(err, ErrAuditEntryNotFound)
+		}
+		where = append(where, "(timestamp < ? OR (timestamp = ? AND id < ?))")
+		args = append(args, timestamp, timestamp, q.Before)
+	}
+	if q.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, q.Action)
+	}
+	if q.ActorID != "" {
+		where = append(where, "actor_id = ?")
+		args = append(args, q.ActorID)
+	}
+	if q.TargetID != "" {
+		where = append(where, "target_id = ?")
+		args = append(args, q.TargetID)
+	}
+
+	query := "SELECT id, action, actor_id, target_type, target_id, ip, timestamp, details FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY timestamp DESC, id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*structs.AuditEntry, 0)
+	for rows.Next() {
+		var (
+			entry     structs.AuditEntry
+			actorID   sql.NullString
+			timestamp int64
+			details   sql.NullString
+		)
+		if err := rows.Scan(&entry.ID, &entry.Action, &actorID, &entry.TargetType, &entry.TargetID, &entry.IP,
+			&timestamp, &details); err != nil {
+			return nil, err
+		}
+		if actorID.Valid {
+			id, err := uuid.Parse(actorID.String)
+			if err != nil {
+				return nil, err
+			}
+			entry.ActorID = &id
+		}
+		entry.Timestamp = fromUnixNano(timestamp)
+		if details.Valid && details.String != "" {
+			if err := json.Unmarshal([]byte(details.String), &entry.Details); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLiteDB) SearchMessages(ctx context.Context, q *search.Query) ([]*structs.Message, int, error) {
+	ids, total := s.index.Search(q)
+	if len(ids) == 0 {
+		return []*structs.Message{}, total, nil
+	}
+
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	found, err := s.queryMessages(ctx, false, messageQuery+" WHERE m.id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// keep the order of the index
+	byID := make(map[string]*structs.Message, len(found))
+	for _, msg := range found {
+		byID[msg.ID.String()] = msg
+	}
+	messages := make([]*structs.Message, 0, len(found))
+	for _, id := range ids {
+		if msg, ok := byID[id]; ok {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, total, nil
+}
@@ -0,0 +1,245 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/search"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+func TestSQLiteDB_Users(t *testing.T) {
+	db, err := OpenSQLite("")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+
+	user := &structs.User{ID: uuid.New(), Username: "jeff", Password: "hash", Created: time.Now()}
+	if _, err := db.CreateUser(ctx, user); err != nil {
+		t.Errorf("encountered error: %v", err)
+	}
+
+	if got, _ := db.FindUserByID(ctx, user.ID.String()); got == nil || got.Username != "jeff" || got.Password != "hash" {
+		t.Errorf("FindUserByID() got %v, wanted jeff", got)
+	}
+	if got, _ := db.FindUserByUsername(ctx, "jeff"); got == nil || got.ID != user.ID {
+		t.Errorf("FindUserByUsername() got %v, wanted jeff", got)
+	}
+	if got, _ := db.FindUserByUsername(ctx, "bob"); got != nil {
+		t.Errorf("FindUserByUsername() got %v, wanted nil", got)
+	}
+
+	if _, err := db.UpdateUser(ctx, &structs.User{ID: uuid.New(), Username: "bob"}); err != ErrUserNotFound {
+		t.Errorf("UpdateUser() on missing user got %v, wanted %v", err, ErrUserNotFound)
+	}
+}
+
+func TestSQLiteDB_Messages(t *testing.T) {
+	db, err := OpenSQLite("")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+
+	jeff := &structs.User{ID: uuid.New(), Username: "jeff", Created: time.Now()}
+	_, _ = db.CreateUser(ctx, jeff)
+	channelID := uuid.New()
+
+	start := time.Now()
+	var ids []uuid.UUID
+	for i := 0; i < 10; i++ {
+		msg := &structs.Message{
+			ID:        uuid.New(),
+			ChannelID: channelID,
+			Author:    jeff,
+			Content:   "message",
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		}
+		_, _ = db.CreateMessage(ctx, msg)
+		ids = append(ids, msg.ID)
+	}
+
+	recent, _ := db.GetRecentMessages(ctx, channelID.String(), 3)
+	if len(recent) != 3 || recent[0].ID != ids[7] || recent[2].ID != ids[9] {
+		t.Errorf("GetRecentMessages() got %v, wanted the last 3 messages oldest first", recent)
+	}
+	if recent[0].Author == nil || recent[0].Author.Username != "jeff" {
+		t.Errorf("recent[0].Author got %v, wanted jeff", recent[0].Author)
+	}
+
+	at := MessageCursor{Timestamp: start.Add(5 * time.Second)}
+	before, _ := db.GetMessagesBefore(ctx, channelID.String(), at, 2)
+	if len(before) != 2 || before[0].ID != ids[3] || before[1].ID != ids[4] {
+		t.Errorf("GetMessagesBefore() got %v, wanted messages 3 and 4", before)
+	}
+	after, _ := db.GetMessagesAfter(ctx, channelID.String(), at, 2)
+	if len(after) != 2 || after[0].ID != ids[6] || after[1].ID != ids[7] {
+		t.Errorf("GetMessagesAfter() got %v, wanted messages 6 and 7", after)
+	}
+	around, _ := db.GetMessagesAround(ctx, channelID.String(), at, 4)
+	if len(around) != 4 || around[0].ID != ids[3] || around[3].ID != ids[6] {
+		t.Errorf("GetMessagesAround() got %v, wanted messages 3 to 6", around)
+	}
+
+	msg, _ := db.FindMessageByID(ctx, ids[0].String())
+	edited := time.Now()
+	msg.Content = "edited"
+	msg.EditedTimestamp = &edited
+	msg.History = []*structs.MessageRevision{{Content: "message", Timestamp: msg.Timestamp}}
+	if _, err := db.UpdateMessage(ctx, msg); err != nil {
+		t.Errorf("UpdateMessage() got %v, wanted nil", err)
+	}
+	if got, _ := db.FindMessageByID(ctx, ids[0].String()); got.Content != "edited" || got.EditedTimestamp == nil || len(got.History) != 1 {
+		t.Errorf("FindMessageByID() got %v, wanted edited message with history", got)
+	}
+
+	if err := db.DeleteMessage(ctx, ids[0].String()); err != nil {
+		t.Errorf("DeleteMessage() got %v, wanted nil", err)
+	}
+	if err := db.DeleteMessage(ctx, ids[0].String()); err != ErrMessageNotFound {
+		t.Errorf("DeleteMessage() twice got %v, wanted %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestSQLiteDB_Reactions(t *testing.T) {
+	db, err := OpenSQLite("")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+
+	msg, _ := db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), Content: "message", Timestamp: time.Now()})
+	jeff := &structs.User{ID: uuid.New(), Username: "jeff"}
+	bob := &structs.User{ID: uuid.New(), Username: "bob"}
+
+	if added, err := db.CreateReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || !added {
+		t.Errorf("CreateReaction() got (%v, %v), wanted (true, nil)", added, err)
+	}
+	if added, err := db.CreateReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || added {
+		t.Errorf("CreateReaction() twice got (%v, %v), wanted (false, nil)", added, err)
+	}
+	_, _ = db.CreateReaction(ctx, msg.ID.String(), bob, "👍🏽")
+
+	got, _ := db.FindMessageByID(ctx, msg.ID.String())
+	if len(got.Reactions) != 1 || len(got.Reactions[0].Users) != 2 {
+		t.Fatalf("msg.Reactions got %v, wanted one reaction with two users", got.Reactions)
+	}
+
+	if removed, err := db.DeleteReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || !removed {
+		t.Errorf("DeleteReaction() got (%v, %v), wanted (true, nil)", removed, err)
+	}
+	if removed, err := db.DeleteReaction(ctx, msg.ID.String(), jeff, "👍🏽"); err != nil || removed {
+		t.Errorf("DeleteReaction() twice got (%v, %v), wanted (false, nil)", removed, err)
+	}
+
+	if _, err := db.CreateReaction(ctx, uuid.New().String(), jeff, "👍🏽"); err != ErrMessageNotFound {
+		t.Errorf("CreateReaction() on missing message got %v, wanted %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestSQLiteDB_Channels(t *testing.T) {
+	db, err := OpenSQLite("")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+
+	if got, _ := db.GetChannels(ctx); len(got) != 1 || got[0].Name != "general" {
+		t.Fatalf("GetChannels() got %v, wanted the general channel", got)
+	}
+
+	jeff := &structs.User{ID: uuid.New(), Username: "jeff"}
+	bob := &structs.User{ID: uuid.New(), Username: "bob"}
+	_, _ = db.CreateUser(ctx, jeff)
+	_, _ = db.CreateUser(ctx, bob)
+
+	dm, _ := db.CreateChannelWithMembers(ctx, &structs.Channel{ID: uuid.New(), Type: structs.ChannelTypeDM, Created: time.Now()},
+		[]string{jeff.ID.String(), bob.ID.String()})
+
+	if got, _ := db.GetChannels(ctx); len(got) != 1 {
+		t.Errorf("len(GetChannels()) got %v, wanted 1", len(got))
+	}
+	if got, _ := db.FindDirectChannel(ctx, bob.ID.String(), jeff.ID.String()); got == nil || got.ID != dm.ID {
+		t.Errorf("FindDirectChannel() got %v, wanted %v", got, dm)
+	}
+	if got, _ := db.GetChannelMembers(ctx, dm.ID.String()); len(got) != 2 || got[0].Username != "bob" {
+		t.Errorf("GetChannelMembers() got %v, wanted bob and jeff", got)
+	}
+	if got, _ := db.GetUserChannels(ctx, jeff.ID.String()); len(got) != 1 || got[0].ID != dm.ID {
+		t.Errorf("GetUserChannels() got %v, wanted the DM", got)
+	}
+
+	_, _ = db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), ChannelID: dm.ID, Content: "message", Timestamp: time.Now()})
+	if err := db.DeleteChannel(ctx, dm.ID.String()); err != nil {
+		t.Errorf("DeleteChannel() got %v, wanted nil", err)
+	}
+	if ok, _ := db.IsChannelMember(ctx, dm.ID.String(), jeff.ID.String()); ok {
+		t.Errorf("IsChannelMember() got true after the channel was deleted")
+	}
+	if got, _ := db.GetRecentMessages(ctx, dm.ID.String(), 10); len(got) != 0 {
+		t.Errorf("len(GetRecentMessages()) got %v, wanted 0", len(got))
+	}
+	if err := db.AddChannelMember(ctx, dm.ID.String(), jeff.ID.String()); err != ErrChannelNotFound {
+		t.Errorf("AddChannelMember() on missing channel got %v, wanted %v", err, ErrChannelNotFound)
+	}
+}
+
+func TestSQLiteDB_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	user := &structs.User{ID: uuid.New(), Username: "jeff", Created: time.Now()}
+	_, _ = db.CreateUser(ctx, user)
+	_ = db.RevokeToken(ctx, "token", time.Now().Add(time.Hour))
+	channels, _ := db.GetChannels(ctx)
+	msg := &structs.Message{ID: uuid.New(), ChannelID: channels[0].ID, Author: user, Content: "hello there", Timestamp: time.Now()}
+	_, _ = db.CreateMessage(ctx, msg)
+	_ = db.Close()
+
+	db, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+
+	if got, _ := db.FindUserByID(ctx, user.ID.String()); got == nil {
+		t.Errorf("FindUserByID() got nil after reopening")
+	}
+	if ok, _ := db.IsTokenRevoked(ctx, "token"); !ok {
+		t.Errorf("IsTokenRevoked() got false after reopening")
+	}
+	if got, _ := db.GetChannels(ctx); len(got) != 1 {
+		t.Errorf("len(GetChannels()) got %v after reopening, wanted 1", len(got))
+	}
+	query := &search.Query{Terms: []string{"hello"}, ChannelIDs: []string{channels[0].ID.String()}}
+	if got, _, _ := db.SearchMessages(ctx, query); len(got) != 1 || got[0].ID != msg.ID {
+		t.Errorf("SearchMessages() got %v after reopening, wanted the message", got)
+	}
+}
+
+func TestSQLiteDB_AuditAppendOnly(t *testing.T) {
+	db, err := OpenSQLite("")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	defer db.Close()
+
+	entry := &structs.AuditEntry{ID: uuid.New(), Action: structs.AuditLogin, Timestamp: time.Now()}
+	if err := db.CreateAuditEntry(ctx, entry); err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	if _, err := db.db.ExecContext(ctx, "UPDATE audit_log SET action = ?", structs.AuditLogout); err == nil {
+		t.Errorf("updating the audit log got nil, wanted an error")
+	}
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM audit_log"); err == nil {
+		t.Errorf("deleting from the audit log got nil, wanted an error")
+	}
+	if got, _ := db.GetAuditEntries(ctx, &AuditQuery{}); len(got) != 1 || got[0].Action != structs.AuditLogin {
+		t.Errorf("GetAuditEntries() got %v, wanted the entry unchanged", got)
+	}
+}
@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/blob"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+	"github.com/intrntsrfr/vue-ws-test/util"
+)
+
+const (
+	DefaultMaxAttachmentSize = 8 << 20
+	// DefaultUnattachedTTL is how long uploads are kept for without being
+	// sent with a message
+	DefaultUnattachedTTL = time.Hour * 24
+
+	// collectInterval is how often uploads that were never sent are looked for
+	collectInterval = time.Hour
+
+	// maxAttachments is how many attachments a message can have
+	maxAttachments = 10
+	// thumbnailSize is how many pixels wide and high thumbnails are at most
+	thumbnailSize = 256
+	// maxImagePixels is the largest image thumbnails are made for, so that
+	// small files can not decode into huge images. At four bytes a pixel it
+	// still takes 64MB to decode one.
+	maxImagePixels = 16_000_000
+	// thumbnailSuffix is added to the key of an attachment to store its
+	// thumbnail under
+	thumbnailSuffix = ".thumbnail"
+)
+
+// DefaultAttachmentTypes are the media types attachments can have unless
+// configured otherwise.
+var DefaultAttachmentTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp",
+	"text/plain", "application/pdf", "application/zip",
+	"video/mp4", "video/webm", "audio/mpeg", "audio/wave", "application/ogg",
+}
+
+// AttachmentConfig limits what can be uploaded.
+type AttachmentConfig struct {
+	// MaxSize is the largest file that can be uploaded, in bytes
+	MaxSize int64
+	// AllowedTypes are the media types files can have, as sniffed from their
+	// contents rather than what the client claims
+	AllowedTypes []string
+	// UnattachedTTL is how long uploads are kept for if they are not sent
+	// with a message
+	UnattachedTTL time.Duration
+}
+
+type AttachmentHandler struct {
+	r       *gin.Engine
+	db      database.DB
+	jwt     api.JWTService
+	ws      *Hub
+	blobs   blob.Store
+	maxSize int64
+	allowed map[string]bool
+	ttl     time.Duration
+}
+
+func NewAttachmentHandler(r *gin.Engine, db database.DB, jwtService api.JWTService, hub *Hub, limiters *RateLimiters, blobs blob.Store, conf *AttachmentConfig) *AttachmentHandler {
+	if conf == nil {
+		conf = &AttachmentConfig{}
+	}
+	h := &AttachmentHandler{
+		r:       r,
+		db:      db,
+		jwt:     jwtService,
+		ws:      hub,
+		blobs:   blobs,
+		maxSize: conf.MaxSize,
+		allowed: map[string]bool{},
+		ttl:     conf.UnattachedTTL,
+	}
+	if h.maxSize <= 0 {
+		h.maxSize = DefaultMaxAttachmentSize
+	}
+	if h.ttl <= 0 {
+		h.ttl = DefaultUnattachedTTL
+	}
+	types := conf.AllowedTypes
+	if len(types) == 0 {
+		types = DefaultAttachmentTypes
+	}
+	for _, t := range types {
+		h.allowed[t] = true
+	}
+
+	g := h.r.Group("/api/attachments")
+	g.POST("/", h.jwt.IsAuthorized(), RateLimit(limiters), RequireUnsanctioned(h.db), h.postAttachment())
+	// downloads are authorized by their signed links instead
+	g.GET("/:id", h.getAttachment(false))
+	g.GET("/:id/thumbnail", h.getAttachment(true))
+	return h
+}
+
+// collectLoop collects uploads that were never sent until the program exits.
+func (h *AttachmentHandler) collectLoop() {
+	ticker := time.NewTicker(collectInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.collectUnattached(context.Background()); err != nil {
+			fmt.Println("collecting attachments:", err)
+		}
+	}
+}
+
+// collectUnattached deletes the attachments that were not sent with a
+// message within the configured time of being uploaded, and their files.
+func (h *AttachmentHandler) collectUnattached(ctx context.Context) error {
+	deleted, err := h.db.DeleteUnattachedAttachments(ctx, time.Now().Add(-h.ttl))
+	for _, attachment := range deleted {
+		key := attachment.ID.String()
+		_ = h.blobs.Delete(ctx, key)
+		_ = h.blobs.Delete(ctx, key+thumbnailSuffix)
+	}
+	return err
+}
+
+// postAttachment uploads the file in the file field of a multipart form to
+// the channel given by channel_id. Images also get their dimensions worked
+// out and a thumbnail made. The attachment can then be sent along with a
+// message in the same channel, by the same user.
+func (h *AttachmentHandler) postAttachment() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// leave some room for the rest of the form
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxSize+1<<20)
+		if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{CodeError, "file is too large"})
+				return
+			}
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "file is required"})
+			return
+		}
+		if fileHeader.Size > h.maxSize {
+			c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{CodeError, "file is too large"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, ok := memberChannel(c, h.db, c.PostForm("channel_id"), user)
+		if !ok {
+			return
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+			return
+		}
+		defer file.Close()
+		contentType, err := sniffContentType(file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+			return
+		}
+		if !h.allowed[contentType] {
+			c.JSON(http.StatusUnsupportedMediaType, ErrorResponse{CodeError, "file type not allowed"})
+			return
+		}
+
+		attachment := &structs.Attachment{
+			ID:          uuid.New(),
+			ChannelID:   channel.ID,
+			UploaderID:  user.ID,
+			Filename:    cleanFilename(fileHeader.Filename),
+			ContentType: contentType,
+			Size:        fileHeader.Size,
+			Created:     time.Now(),
+		}
+		ctx := c.Request.Context()
+		key := attachment.ID.String()
+		if err := h.storeThumbnail(c, file, attachment); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			err = h.blobs.Put(ctx, key, file)
+		}
+		if err != nil {
+			_ = h.blobs.Delete(ctx, key+thumbnailSuffix)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+			return
+		}
+
+		if _, err := h.db.CreateAttachment(ctx, attachment); err != nil {
+			_ = h.blobs.Delete(ctx, key)
+			_ = h.blobs.Delete(ctx, key+thumbnailSuffix)
+			databaseError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, h.ws.signAttachment(attachment))
+	}
+}
+
+// storeThumbnail fills in the dimensions of images and stores a thumbnail of
+// them. Files that do not decode as an image are left alone.
+func (h *AttachmentHandler) storeThumbnail(c *gin.Context, file multipart.File, attachment *structs.Attachment) error {
+	if !strings.HasPrefix(attachment.ContentType, "image/") {
+		return nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	conf, _, err := image.DecodeConfig(file)
+	if err != nil || conf.Width*conf.Height > maxImagePixels {
+		return nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, util.Thumbnail(img, thumbnailSize)); err != nil {
+		return err
+	}
+	if err := h.blobs.Put(c.Request.Context(), attachment.ID.String()+thumbnailSuffix, &buf); err != nil {
+		return err
+	}
+	attachment.Width, attachment.Height = conf.Width, conf.Height
+	return nil
+}
+
+// sniffContentType works out the media type of a file from how it starts.
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return mediaType, err
+}
+
+// cleanFilename drops any directories from a filename sent by a client.
+func cleanFilename(name string) string {
+	name = strings.TrimSpace(name[strings.LastIndexAny(name, `/\`)+1:])
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// getAttachment downloads an attachment, or its thumbnail, through a link
+// handed out by signAttachment.
+func (h *AttachmentHandler) getAttachment(thumbnail bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.ws.signer.Verify(c.Request.URL.Path, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "invalid or expired link"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		attachment, err := h.db.FindAttachmentByID(ctx, c.Param("id"))
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		key, contentType, size := attachment.ID.String(), attachment.ContentType, attachment.Size
+		if thumbnail {
+			if !attachment.IsImage() {
+				c.JSON(http.StatusNotFound, ErrorResponse{CodeError, "attachment has no thumbnail"})
+				return
+			}
+			key, contentType, size = key+thumbnailSuffix, "image/png", -1
+		}
+
+		r, err := h.blobs.Open(ctx, key)
+		if errors.Is(err, blob.ErrNotFound) {
+			c.JSON(http.StatusNotFound, ErrorResponse{CodeError, "attachment not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+			return
+		}
+		defer r.Close()
+
+		// only images are shown in place, anything else is downloaded so that
+		// it can not run in the page
+		disposition := "attachment"
+		if attachment.IsImage() {
+			disposition = "inline"
+		}
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.DataFromReader(http.StatusOK, size, contentType, r, map[string]string{
+			"Content-Disposition": mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}),
+			"Cache-Control":       "private, max-age=300",
+		})
+	}
+}
+
+// attachmentPath returns where an attachment is downloaded from, before the
+// link is signed.
+func attachmentPath(id uuid.UUID) string {
+	return "/api/attachments/" + id.String()
+}
+
+// signAttachment returns a copy of an attachment with links to download it,
+// and its thumbnail if it has one.
+func (h *Hub) signAttachment(a *structs.Attachment) *structs.Attachment {
+	signed := *a
+	signed.URL = h.signer.Sign(attachmentPath(a.ID))
+	if a.IsImage() {
+		signed.ThumbnailURL = h.signer.Sign(attachmentPath(a.ID) + "/thumbnail")
+	}
+	return &signed
+}
+
+// signMessage returns a copy of a message with links to its attachments.
+// Messages without attachments are returned as they are.
+func (h *Hub) signMessage(msg *structs.Message) *structs.Message {
+	if len(msg.Attachments) == 0 {
+		return msg
+	}
+	signed := *msg
+	signed.Attachments = make([]*structs.Attachment, 0, len(msg.Attachments))
+	for _, a := range msg.Attachments {
+		signed.Attachments = append(signed.Attachments, h.signAttachment(a))
+	}
+	return &signed
+}
+
+// signMessages is signMessage for several messages.
+func (h *Hub) signMessages(msgs []*structs.Message) []*structs.Message {
+	signed := make([]*structs.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		signed = append(signed, h.signMessage(msg))
+	}
+	return signed
+}
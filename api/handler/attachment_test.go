@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/blob"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// uploadRequest returns a request uploading a file to a channel.
+func uploadRequest(t *testing.T, token, channelID, filename string, content []byte) *http.Request {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	_ = w.WriteField("channel_id", channelID)
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	_, _ = part.Write(content)
+	_ = w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/attachments/", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestAttachmentHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	db, _ := database.Open("")
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	jwtUtil := api.NewJWTUtil(&api.JWTConfig{Key: []byte("key")})
+	hub := NewHub(db, jwtUtil, nil, nil)
+	r := gin.New()
+	h := NewAttachmentHandler(r, db, jwtUtil, hub, nil, blobs, &AttachmentConfig{MaxSize: 64 << 10, UnattachedTTL: time.Nanosecond})
+	NewMessageHandler(r, db, jwtUtil, hub, nil)
+
+	user := &structs.User{ID: uuid.New(), Username: "jeff", Created: time.Now()}
+	_, _ = db.CreateUser(ctx, user)
+	token, _ := jwtUtil.GenerateToken(ctx, user)
+	channels, _ := db.GetChannels(ctx)
+	channelID := channels[0].ID.String()
+	_ = db.AddChannelMember(ctx, channelID, user.ID.String())
+
+	var img bytes.Buffer
+	_ = png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 600, 300)))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, uploadRequest(t, token, channelID, "../cat.png", img.Bytes()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+	}
+	var attachment structs.Attachment
+	_ = json.Unmarshal(w.Body.Bytes(), &attachment)
+	if attachment.Filename != "cat.png" || attachment.ContentType != "image/png" || attachment.Width != 600 || attachment.Height != 300 {
+		t.Errorf("upload got %+v, wanted a 600x300 image/png named cat.png", attachment)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, attachment.URL, nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), img.Bytes()) {
+		t.Errorf("download got %v, wanted %v with the uploaded file", w.Code, http.StatusOK)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, attachment.ThumbnailURL, nil))
+	if thumb, err := png.Decode(w.Body); err != nil || thumb.Bounds().Dx() != thumbnailSize || thumb.Bounds().Dy() != thumbnailSize/2 {
+		t.Errorf("thumbnail download got %v, wanted a %vx%v png", w.Code, thumbnailSize, thumbnailSize/2)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, attachmentPath(attachment.ID), nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unsigned download got %v, wanted %v", w.Code, http.StatusForbidden)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    int
+	}{
+		{"html", []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType},
+		{"too large", bytes.Repeat([]byte("a"), 128<<10), http.StatusRequestEntityTooLarge},
+		{"text", []byte("hello"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, uploadRequest(t, token, channelID, "file", tt.content))
+		if w.Code != tt.want {
+			t.Errorf("upload %v got %v, wanted %v", tt.name, w.Code, tt.want)
+		}
+	}
+
+	body, _ := json.Marshal(gin.H{"channel_id": channelID, "attachment_ids": []uuid.UUID{attachment.ID}})
+	req := httptest.NewRequest(http.MethodPost, "/api/messages/", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var msg structs.Message
+	_ = json.Unmarshal(w.Body.Bytes(), &msg)
+	if w.Code != http.StatusOK || len(msg.Attachments) != 1 || msg.Attachments[0].URL == "" {
+		t.Errorf("posting a message got %v: %v, wanted it with a signed attachment", w.Code, w.Body)
+	}
+	if stored, _ := db.FindMessageByID(ctx, msg.ID.String()); stored != nil && stored.Attachments[0].URL != "" {
+		t.Errorf("stored message got a signed link, wanted none")
+	}
+
+	body, _ = json.Marshal(gin.H{"channel_id": channelID, "attachment_ids": []uuid.UUID{uuid.New()}})
+	req = httptest.NewRequest(http.MethodPost, "/api/messages/", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("posting an unknown attachment got %v, wanted %v", w.Code, http.StatusBadRequest)
+	}
+
+	// the text file was never sent, unlike the image
+	var unsent structs.Attachment
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, uploadRequest(t, token, channelID, "file", []byte("hello")))
+	_ = json.Unmarshal(w.Body.Bytes(), &unsent)
+	time.Sleep(time.Millisecond)
+	if err := h.collectUnattached(ctx); err != nil {
+		t.Errorf("collectUnattached() got %v, wanted nil", err)
+	}
+	if _, err := db.FindAttachmentByID(ctx, unsent.ID.String()); !errors.Is(err, database.ErrAttachmentNotFound) {
+		t.Errorf("FindAttachmentByID() of an unsent upload got %v, wanted %v", err, database.ErrAttachmentNotFound)
+	}
+	if _, err := blobs.Open(ctx, unsent.ID.String()); !errors.Is(err, blob.ErrNotFound) {
+		t.Errorf("opening the file of an unsent upload got %v, wanted %v", err, blob.ErrNotFound)
+	}
+	for _, key := range []string{attachment.ID.String(), attachment.ID.String() + thumbnailSuffix} {
+		if f, err := blobs.Open(ctx, key); err != nil {
+			t.Errorf("opening %v of a sent attachment got %v, wanted nil", key, err)
+		} else {
+			_ = f.Close()
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+	"github.com/intrntsrfr/vue-ws-test/util"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 100
+)
+
+// AuditHandler lets admins look through the audit log.
+type AuditHandler struct {
+	r   *gin.Engine
+	db  database.DB
+	jwt api.JWTService
+}
+
+func NewAuditHandler(r *gin.Engine, db database.DB, jwtService api.JWTService) {
+	h := &AuditHandler{r, db, jwtService}
+
+	g := h.r.Group("/api/audit")
+	g.Use(h.jwt.IsAuthorized(), RequirePermission(h.db, structs.PermViewAuditLog))
+	g.GET("/", h.getEntries())
+}
+
+// getEntries returns a page of the audit log, newest first. The next page
+// starts before the last entry, given as the before parameter. Entries can be
+// narrowed down by action, actor_id and target_id.
+func (h *AuditHandler) getEntries() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := &database.AuditQuery{
+			Action:   structs.AuditAction(c.Query("action")),
+			ActorID:  c.Query("actor_id"),
+			TargetID: c.Query("target_id"),
+			Before:   c.Query("before"),
+			Limit:    defaultAuditLimit,
+		}
+		if l := c.Query("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "limit must be a positive number"})
+				return
+			}
+			q.Limit = util.Min(n, maxAuditLimit)
+		}
+
+		entries, err := h.db.GetAuditEntries(c.Request.Context(), q)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, entries)
+	}
+}
+
+// audit records an action in the audit log, as done by actor from the address
+// the request came from. Failing to record it does not fail the request.
+func audit(c *gin.Context, db database.DB, actor *structs.User, entry *structs.AuditEntry) {
+	entry.ID = uuid.New()
+	entry.IP = c.ClientIP()
+	entry.Timestamp = time.Now()
+	if actor != nil {
+		id := actor.ID
+		entry.ActorID = &id
+	}
+	// the action already happened, so it is recorded even if the client goes
+	// away in the meantime
+	if err := db.CreateAuditEntry(context.Background(), entry); err != nil {
+		fmt.Println("recording audit log entry:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+func TestAuditHandler(t *testing.T) {
+	s := newTestServer(t, nil, nil)
+	admin, adminToken := s.addUser(t, "admin", structs.RoleAdmin)
+	member, memberToken := s.addUser(t, "member", structs.RoleMember)
+	entries := func(query string) []*structs.AuditEntry {
+		t.Helper()
+		w := s.do(jsonRequest(http.MethodGet, "/api/audit/"+query, adminToken, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("getting the audit log got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+		}
+		var got []*structs.AuditEntry
+		_ = json.Unmarshal(w.Body.Bytes(), &got)
+		return got
+	}
+
+	if w := s.do(jsonRequest(http.MethodGet, "/api/audit/", memberToken, nil)); w.Code != http.StatusForbidden {
+		t.Errorf("member getting the audit log got %v, wanted %v", w.Code, http.StatusForbidden)
+	}
+
+	_ = s.do(jsonRequest(http.MethodPost, "/api/auth/login", "", gin.H{"username": "member", "password": "wrong"}))
+	_ = s.do(jsonRequest(http.MethodPut, "/api/users/"+member.ID.String()+"/ban", adminToken, gin.H{"reason": "abuse"}))
+	_ = s.do(jsonRequest(http.MethodPost, "/api/auth/login", "", gin.H{"username": "member", "password": "password"}))
+
+	got := entries("")
+	want := []structs.AuditAction{structs.AuditLoginFailed, structs.AuditBan, structs.AuditLoginFailed}
+	if len(got) != len(want) {
+		t.Fatalf("audit log got %v entries, wanted %v", len(got), len(want))
+	}
+	for i, action := range want {
+		// newest first
+		if entry := got[len(got)-1-i]; entry.Action != action {
+			t.Errorf("audit log entry %v got %v, wanted %v", i, entry.Action, action)
+		}
+	}
+	ban := got[1]
+	if ban.ActorID == nil || *ban.ActorID != admin.ID || ban.TargetID != member.ID.String() || ban.Details["reason"] != "abuse" || ban.IP == "" {
+		t.Errorf("ban entry got %+v, wanted it by admin on member, with the reason and IP", ban)
+	}
+	if got[0].ActorID != nil || got[0].Details["reason"] != "banned" {
+		t.Errorf("failed login entry got %+v, wanted one without an actor, failing for the ban", got[0])
+	}
+
+	if page := entries("?limit=1&before=" + got[0].ID.String()); len(page) != 1 || page[0].ID != ban.ID {
+		t.Errorf("second page got %v, wanted the ban", page)
+	}
+	if page := entries("?action=ban"); len(page) != 1 || page[0].ID != ban.ID {
+		t.Errorf("audit log of bans got %v, wanted the ban", page)
+	}
+	if w := s.do(jsonRequest(http.MethodGet, "/api/audit/?before="+uuid.New().String(), adminToken, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("getting the audit log before a missing entry got %v, wanted %v", w.Code, http.StatusNotFound)
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"github.com/intrntsrfr/vue-ws-test/structs"
 	"net/http"
 	"time"
@@ -13,17 +14,24 @@ import (
 )
 
 type AuthHandler struct {
-	r   *gin.Engine
-	db  database.DB
-	jwt api.JWTService
+	r         *gin.Engine
+	db        database.DB
+	jwt       api.JWTService
+	passwords api.PasswordService
+	policy    *api.CredentialPolicy
+	ws        *Hub
+	logins    *LoginTracker
 }
 
-func NewAuthHandler(r *gin.Engine, db database.DB, jwtService api.JWTService) {
-	h := &AuthHandler{r, db, jwtService}
+func NewAuthHandler(r *gin.Engine, db database.DB, jwtService api.JWTService, passwords api.PasswordService, policy *api.CredentialPolicy, hub *Hub, limiters *RateLimiters, logins *LoginTracker) {
+	h := &AuthHandler{r, db, jwtService, passwords, policy, hub, logins}
 
 	g := h.r.Group("/api/auth")
+	g.Use(RateLimit(limiters))
 	g.POST("/login", h.login())
 	g.POST("/register", h.register())
+	g.POST("/refresh", h.refresh())
+	g.POST("/logout", h.jwt.IsAuthorized(), h.logout())
 }
 
 func (h *AuthHandler) login() gin.HandlerFunc {
@@ -39,21 +47,67 @@ func (h *AuthHandler) login() gin.HandlerFunc {
 			return
 		}
 
-		user := h.db.FindUserByUsername(loginBody.Username)
-		if user == nil || loginBody.Password != user.Password {
-			c.JSON(http.StatusUnauthorized, ErrorResponse{CodeError, "invalid username or password"})
+		user, err := h.db.FindUserByUsername(c.Request.Context(), loginBody.Username)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			databaseError(c, err)
 			return
 		}
+		failed := &structs.AuditEntry{
+			Action:  structs.AuditLoginFailed,
+			Details: map[string]string{"username": loginBody.Username},
+		}
+		if user != nil {
+			failed.TargetType, failed.TargetID = structs.AuditTargetUser, user.ID.String()
+		}
 
-		token, err := h.jwt.GenerateToken(user)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+		// the attempt is counted before the password is checked, so that
+		// guesses made while locked out can not tell whether they were
+		// right, and known and unknown usernames are counted alike
+		wait, locked := h.logins.attempt(loginBody.Username, c.ClientIP())
+		// logins turned away while locked out are not audited, as anyone
+		// could flood the log with them. The failure that locked the
+		// username is.
+		if wait > 0 {
+			lockedOut(c, wait)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"token": token,
+		hash := ""
+		if user != nil {
+			hash = user.Password
+		}
+		// an empty hash is still verified, so that unknown usernames take
+		// as long as wrong passwords
+		if !h.passwords.Verify(hash, loginBody.Password) || user == nil {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{CodeError, "invalid username or password"})
+			failed.Details["reason"] = "invalid username or password"
+			if locked {
+				failed.Details["locked"] = "true"
+			}
+			audit(c, h.db, nil, failed)
+			return
+		}
+		h.logins.succeed(loginBody.Username, c.ClientIP())
+		if sanctioned(c, h.db, user, structs.SanctionBan) {
+			failed.Details["reason"] = "banned"
+			audit(c, h.db, nil, failed)
+			return
+		}
+
+		if h.passwords.NeedsRehash(user.Password) {
+			if newHash, err := h.passwords.Hash(loginBody.Password); err == nil {
+				userCopy := *user
+				userCopy.Password = newHash
+				_, _ = h.db.UpdateUser(c.Request.Context(), &userCopy)
+			}
+		}
+
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditLogin,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   user.ID.String(),
 		})
+		h.issueTokens(c, user)
 	}
 }
 
@@ -70,31 +124,170 @@ func (h *AuthHandler) register() gin.HandlerFunc {
 			return
 		}
 
-		user := h.db.FindUserByUsername(registerBody.Username)
-		if user != nil {
-			c.JSON(http.StatusConflict, ErrorResponse{CodeError, "username already taken"})
+		if err := h.policy.ValidateUsername(registerBody.Username); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, err.Error()})
+			return
+		}
+		if err := h.policy.ValidatePassword(registerBody.Password); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, err.Error()})
 			return
 		}
 
-		user, err := h.db.CreateUser(&structs.User{
+		hash, err := h.passwords.Hash(registerBody.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+			return
+		}
+
+		count, err := h.db.CountUsers(c.Request.Context())
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		user, err := h.db.CreateUser(c.Request.Context(), &structs.User{
 			ID:       uuid.New(),
 			Username: registerBody.Username,
-			Password: registerBody.Password,
+			Password: hash,
 			Created:  time.Now(),
+			Role:     structs.RoleMember,
 		})
 		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		// the first user to register owns the server. Users registering at
+		// the same time can all find none before them, so only one of them
+		// gets to claim it.
+		if count == 0 {
+			owner, err := h.db.ClaimOwnership(c.Request.Context(), user.ID.String())
+			if err != nil {
+				databaseError(c, err)
+				return
+			}
+			if owner {
+				user.Role = structs.RoleOwner
+			}
+		}
+
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditRegister,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   user.ID.String(),
+		})
+		h.issueTokens(c, user)
+	}
+}
+
+type RefreshBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refresh trades a refresh token for a new access token. Refresh tokens are
+// single use, so a new one is handed out as well.
+func (h *AuthHandler) refresh() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var refreshBody RefreshBody
+		if err := c.BindJSON(&refreshBody); err != nil || refreshBody.RefreshToken == "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		hash := api.HashRefreshToken(refreshBody.RefreshToken)
+		stored, err := h.db.FindRefreshToken(c.Request.Context(), hash)
+		if errors.Is(err, database.ErrNotFound) || (err == nil && time.Now().After(stored.Expires)) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{CodeError, "invalid refresh token"})
+			return
+		} else if err != nil {
+			databaseError(c, err)
+			return
+		}
+		// whoever deletes it first gets to use it
+		if err := h.db.DeleteRefreshToken(c.Request.Context(), hash); errors.Is(err, database.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{CodeError, "invalid refresh token"})
+			return
+		} else if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		user, err := h.db.FindUserByID(c.Request.Context(), stored.UserID.String())
+		if errors.Is(err, database.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{CodeError, "user does not exist"})
+			return
+		} else if err != nil {
+			databaseError(c, err)
+			return
+		}
+		if sanctioned(c, h.db, user, structs.SanctionBan) {
+			return
+		}
+
+		h.issueTokens(c, user)
+	}
+}
+
+// logout revokes the access token used to make the request, and disconnects
+// the websocket sessions that identified with it. If a refresh token is
+// given, it is revoked as well.
+func (h *AuthHandler) logout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var refreshBody RefreshBody
+		// the body is optional
+		_ = c.ShouldBindJSON(&refreshBody)
+
+		claims, ok := c.MustGet("claims").(*api.UserClaims)
+		if !ok {
 			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
 			return
 		}
 
-		token, err := h.jwt.GenerateToken(user)
-		if err != nil {
+		if refreshBody.RefreshToken != "" {
+			hash := api.HashRefreshToken(refreshBody.RefreshToken)
+			if stored, err := h.db.FindRefreshToken(c.Request.Context(), hash); err == nil && stored.UserID.String() == claims.Subject {
+				_ = h.db.DeleteRefreshToken(c.Request.Context(), hash)
+			}
+		}
+
+		if err := h.jwt.RevokeToken(c.Request.Context(), claims); err != nil {
 			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"token": token,
-		})
+		c.Status(http.StatusNoContent)
+		h.ws.disconnectToken(claims.ID)
+
+		entry := &structs.AuditEntry{
+			Action:     structs.AuditLogout,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   claims.Subject,
+		}
+		if id, err := uuid.Parse(claims.Subject); err == nil {
+			entry.ActorID = &id
+		}
+		audit(c, h.db, nil, entry)
+	}
+}
+
+// issueTokens responds with a new access token and refresh token for a user.
+func (h *AuthHandler) issueTokens(c *gin.Context, user *structs.User) {
+	token, err := h.jwt.GenerateToken(c.Request.Context(), user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+		return
 	}
+
+	refreshToken, stored, err := h.jwt.GenerateRefreshToken(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+		return
+	}
+	if _, err := h.db.CreateRefreshToken(c.Request.Context(), stored); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+	})
 }
@@ -0,0 +1,441 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+const (
+	maxChannelNameLength  = 100
+	maxChannelTopicLength = 1024
+)
+
+type ChannelHandler struct {
+	r   *gin.Engine
+	db  database.DB
+	jwt api.JWTService
+	ws  *Hub
+}
+
+func NewChannelHandler(r *gin.Engine, db database.DB, jwtService api.JWTService, hub *Hub) {
+	h := &ChannelHandler{r, db, jwtService, hub}
+
+	g := h.r.Group("/api/channels")
+	g.Use(h.jwt.IsAuthorized())
+	g.GET("/", h.getChannels())
+	g.POST("/", RequirePermission(h.db, structs.PermCreateChannels), RequireUnsanctioned(h.db), h.postChannel())
+	g.GET("/:id", h.getChannel())
+	g.PATCH("/:id", RequireUnsanctioned(h.db), h.patchChannel())
+	g.DELETE("/:id", RequireUnsanctioned(h.db), h.deleteChannel())
+
+	g.GET("/:id/members", h.getMembers())
+	g.POST("/:id/members", RequireUnsanctioned(h.db), h.postMember())
+	g.DELETE("/:id/members", RequireUnsanctioned(h.db), h.deleteMember())
+
+	g.PUT("/:id/overrides/:role", RequireUnsanctioned(h.db), h.putOverride())
+	g.DELETE("/:id/overrides/:role", RequireUnsanctioned(h.db), h.deleteOverride())
+}
+
+// validChannel trims the name and topic of a channel, and reports whether
+// they are within bounds.
+func validChannel(channel *structs.Channel) bool {
+	channel.Name = strings.TrimSpace(channel.Name)
+	channel.Topic = strings.TrimSpace(channel.Topic)
+	return channel.Name != "" && len(channel.Name) <= maxChannelNameLength && len(channel.Topic) <= maxChannelTopicLength
+}
+
+func (h *ChannelHandler) getChannels() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channels, err := h.db.GetChannels(c.Request.Context())
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, channels)
+	}
+}
+
+func (h *ChannelHandler) postChannel() gin.HandlerFunc {
+	type PostChannelBody struct {
+		Name  string `json:"name"`
+		Topic string `json:"topic"`
+	}
+
+	return func(c *gin.Context) {
+		var postChannelBody PostChannelBody
+		if err := c.BindJSON(&postChannelBody); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+
+		channel := &structs.Channel{
+			ID:      uuid.New(),
+			Name:    postChannelBody.Name,
+			Topic:   postChannelBody.Topic,
+			OwnerID: user.ID,
+			Created: time.Now(),
+		}
+		if !validChannel(channel) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		channel, err := h.db.CreateChannel(c.Request.Context(), channel)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		if err := h.db.AddChannelMember(c.Request.Context(), channel.ID.String(), user.ID.String()); err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, channel)
+		_ = h.ws.dispatchEvent(ActionChannelCreate, nil, channel)
+		_ = h.ws.dispatchEvent(ActionChannelMemberAdd, nil, &structs.ChannelMemberAdd{ChannelID: channel.ID, User: user})
+	}
+}
+
+func (h *ChannelHandler) getChannel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, ok := visibleChannel(c, h.db, c.Param("id"), user)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, channel)
+	}
+}
+
+func (h *ChannelHandler) patchChannel() gin.HandlerFunc {
+	type PatchChannelBody struct {
+		Name  *string `json:"name"`
+		Topic *string `json:"topic"`
+	}
+
+	return func(c *gin.Context) {
+		var patchChannelBody PatchChannelBody
+		if err := c.BindJSON(&patchChannelBody); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, ok := ownedChannel(c, h.db, user)
+		if !ok {
+			return
+		}
+
+		channelCopy := *channel
+		if patchChannelBody.Name != nil {
+			channelCopy.Name = *patchChannelBody.Name
+		}
+		if patchChannelBody.Topic != nil {
+			channelCopy.Topic = *patchChannelBody.Topic
+		}
+		if !validChannel(&channelCopy) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		channel, err := h.db.UpdateChannel(c.Request.Context(), &channelCopy)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, channel)
+		_ = h.ws.dispatchEvent(ActionChannelUpdate, nil, channel)
+	}
+}
+
+func (h *ChannelHandler) deleteChannel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, ok := ownedChannel(c, h.db, user)
+		if !ok {
+			return
+		}
+
+		if err := h.db.DeleteChannel(c.Request.Context(), channel.ID.String()); err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+		_ = h.ws.dispatchEvent(ActionChannelDelete, nil, channel)
+	}
+}
+
+func (h *ChannelHandler) getMembers() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, ok := memberChannel(c, h.db, c.Param("id"), user)
+		if !ok {
+			return
+		}
+
+		members, err := h.db.GetChannelMembers(c.Request.Context(), channel.ID.String())
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, withoutPasswords(members))
+	}
+}
+
+func (h *ChannelHandler) postMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, err := h.db.FindChannelByID(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, database.ErrNotFound) || (err == nil && channel.Private()) {
+			c.JSON(http.StatusNotFound, ErrorResponse{CodeError, "channel not found"})
+			return
+		} else if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		channelID, userID := channel.ID.String(), user.ID.String()
+		isMember, err := h.db.IsChannelMember(c.Request.Context(), channelID, userID)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		if isMember {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		if err := h.db.AddChannelMember(c.Request.Context(), channelID, userID); err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+		_ = h.ws.dispatchEvent(ActionChannelMemberAdd, nil, &structs.ChannelMemberAdd{ChannelID: channel.ID, User: user})
+	}
+}
+
+func (h *ChannelHandler) deleteMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, ok := memberChannel(c, h.db, c.Param("id"), user)
+		if !ok {
+			return
+		}
+		if channel.Type == structs.ChannelTypeDM {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "can not leave a direct message"})
+			return
+		}
+
+		if err := h.db.RemoveChannelMember(c.Request.Context(), channel.ID.String(), user.ID.String()); err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+		_ = h.ws.dispatchEvent(ActionChannelMemberRemove, nil, &structs.ChannelMemberRemove{ChannelID: channel.ID, User: user})
+	}
+}
+
+// memberChannel returns the channel with the given ID, as long as the user is
+// a member of it. If not, an error response is written and ok is false.
+func memberChannel(c *gin.Context, db database.DB, channelID string, user *structs.User) (channel *structs.Channel, ok bool) {
+	channel, isMember, ok := findChannel(c, db, channelID, user)
+	if !ok {
+		return nil, false
+	}
+	if !isMember {
+		c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "not a member of this channel"})
+		return nil, false
+	}
+	return channel, true
+}
+
+// visibleChannel returns the channel with the given ID, as long as the user
+// can see it. If not, an error response is written and ok is false.
+func visibleChannel(c *gin.Context, db database.DB, channelID string, user *structs.User) (channel *structs.Channel, ok bool) {
+	channel, _, ok = findChannel(c, db, channelID, user)
+	return channel, ok
+}
+
+// findChannel looks up a channel and whether the user is a member of it.
+// Private channels are not found by those outside them. If the channel can
+// not be found, an error response is written and ok is false.
+func findChannel(c *gin.Context, db database.DB, channelID string, user *structs.User) (channel *structs.Channel, isMember bool, ok bool) {
+	channel, err := db.FindChannelByID(c.Request.Context(), channelID)
+	if err == nil {
+		isMember, err = db.IsChannelMember(c.Request.Context(), channelID, user.ID.String())
+	}
+	if errors.Is(err, database.ErrNotFound) || (err == nil && channel.Private() && !isMember) {
+		c.JSON(http.StatusNotFound, ErrorResponse{CodeError, "channel not found"})
+		return nil, false, false
+	} else if err != nil {
+		databaseError(c, err)
+		return nil, false, false
+	}
+	return channel, isMember, true
+}
+
+// ownedChannel returns the channel given by the id parameter, as long as the
+// user owns it or is allowed to manage channels. If not, an error response is
+// written and ok is false.
+func ownedChannel(c *gin.Context, db database.DB, user *structs.User) (channel *structs.Channel, ok bool) {
+	channel, ok = visibleChannel(c, db, c.Param("id"), user)
+	if !ok {
+		return nil, false
+	}
+	if channel.OwnerID != user.ID && !channel.PermissionsFor(user.Role).Has(structs.PermManageChannels) {
+		c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "only the owner can do this"})
+		return nil, false
+	}
+	return channel, true
+}
+
+// putOverride sets what the role given by the role parameter is allowed to do
+// in a channel. Users can only set overrides for roles below their own, and
+// only allow what they are allowed to do themselves.
+func (h *ChannelHandler) putOverride() gin.HandlerFunc {
+	type PutOverrideBody struct {
+		Allow structs.Permissions `json:"allow"`
+		Deny  structs.Permissions `json:"deny"`
+	}
+
+	return func(c *gin.Context) {
+		var putOverrideBody PutOverrideBody
+		if err := c.BindJSON(&putOverrideBody); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, role, ok := h.overrideTarget(c, user)
+		if !ok {
+			return
+		}
+		if putOverrideBody.Allow&putOverrideBody.Deny != 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "can not both allow and deny a permission"})
+			return
+		}
+		if !hasPermission(c, channel.PermissionsFor(user.Role), putOverrideBody.Allow) {
+			return
+		}
+
+		channelCopy := *channel
+		channelCopy.SetOverride(&structs.PermissionOverride{
+			Role:  role,
+			Allow: putOverrideBody.Allow,
+			Deny:  putOverrideBody.Deny,
+		})
+		if !h.updateOverrides(c, &channelCopy) {
+			return
+		}
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditOverrideUpdate,
+			TargetType: structs.AuditTargetChannel,
+			TargetID:   channel.ID.String(),
+			Details: map[string]string{
+				"role":  string(role),
+				"allow": strconv.FormatUint(uint64(putOverrideBody.Allow), 10),
+				"deny":  strconv.FormatUint(uint64(putOverrideBody.Deny), 10),
+			},
+		})
+	}
+}
+
+// deleteOverride removes the override of the role given by the role parameter
+// from a channel.
+func (h *ChannelHandler) deleteOverride() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, role, ok := h.overrideTarget(c, user)
+		if !ok {
+			return
+		}
+
+		channelCopy := *channel
+		channelCopy.SetOverride(&structs.PermissionOverride{Role: role})
+		if !h.updateOverrides(c, &channelCopy) {
+			return
+		}
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditOverrideDelete,
+			TargetType: structs.AuditTargetChannel,
+			TargetID:   channel.ID.String(),
+			Details:    map[string]string{"role": string(role)},
+		})
+	}
+}
+
+// overrideTarget returns the channel given by the id parameter and the role
+// given by the role parameter, as long as the user is allowed to manage the
+// channel and ranks above the role. If not, an error response is written and
+// ok is false.
+func (h *ChannelHandler) overrideTarget(c *gin.Context, user *structs.User) (channel *structs.Channel, role structs.Role, ok bool) {
+	role = structs.Role(c.Param("role"))
+	if !role.Valid() {
+		c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "unknown role"})
+		return nil, "", false
+	}
+	channel, ok = visibleChannel(c, h.db, c.Param("id"), user)
+	if !ok || !hasPermission(c, channel.PermissionsFor(user.Role), structs.PermManageChannels) {
+		return nil, "", false
+	}
+	if role.Rank() >= user.Role.Rank() {
+		c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "can only change roles below your own"})
+		return nil, "", false
+	}
+	return channel, role, true
+}
+
+// updateOverrides stores a channel after its overrides were changed, and
+// reports whether it was stored.
+func (h *ChannelHandler) updateOverrides(c *gin.Context, channel *structs.Channel) bool {
+	channel, err := h.db.UpdateChannel(c.Request.Context(), channel)
+	if err != nil {
+		databaseError(c, err)
+		return false
+	}
+
+	c.JSON(http.StatusOK, channel)
+	_ = h.ws.dispatchEvent(ActionChannelUpdate, nil, channel)
+	return true
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// writeWait is how long a single write may take before the client is
+// considered dead.
+const writeWait = time.Second * 10
+
+// Client represents a connected websocket client
+type Client struct {
+	User       *structs.User
+	Conn       *websocket.Conn
+	Identified bool
+	LastPing   time.Time
+	// addr is the address the client connected from
+	addr string
+	// TokenID is the ID of the access token the client identified with
+	TokenID string
+	// Channels is the set of channel IDs the client receives events for
+	Channels map[string]bool
+
+	// lastTyping is when the client last renewed a typing indicator
+	lastTyping time.Time
+	// lastActive is when the user last did something on the client, and is
+	// guarded by the hub
+	lastActive time.Time
+
+	session *session
+
+	// ctx is canceled once the client is closed, so that work done on its
+	// behalf can stop early
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// send queues events for writePump, which is the only goroutine that
+	// writes to Conn
+	send      chan *sendEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	closeData *ErrorData
+}
+
+func newClient(conn *websocket.Conn, queueSize int) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		Conn:       conn,
+		LastPing:   time.Now(),
+		lastActive: time.Now(),
+		Channels:   map[string]bool{},
+		ctx:        ctx,
+		cancel:     cancel,
+		send:       make(chan *sendEvent, queueSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// sharesChannel reports whether the client is subscribed to any of the
+// given channels.
+func (c *Client) sharesChannel(channels map[string]bool) bool {
+	for id := range channels {
+		if c.Channels[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue queues msg to be written without blocking, and reports whether
+// there was room for it.
+func (c *Client) enqueue(msg *sendEvent) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the client from being written to and closes its connection.
+// If data is not nil, it is sent as an error event right before closing.
+// Anything still queued is thrown away.
+func (c *Client) close(data *ErrorData) {
+	c.closeOnce.Do(func() {
+		c.closeData = data
+		close(c.done)
+		c.cancel()
+	})
+}
+
+// closedWith returns the error the client was closed with, if it was closed
+// with one.
+func (c *Client) closedWith() *ErrorData {
+	select {
+	case <-c.done:
+		return c.closeData
+	default:
+		return nil
+	}
+}
+
+// writePump writes queued events to the connection until the client is
+// closed or a write fails.
+func (c *Client) writePump() {
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteJSON(msg); err != nil {
+				c.close(nil)
+				return
+			}
+		case <-c.done:
+			if c.closeData != nil {
+				_ = c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				_ = c.Conn.WriteJSON(&sendEvent{
+					Operation: Error,
+					Data:      c.closeData,
+					Action:    ActionNone,
+				})
+			}
+			_ = c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// maxGroupSize is the most users a group conversation can have, including
+// the one who opens it.
+const maxGroupSize = 10
+
+// ConversationHandler handles private conversations, which are channels of
+// the DM and group types. Their messages go through the MessageHandler like
+// any other channel.
+type ConversationHandler struct {
+	r   *gin.Engine
+	db  database.DB
+	jwt api.JWTService
+	ws  *Hub
+}
+
+func NewConversationHandler(r *gin.Engine, db database.DB, jwtService api.JWTService, hub *Hub) {
+	h := &ConversationHandler{r, db, jwtService, hub}
+
+	g := h.r.Group("/api/conversations")
+	g.Use(h.jwt.IsAuthorized())
+	g.GET("/", h.getConversations())
+	g.POST("/", RequireUnsanctioned(h.db), h.postConversation())
+}
+
+func (h *ConversationHandler) getConversations() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+
+		channels, err := h.db.GetUserChannels(c.Request.Context(), user.ID.String())
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		conversations := make([]*structs.Conversation, 0)
+		for _, channel := range channels {
+			if !channel.Private() {
+				continue
+			}
+			conversation, err := h.conversation(c.Request.Context(), channel)
+			if err != nil {
+				databaseError(c, err)
+				return
+			}
+			conversations = append(conversations, conversation)
+		}
+		c.JSON(http.StatusOK, conversations)
+	}
+}
+
+// postConversation opens a conversation with the given users. With a single
+// other user it is a DM, and an existing DM between the two is reused.
+// Otherwise a new group is created, owned by the user opening it.
+func (h *ConversationHandler) postConversation() gin.HandlerFunc {
+	type PostConversationBody struct {
+		UserIDs []uuid.UUID `json:"user_ids"`
+		Name    string      `json:"name"`
+	}
+
+	return func(c *gin.Context) {
+		var postConversationBody PostConversationBody
+		if err := c.BindJSON(&postConversationBody); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+
+		seen := map[uuid.UUID]bool{user.ID: true}
+		var recipients []*structs.User
+		for _, id := range postConversationBody.UserIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			recipient, err := h.db.FindUserByID(c.Request.Context(), id.String())
+			if err != nil {
+				databaseError(c, err)
+				return
+			}
+			recipients = append(recipients, recipient)
+		}
+		if len(recipients) == 0 || len(recipients)+1 > maxGroupSize {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "a conversation needs between 2 and 10 users"})
+			return
+		}
+
+		channel := &structs.Channel{
+			ID:      uuid.New(),
+			Type:    structs.ChannelTypeGroup,
+			Name:    strings.TrimSpace(postConversationBody.Name),
+			OwnerID: user.ID,
+			Created: time.Now(),
+		}
+		if len(recipients) == 1 {
+			existing, err := h.db.FindDirectChannel(c.Request.Context(), user.ID.String(), recipients[0].ID.String())
+			if err == nil {
+				h.respondConversation(c, existing)
+				return
+			} else if !errors.Is(err, database.ErrNotFound) {
+				databaseError(c, err)
+				return
+			}
+			channel.Type = structs.ChannelTypeDM
+			channel.Name = ""
+			channel.OwnerID = uuid.Nil
+		}
+		if len(channel.Name) > maxChannelNameLength {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		memberIDs := []string{user.ID.String()}
+		for _, u := range recipients {
+			memberIDs = append(memberIDs, u.ID.String())
+		}
+		channel, err := h.db.CreateChannelWithMembers(c.Request.Context(), channel, memberIDs)
+		if errors.Is(err, database.ErrDirectChannelTaken) {
+			// the other user opened it at the same time
+			existing, err := h.db.FindDirectChannel(c.Request.Context(), user.ID.String(), recipients[0].ID.String())
+			if err != nil {
+				databaseError(c, err)
+				return
+			}
+			h.respondConversation(c, existing)
+			return
+		} else if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		h.respondConversation(c, channel)
+		_ = h.ws.dispatchEvent(ActionChannelCreate, nil, channel)
+	}
+}
+
+// respondConversation responds with the conversation for a channel.
+func (h *ConversationHandler) respondConversation(c *gin.Context, channel *structs.Channel) {
+	conversation, err := h.conversation(c.Request.Context(), channel)
+	if err != nil {
+		databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, conversation)
+}
+
+func (h *ConversationHandler) conversation(ctx context.Context, channel *structs.Channel) (*structs.Conversation, error) {
+	members, err := h.db.GetChannelMembers(ctx, channel.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	return &structs.Conversation{
+		Channel:    channel,
+		Recipients: withoutPasswords(members),
+	}, nil
+}
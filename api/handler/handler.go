@@ -2,6 +2,7 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -10,7 +11,9 @@ import (
 	"time"
 
 	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/blob"
 	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -31,24 +34,66 @@ type Handler struct {
 	e  *gin.Engine
 	ws *Hub
 	db database.DB
+	// attachments is nil if there is nowhere to store them
+	attachments *AttachmentHandler
 }
 
 type Config struct {
-	JwtUtil api.JWTService
-	DB      database.DB
+	JwtUtil          api.JWTService
+	PasswordUtil     api.PasswordService
+	CredentialPolicy *api.CredentialPolicy
+	DB               database.DB
+	Hub              *HubConfig
+	// RateLimiters limits how often clients can make requests and send
+	// websocket events. If it is nil, DefaultRateLimits is used.
+	RateLimiters *RateLimiters
+	// Logins tracks failed logins. If it is nil, the default lockout is used.
+	Logins *LoginTracker
+	// Blobs stores attachments, which can not be uploaded without it
+	Blobs       blob.Store
+	Attachments *AttachmentConfig
+	// TrustedProxies are the addresses and networks of the proxies whose
+	// X-Forwarded-For headers are believed. Without any, clients are known
+	// by the address they connect from.
+	TrustedProxies []string
 }
 
-func NewHandler(conf *Config) *Handler {
+func NewHandler(conf *Config) (*Handler, error) {
+	limiters := conf.RateLimiters
+	if limiters == nil {
+		limiters = NewRateLimiters(nil)
+	}
+	logins := conf.Logins
+	if logins == nil {
+		logins = NewLoginTracker(nil)
+	}
 	h := &Handler{
-		gin.Default(),
-		NewHub(conf.DB, conf.JwtUtil),
-		conf.DB,
+		e:  gin.Default(),
+		ws: NewHub(conf.DB, conf.JwtUtil, limiters, conf.Hub),
+		db: conf.DB,
+	}
+	// rate limits, lockouts and the audit log go by the address of clients,
+	// which anyone could claim through headers if every peer were trusted
+	if err := h.e.SetTrustedProxies(conf.TrustedProxies); err != nil {
+		return nil, err
 	}
 
 	h.e.Use(Cors())
 
-	NewAuthHandler(h.e, conf.DB, conf.JwtUtil)
-	NewMessageHandler(h.e, conf.DB, conf.JwtUtil, h.ws)
+	policy := conf.CredentialPolicy
+	if policy == nil {
+		policy = api.DefaultCredentialPolicy()
+	}
+
+	NewAuthHandler(h.e, conf.DB, conf.JwtUtil, conf.PasswordUtil, policy, h.ws, limiters, logins)
+	NewMessageHandler(h.e, conf.DB, conf.JwtUtil, h.ws, limiters)
+	NewChannelHandler(h.e, conf.DB, conf.JwtUtil, h.ws)
+	NewConversationHandler(h.e, conf.DB, conf.JwtUtil, h.ws)
+	NewUserHandler(h.e, conf.DB, conf.JwtUtil, h.ws, logins)
+	NewAuditHandler(h.e, conf.DB, conf.JwtUtil)
+	if conf.Blobs != nil {
+		h.attachments = NewAttachmentHandler(h.e, conf.DB, conf.JwtUtil, h.ws, limiters, conf.Blobs, conf.Attachments)
+	}
 
 	h.e.GET("/api/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
@@ -56,7 +101,7 @@ func NewHandler(conf *Config) *Handler {
 
 	h.e.GET("/ws", h.ws.Handler())
 
-	return h
+	return h, nil
 }
 
 func (h *Handler) Run(address string) error {
@@ -66,6 +111,9 @@ func (h *Handler) Run(address string) error {
 	}
 
 	go h.ws.Run()
+	if h.attachments != nil {
+		go h.attachments.collectLoop()
+	}
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -73,7 +121,7 @@ func (h *Handler) Run(address string) error {
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
@@ -83,9 +131,60 @@ func (h *Handler) Run(address string) error {
 func Cors() gin.HandlerFunc {
 	return cors.New(cors.Config{
 		AllowAllOrigins:  true,
-		AllowMethods:     []string{"GET", "POST", "OPTIONS", "DELETE"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "OPTIONS", "DELETE"},
 		AllowHeaders:     []string{"Authorization", "Content-Type"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	})
 }
+
+// currentUser returns a copy of the user the request was authorized as, with
+// the password left out. If the user can not be found, an error response is
+// written and ok is false.
+func currentUser(c *gin.Context, db database.DB) (user *structs.User, ok bool) {
+	if user, ok := c.Get("user"); ok {
+		return user.(*structs.User), true
+	}
+	claims, ok := c.MustGet("claims").(*api.UserClaims)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+		return nil, false
+	}
+
+	found, err := db.FindUserByID(c.Request.Context(), claims.Subject)
+	if errors.Is(err, database.ErrNotFound) {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{CodeError, "user does not exist"})
+		return nil, false
+	} else if err != nil {
+		databaseError(c, err)
+		return nil, false
+	}
+	userCopy := *found
+	userCopy.Password = ""
+	return &userCopy, true
+}
+
+// databaseError writes the error response for an error returned by the
+// database. Missing items are a 404 and conflicts a 409, with the error as
+// the message. Anything else is an internal server error.
+func databaseError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{CodeError, err.Error()})
+	case errors.Is(err, database.ErrConflict):
+		c.JSON(http.StatusConflict, ErrorResponse{CodeError, err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
+	}
+}
+
+// withoutPasswords returns copies of the users with their passwords left out.
+func withoutPasswords(users []*structs.User) []*structs.User {
+	copies := make([]*structs.User, 0, len(users))
+	for _, u := range users {
+		userCopy := *u
+		userCopy.Password = ""
+		copies = append(copies, &userCopy)
+	}
+	return copies
+}
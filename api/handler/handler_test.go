@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/blob"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testServer is every handler served from an in-memory database.
+type testServer struct {
+	db        database.DB
+	jwt       *api.JWTUtil
+	passwords *api.PasswordUtil
+	hub       *Hub
+	r         *gin.Engine
+	// channelID is the channel the database starts with
+	channelID string
+}
+
+// newTestServer returns a test server limited by limits and locking logins
+// out by lockout, using the defaults for either if it is nil.
+func newTestServer(t *testing.T, limits *RateLimitConfig, lockout *LockoutConfig) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db, err := database.Open("")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	passwords, err := api.NewPasswordUtil(bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	channels, err := db.GetChannels(context.Background())
+	if err != nil || len(channels) == 0 {
+		t.Fatalf("GetChannels() got %v, %v, wanted a channel", channels, err)
+	}
+
+	s := &testServer{
+		db:        db,
+		jwt:       api.NewJWTUtil(&api.JWTConfig{Key: []byte("key"), Revocations: db}),
+		passwords: passwords,
+		r:         gin.New(),
+		channelID: channels[0].ID.String(),
+	}
+	limiters := NewRateLimiters(limits)
+	logins := NewLoginTracker(lockout)
+	s.hub = NewHub(db, s.jwt, limiters, nil)
+	NewAuthHandler(s.r, db, s.jwt, passwords, api.DefaultCredentialPolicy(), s.hub, limiters, logins)
+	NewMessageHandler(s.r, db, s.jwt, s.hub, limiters)
+	NewChannelHandler(s.r, db, s.jwt, s.hub)
+	NewConversationHandler(s.r, db, s.jwt, s.hub)
+	NewUserHandler(s.r, db, s.jwt, s.hub, logins)
+	NewAuditHandler(s.r, db, s.jwt)
+	NewAttachmentHandler(s.r, db, s.jwt, s.hub, limiters, blobs, nil)
+	return s
+}
+
+// addUser creates a user with the password "password" in the channel the
+// database starts with, and returns them along with a token for them.
+func (s *testServer) addUser(t *testing.T, username string, role structs.Role) (*structs.User, string) {
+	t.Helper()
+	ctx := context.Background()
+	hash, err := s.passwords.Hash("password")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	user := &structs.User{ID: uuid.New(), Username: username, Password: hash, Created: time.Now(), Role: role}
+	if _, err := s.db.CreateUser(ctx, user); err != nil {
+		t.Fatalf("CreateUser() got %v, wanted nil", err)
+	}
+	if err := s.db.AddChannelMember(ctx, s.channelID, user.ID.String()); err != nil {
+		t.Fatalf("AddChannelMember() got %v, wanted nil", err)
+	}
+	token, err := s.jwt.GenerateToken(ctx, user)
+	if err != nil {
+		t.Fatalf("GenerateToken() got %v, wanted nil", err)
+	}
+	return user, token
+}
+
+// do serves req and returns the response.
+func (s *testServer) do(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.r.ServeHTTP(w, req)
+	return w
+}
+
+// jsonRequest returns a request sending body as JSON, authorized by token.
+func jsonRequest(method, path, token string, body interface{}) *http.Request {
+	d, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(d))
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestNewHandler_TrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	passwords, err := api.NewPasswordUtil(bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		proxies []string
+		want    string
+	}{
+		{"no proxies", nil, "192.0.2.1"},
+		{"trusted proxy", []string{"192.0.2.0/24"}, "203.0.113.7"},
+		{"other proxy", []string{"198.51.100.1"}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		db, err := database.Open("")
+		if err != nil {
+			t.Fatalf("encountered error: %v", err)
+		}
+		jwtUtil := api.NewJWTUtil(&api.JWTConfig{Key: []byte("key")})
+		h, err := NewHandler(&Config{JwtUtil: jwtUtil, PasswordUtil: passwords, DB: db, TrustedProxies: tt.proxies})
+		if err != nil {
+			t.Fatalf("NewHandler() with %v got %v, wanted nil", tt.proxies, err)
+		}
+
+		// httptest requests come from 192.0.2.1
+		req := jsonRequest(http.MethodPost, "/api/auth/login", "", gin.H{"username": "jeff", "password": "wrong"})
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		h.e.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries, _ := db.GetAuditEntries(ctx, &database.AuditQuery{Limit: 1})
+		if len(entries) != 1 || entries[0].IP != tt.want {
+			t.Errorf("%v: audit entries got %+v, wanted one from %v", tt.name, entries, tt.want)
+		}
+	}
+
+	if _, err := NewHandler(&Config{TrustedProxies: []string{"not a proxy"}}); err == nil {
+		t.Errorf("NewHandler() with an invalid proxy got nil, wanted an error")
+	}
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LockoutConfig decides how long logins have to wait after failing. Failures
+// are counted both per username and per address, and anything left at zero
+// falls back to the default.
+type LockoutConfig struct {
+	// FreeAttempts is how many logins for a username can fail before the
+	// next has to wait
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past FreeAttempts, which
+	// doubles with every failure after it, up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Threshold is how many failures lock a username for LockoutDuration
+	Threshold int
+	// IPThreshold is how many failures lock an address. It is higher than
+	// Threshold, and addresses do not back off before it, since many users
+	// can share one.
+	IPThreshold int
+	// LockoutDuration is how long a lockout lasts. Failures are forgotten
+	// once this long passes without another.
+	LockoutDuration time.Duration
+}
+
+const (
+	DefaultFreeAttempts    = 3
+	DefaultBaseDelay       = time.Second
+	DefaultMaxDelay        = time.Minute
+	DefaultThreshold       = 10
+	DefaultIPThreshold     = 50
+	DefaultLockoutDuration = time.Minute * 15
+)
+
+// errLockedOut is what logins that have to wait are told. It is the same for
+// every username, whether it exists or not.
+const errLockedOut = "too many failed logins, try again later"
+
+type loginFailures struct {
+	count int
+	last  time.Time
+	// until is when the next login is allowed
+	until time.Time
+}
+
+// LoginTracker counts failed logins by username and by address, and works
+// out how long the next one has to wait. It is shared by the handlers that
+// log users in and unlock them.
+type LoginTracker struct {
+	conf LockoutConfig
+	now  func() time.Time
+
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	lastSweep time.Time
+}
+
+// NewLoginTracker returns a LoginTracker using conf, or the defaults if conf is
+// nil.
+func NewLoginTracker(conf *LockoutConfig) *LoginTracker {
+	t := &LoginTracker{now: time.Now, failures: map[string]*loginFailures{}}
+	if conf != nil {
+		t.conf = *conf
+	}
+	if t.conf.FreeAttempts <= 0 {
+		t.conf.FreeAttempts = DefaultFreeAttempts
+	}
+	if t.conf.BaseDelay <= 0 {
+		t.conf.BaseDelay = DefaultBaseDelay
+	}
+	if t.conf.MaxDelay <= 0 {
+		t.conf.MaxDelay = DefaultMaxDelay
+	}
+	if t.conf.Threshold <= 0 {
+		t.conf.Threshold = DefaultThreshold
+	}
+	if t.conf.IPThreshold <= 0 {
+		t.conf.IPThreshold = DefaultIPThreshold
+	}
+	if t.conf.LockoutDuration <= 0 {
+		t.conf.LockoutDuration = DefaultLockoutDuration
+	}
+	return t
+}
+
+func usernameKey(username string) string {
+	return "user:" + username
+}
+
+func addressKey(ip string) string {
+	return "ip:" + ip
+}
+
+// attempt reserves a login for username from ip. If it has to wait, the wait
+// is returned and nothing is counted. Otherwise it is counted as failed before
+// the password is checked, so that guesses made at the same time can not all
+// slip in before the first of them fails, and locked reports whether it locked
+// the username. succeed takes it back if the password was right.
+func (t *LoginTracker) attempt(username, ip string) (wait time.Duration, locked bool) {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range []string{usernameKey(username), addressKey(ip)} {
+		if f := t.current(key, now); f != nil && f.until.After(now) {
+			if d := f.until.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+
+	if now.Sub(t.lastSweep) >= time.Minute {
+		t.sweep(now)
+	}
+	locked = t.count(usernameKey(username), t.conf.Threshold, true, now)
+	t.count(addressKey(ip), t.conf.IPThreshold, false, now)
+	return 0, locked
+}
+
+// succeed forgets the failures of a username once someone logs in as it, and
+// takes back the attempt counted for the address. The other failures of the
+// address are kept, so that logging into one account does not make up for
+// guessing at others.
+func (t *LoginTracker) succeed(username, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, usernameKey(username))
+
+	key := addressKey(ip)
+	f, ok := t.failures[key]
+	if !ok {
+		return
+	}
+	f.count--
+	if f.count <= 0 {
+		delete(t.failures, key)
+	} else if f.count < t.conf.IPThreshold {
+		f.until = time.Time{}
+	}
+}
+
+// unlock forgets the failures of a username, lifting any lockout.
+func (t *LoginTracker) unlock(username string) {
+	t.mu.Lock()
+	delete(t.failures, usernameKey(username))
+	t.mu.Unlock()
+}
+
+// current returns the failures of key, unless they have been forgotten.
+func (t *LoginTracker) current(key string, now time.Time) *loginFailures {
+	f, ok := t.failures[key]
+	if !ok {
+		return nil
+	}
+	if now.Sub(f.last) >= t.conf.LockoutDuration && !f.until.After(now) {
+		delete(t.failures, key)
+		return nil
+	}
+	return f
+}
+
+// count adds a failure to key, and reports whether it reached threshold.
+// Below it, the next login has to wait only if backoff is set.
+func (t *LoginTracker) count(key string, threshold int, backoff bool, now time.Time) bool {
+	f := t.current(key, now)
+	if f == nil {
+		f = &loginFailures{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count >= threshold {
+		f.until = now.Add(t.conf.LockoutDuration)
+		return f.count == threshold
+	}
+	if over := f.count - t.conf.FreeAttempts; backoff && over > 0 {
+		delay := t.conf.MaxDelay
+		// shifting by too much overflows
+		if over <= 32 {
+			if d := t.conf.BaseDelay << (over - 1); d > 0 && d < delay {
+				delay = d
+			}
+		}
+		f.until = now.Add(delay)
+	}
+	return false
+}
+
+// sweep throws away the failures that have been forgotten.
+func (t *LoginTracker) sweep(now time.Time) {
+	for key := range t.failures {
+		t.current(key, now)
+	}
+	t.lastSweep = now
+}
+
+// lockedOut writes the response for a login that has to wait for d.
+func lockedOut(c *gin.Context, d time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, ErrorResponse{CodeError, errLockedOut})
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+func TestLoginTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewLoginTracker(&LockoutConfig{
+		FreeAttempts:    2,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second * 3,
+		Threshold:       6,
+		IPThreshold:     8,
+		LockoutDuration: time.Hour,
+	})
+	tracker.now = func() time.Time { return now }
+
+	// the waits before each guess, doubling past the free attempts
+	for i, want := range []time.Duration{0, 0, 0, time.Second, time.Second * 2, time.Second * 3} {
+		wait, locked := tracker.attempt("jeff", "a")
+		if wait != want {
+			t.Errorf("wait before guess %v got %v, wanted %v", i, wait, want)
+		}
+		if wait > 0 {
+			now = now.Add(wait)
+			wait, locked = tracker.attempt("jeff", "a")
+		}
+		if wait != 0 || locked != (i == 5) {
+			t.Errorf("guess %v got a wait of %v and locked %v, wanted it counted and locked only at the threshold", i, wait, locked)
+		}
+	}
+	if wait, _ := tracker.attempt("jeff", "b"); wait != time.Hour {
+		t.Errorf("wait when locked out got %v, wanted %v", wait, time.Hour)
+	}
+
+	// guesses made at once are each counted before any of them is checked
+	tracker.attempt("bob", "b")
+	tracker.attempt("bob", "b")
+	tracker.attempt("bob", "b")
+	if wait, _ := tracker.attempt("bob", "b"); wait != time.Second {
+		t.Errorf("wait after guesses at once got %v, wanted %v", wait, time.Second)
+	}
+
+	// a right guess forgets the username, and takes back its own attempt
+	tracker.attempt("carol", "c")
+	tracker.attempt("carol", "c")
+	tracker.succeed("carol", "c")
+	if f := tracker.failures[addressKey("c")]; f == nil || f.count != 1 {
+		t.Errorf("address failures after a right guess got %+v, wanted 1", f)
+	}
+	if f := tracker.failures[usernameKey("carol")]; f != nil {
+		t.Errorf("username failures after a right guess got %+v, wanted none", f)
+	}
+
+	// the address is locked out too once it fails for other usernames
+	tracker.attempt("alice", "a")
+	tracker.attempt("alice", "a")
+	if wait, _ := tracker.attempt("someone", "a"); wait != time.Hour {
+		t.Errorf("wait for a locked out address got %v, wanted %v", wait, time.Hour)
+	}
+
+	tracker.unlock("jeff")
+	if wait, _ := tracker.attempt("jeff", "d"); wait != 0 {
+		t.Errorf("wait after unlocking got %v, wanted 0", wait)
+	}
+
+	now = now.Add(time.Hour)
+	if wait, _ := tracker.attempt("someone", "a"); wait != 0 {
+		t.Errorf("wait after the lockout got %v, wanted 0", wait)
+	}
+	tracker.attempt("bob", "e")
+	tracker.attempt("bob", "e")
+	if wait, _ := tracker.attempt("bob", "e"); wait != 0 {
+		t.Errorf("wait after failures were forgotten got %v, wanted 0", wait)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, &RateLimitConfig{}, &LockoutConfig{FreeAttempts: 3, BaseDelay: time.Hour, Threshold: 3, IPThreshold: 100})
+	_, adminToken := s.addUser(t, "admin", structs.RoleAdmin)
+	member, memberToken := s.addUser(t, "member", structs.RoleMember)
+	login := func(username, password string) *httptest.ResponseRecorder {
+		return s.do(jsonRequest(http.MethodPost, "/api/auth/login", "", gin.H{"username": username, "password": password}))
+	}
+
+	// guesses sent at once get no more tries than ones sent one by one
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = login("member", "wrong").Code
+		}(i)
+	}
+	wg.Wait()
+	checked := 0
+	for _, code := range codes {
+		if code == http.StatusUnauthorized {
+			checked++
+		} else if code != http.StatusTooManyRequests {
+			t.Errorf("wrong guess for member got %v, wanted %v or %v", code, http.StatusUnauthorized, http.StatusTooManyRequests)
+		}
+	}
+	if checked != 3 {
+		t.Errorf("wrong guesses at once had %v checked, wanted 3", checked)
+	}
+	for i := 0; i < 3; i++ {
+		if w := login("nobody", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("wrong guess %v for nobody got %v, wanted %v", i, w.Code, http.StatusUnauthorized)
+		}
+	}
+	known, unknown := login("member", "password"), login("nobody", "password")
+	if known.Code != http.StatusTooManyRequests || known.Header().Get("Retry-After") == "" {
+		t.Errorf("locked out login got %v with Retry-After %q, wanted %v with one", known.Code, known.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Errorf("locked out logins got %v %v and %v %v, wanted them the same for known and unknown usernames",
+			known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+	if w := login("admin", "password"); w.Code != http.StatusOK {
+		t.Errorf("login for another username got %v, wanted %v", w.Code, http.StatusOK)
+	}
+
+	unlock := "/api/users/" + member.ID.String() + "/lockout"
+	if w := s.do(jsonRequest(http.MethodDelete, unlock, memberToken, nil)); w.Code != http.StatusForbidden {
+		t.Errorf("member unlocking got %v, wanted %v", w.Code, http.StatusForbidden)
+	}
+	if w := s.do(jsonRequest(http.MethodDelete, unlock, adminToken, nil)); w.Code != http.StatusNoContent {
+		t.Errorf("admin unlocking got %v: %v, wanted %v", w.Code, w.Body, http.StatusNoContent)
+	}
+	if w := login("member", "password"); w.Code != http.StatusOK {
+		t.Errorf("login after unlocking got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+	}
+
+	// only the guesses that were checked are audited
+	entries, _ := s.db.GetAuditEntries(ctx, &database.AuditQuery{Action: structs.AuditLoginFailed, Limit: 100})
+	if len(entries) != 6 {
+		t.Errorf("failed login audit entries got %v, wanted 6", len(entries))
+	}
+	locked := 0
+	for _, e := range entries {
+		if e.Details["locked"] == "true" {
+			locked++
+		}
+	}
+	if locked != 2 {
+		t.Errorf("audit entries for failures that locked a username got %v, wanted 2", locked)
+	}
+
+	entries, _ = s.db.GetAuditEntries(ctx, &database.AuditQuery{Action: structs.AuditUnlock, Limit: 10})
+	if len(entries) != 1 || entries[0].TargetID != member.ID.String() {
+		t.Errorf("unlock audit entries got %v, wanted one for member", entries)
+	}
+}
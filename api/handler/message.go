@@ -1,7 +1,11 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -9,7 +13,9 @@ import (
 	"github.com/google/uuid"
 	api "github.com/intrntsrfr/vue-ws-test"
 	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/search"
 	"github.com/intrntsrfr/vue-ws-test/structs"
+	"github.com/intrntsrfr/vue-ws-test/util"
 )
 
 type MessageHandler struct {
@@ -19,71 +25,546 @@ type MessageHandler struct {
 	ws  *Hub
 }
 
-func NewMessageHandler(r *gin.Engine, db database.DB, jwtService api.JWTService, hub *Hub) {
+func NewMessageHandler(r *gin.Engine, db database.DB, jwtService api.JWTService, hub *Hub, limiters *RateLimiters) {
 	h := &MessageHandler{r, db, jwtService, hub}
+	limit := RateLimit(limiters)
 
 	g := h.r.Group("/api/messages")
-	g.POST("/", h.jwt.IsAuthorized(), h.postMessage())
-	g.GET("/", h.getMessages())
+	g.POST("/", h.jwt.IsAuthorized(), limit, RequireUnsanctioned(h.db), h.postMessage())
+	g.GET("/", h.jwt.IsAuthorized(), limit, h.getMessages())
+	g.GET("/search", h.jwt.IsAuthorized(), limit, h.searchMessages())
+	g.PATCH("/:id", h.jwt.IsAuthorized(), limit, RequireUnsanctioned(h.db), h.patchMessage())
+	g.DELETE("/:id", h.jwt.IsAuthorized(), limit, RequireUnsanctioned(h.db), h.deleteMessage())
 
-	g.POST("/:id/reactions", h.jwt.IsAuthorized(), h.postReaction())
-	g.DELETE("/:id/reactions", h.jwt.IsAuthorized(), h.deleteReaction())
+	g.POST("/:id/ack", h.jwt.IsAuthorized(), limit, h.ackMessage())
+
+	g.POST("/:id/reactions", h.jwt.IsAuthorized(), limit, RequireUnsanctioned(h.db), h.postReaction())
+	g.DELETE("/:id/reactions", h.jwt.IsAuthorized(), limit, RequireUnsanctioned(h.db), h.deleteReaction())
 }
 
 func (h *MessageHandler) postMessage() gin.HandlerFunc {
 	type PostMessageBody struct {
-		Content string `json:"content"`
+		ChannelID uuid.UUID `json:"channel_id"`
+		Content   string    `json:"content"`
+		// AttachmentIDs are attachments uploaded to the channel beforehand
+		AttachmentIDs []uuid.UUID `json:"attachment_ids"`
 	}
 
 	return func(c *gin.Context) {
 		var postMessageBody PostMessageBody
-		if err := c.BindJSON(&postMessageBody); err != nil || strings.TrimSpace(postMessageBody.Content) == "" {
+		err := c.BindJSON(&postMessageBody)
+		if err != nil || (strings.TrimSpace(postMessageBody.Content) == "" && len(postMessageBody.AttachmentIDs) == 0) {
 			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
 			return
 		}
+		if len(postMessageBody.AttachmentIDs) > maxAttachments {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, fmt.Sprintf("at most %d attachments are allowed", maxAttachments)})
+			return
+		}
 
-		claims, ok := c.MustGet("claims").(*api.UserClaims)
+		user, ok := currentUser(c, h.db)
 		if !ok {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{CodeError, "internal server error"})
 			return
 		}
-
-		user := h.db.FindUserByID(claims.Subject)
-		if user == nil {
-			c.JSON(http.StatusUnauthorized, ErrorResponse{CodeError, "user does not exist"})
+		channel, ok := memberChannel(c, h.db, postMessageBody.ChannelID.String(), user)
+		if !ok || !hasPermission(c, channel.PermissionsFor(user.Role), structs.PermSendMessages) {
+			return
+		}
+		attachments, ok := h.uploadedAttachments(c, postMessageBody.AttachmentIDs, channel, user)
+		if !ok {
 			return
 		}
-		userCopy := *user
-		userCopy.Password = ""
-		msg, _ := h.db.CreateMessage(&structs.Message{
-			ID:        uuid.New(),
-			Author:    &userCopy,
-			Content:   strings.TrimSpace(postMessageBody.Content),
-			Timestamp: time.Now(),
-			Reactions: []*structs.Reaction{},
+		msg, err := h.db.CreateMessage(c.Request.Context(), &structs.Message{
+			ID:          uuid.New(),
+			ChannelID:   channel.ID,
+			Author:      user,
+			Content:     strings.TrimSpace(postMessageBody.Content),
+			Timestamp:   time.Now(),
+			Reactions:   []*structs.Reaction{},
+			Attachments: attachments,
 		})
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
 
+		msg = h.ws.signMessage(msg)
 		c.JSON(http.StatusOK, msg)
 		//h.ws.userMessage(msg)
 		_ = h.ws.dispatchEvent(ActionUserMessage, nil, msg)
 	}
 }
 
+// uploadedAttachments looks up the attachments a user uploaded to a channel
+// to send with a message. If any of them can not be found, an error response
+// is written and ok is false.
+func (h *MessageHandler) uploadedAttachments(c *gin.Context, ids []uuid.UUID, channel *structs.Channel, user *structs.User) (attachments []*structs.Attachment, ok bool) {
+	seen := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		attachment, err := h.db.FindAttachmentByID(c.Request.Context(), id.String())
+		if err == nil && (attachment.ChannelID != channel.ID || attachment.UploaderID != user.ID) {
+			err = database.ErrAttachmentNotFound
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "unknown attachment " + id.String()})
+			return nil, false
+		} else if err != nil {
+			databaseError(c, err)
+			return nil, false
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, true
+}
+
+// patchMessage edits the content of a message. What it said before is kept
+// in its history.
+func (h *MessageHandler) patchMessage() gin.HandlerFunc {
+	type PatchMessageBody struct {
+		Content string `json:"content"`
+	}
+
+	return func(c *gin.Context) {
+		var patchMessageBody PatchMessageBody
+		if err := c.BindJSON(&patchMessageBody); err != nil || strings.TrimSpace(patchMessageBody.Content) == "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		msg, ok := h.memberMessage(c, user)
+		if !ok {
+			return
+		}
+		if !canModifyMessage(user, msg) {
+			c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "only the author can do this"})
+			return
+		}
+
+		content := strings.TrimSpace(patchMessageBody.Content)
+		if content == msg.Content {
+			c.JSON(http.StatusOK, h.ws.signMessage(msg))
+			return
+		}
+
+		revisionTime := msg.Timestamp
+		if msg.EditedTimestamp != nil {
+			revisionTime = *msg.EditedTimestamp
+		}
+		now := time.Now()
+		msgCopy := *msg
+		msgCopy.Content = content
+		msgCopy.EditedTimestamp = &now
+		msgCopy.History = append(append([]*structs.MessageRevision{}, msg.History...), &structs.MessageRevision{
+			Content:   msg.Content,
+			Timestamp: revisionTime,
+		})
+
+		updated, err := h.db.UpdateMessage(c.Request.Context(), &msgCopy)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		updated = h.ws.signMessage(updated)
+		c.JSON(http.StatusOK, updated)
+		_ = h.ws.dispatchEvent(ActionMessageUpdate, nil, updated)
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditMessageEdit,
+			TargetType: structs.AuditTargetMessage,
+			TargetID:   msg.ID.String(),
+			Details:    map[string]string{"channel_id": msg.ChannelID.String()},
+		})
+	}
+}
+
+func (h *MessageHandler) deleteMessage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		msg, ok := h.memberMessage(c, user)
+		if !ok {
+			return
+		}
+		perms, ok := channelPermissions(c, h.db, msg.ChannelID.String(), user)
+		if !ok {
+			return
+		}
+		if !canModifyMessage(user, msg) && !hasPermission(c, perms, structs.PermManageMessages) {
+			return
+		}
+
+		if err := h.db.DeleteMessage(c.Request.Context(), msg.ID.String()); err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+		_ = h.ws.dispatchEvent(ActionMessageDelete, nil, &structs.MessageDelete{ChannelID: msg.ChannelID, MessageID: msg.ID})
+
+		details := map[string]string{"channel_id": msg.ChannelID.String()}
+		if msg.Author != nil {
+			details["author_id"] = msg.Author.ID.String()
+		}
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditMessageDelete,
+			TargetType: structs.AuditTargetMessage,
+			TargetID:   msg.ID.String(),
+			Details:    details,
+		})
+	}
+}
+
+// ackMessage marks a message and everything sent before it in its channel as
+// read by the user. Read states only move forward, so acknowledging an older
+// message does nothing.
+func (h *MessageHandler) ackMessage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		msg, ok := h.memberMessage(c, user)
+		if !ok {
+			return
+		}
+
+		state := &structs.ReadState{
+			UserID:    user.ID,
+			ChannelID: msg.ChannelID,
+			MessageID: msg.ID,
+			Timestamp: msg.Timestamp,
+		}
+		// acking a message older than the one already read changes nothing
+		advanced, err := h.db.SetReadState(c.Request.Context(), state)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+		if advanced {
+			_ = h.ws.dispatchEvent(ActionReadStateUpdate, nil, state)
+		}
+	}
+}
+
+// canModifyMessage reports whether the user wrote a message, which it takes to
+// edit it. Messages can also be deleted by those allowed to manage messages.
+func canModifyMessage(user *structs.User, msg *structs.Message) bool {
+	return msg.Author != nil && msg.Author.ID == user.ID
+}
+
+const (
+	defaultMessageLimit = 50
+	maxMessageLimit     = 100
+)
+
+var (
+	errCursorNotFound = errors.New("cursor message not found")
+	errInvalidCursor  = errors.New("invalid cursor")
+)
+
+// getMessages returns a page of messages in the channel given by channel_id,
+// oldest first. At most one of the before, after and around cursors may be
+// given, each being either a message ID, an RFC 3339 timestamp or a unix
+// timestamp in milliseconds. Without a cursor, the most recent messages are
+// returned.
 func (h *MessageHandler) getMessages() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		//msgs := h.Messages[len(h.Messages)-util.Min(len(h.Messages), 50):]
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		channel, ok := memberChannel(c, h.db, c.Query("channel_id"), user)
+		if !ok {
+			return
+		}
+		channelID := channel.ID.String()
+
+		limit := defaultMessageLimit
+		if l := c.Query("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "limit must be a positive number"})
+				return
+			}
+			limit = util.Min(n, maxMessageLimit)
+		}
+
+		var cursors []string
+		for _, key := range []string{"before", "after", "around"} {
+			if c.Query(key) != "" {
+				cursors = append(cursors, key)
+			}
+		}
+		if len(cursors) > 1 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "only one of before, after and around can be used"})
+			return
+		}
+		ctx := c.Request.Context()
+		if len(cursors) == 0 {
+			msgs, err := h.db.GetRecentMessages(ctx, channelID, limit)
+			if err != nil {
+				databaseError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, h.ws.signMessages(msgs))
+			return
+		}
+
+		cursor, err := h.parseCursor(ctx, channelID, c.Query(cursors[0]))
+		if errors.Is(err, errCursorNotFound) {
+			c.JSON(http.StatusNotFound, ErrorResponse{CodeError, "message not found"})
+			return
+		} else if errors.Is(err, errInvalidCursor) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "invalid cursor"})
+			return
+		} else if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		var msgs []*structs.Message
+		switch cursors[0] {
+		case "before":
+			msgs, err = h.db.GetMessagesBefore(ctx, channelID, cursor, limit)
+		case "after":
+			msgs, err = h.db.GetMessagesAfter(ctx, channelID, cursor, limit)
+		case "around":
+			msgs, err = h.db.GetMessagesAround(ctx, channelID, cursor, limit)
+		}
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, h.ws.signMessages(msgs))
+	}
+}
+
+// parseCursor turns a message ID or timestamp into a place in the history of
+// a channel. Message IDs have to belong to the given channel.
+func (h *MessageHandler) parseCursor(ctx context.Context, channelID, cursor string) (database.MessageCursor, error) {
+	if id, err := uuid.Parse(cursor); err == nil {
+		msg, err := h.db.FindMessageByID(ctx, id.String())
+		if errors.Is(err, database.ErrNotFound) || (err == nil && msg.ChannelID.String() != channelID) {
+			return database.MessageCursor{}, errCursorNotFound
+		} else if err != nil {
+			return database.MessageCursor{}, err
+		}
+		return database.MessageCursor{Timestamp: msg.Timestamp, ID: msg.ID.String()}, nil
+	}
+	t, ok := parseTimestamp(cursor)
+	if !ok {
+		return database.MessageCursor{}, errInvalidCursor
+	}
+	return database.MessageCursor{Timestamp: t}, nil
+}
+
+// parseTimestamp parses an RFC 3339 timestamp or a unix timestamp in
+// milliseconds.
+func parseTimestamp(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+const defaultSearchLimit = 25
+
+// searchMessages returns a page of the messages containing every term in q,
+// newest first, with a snippet of each. Only channels the user is a member of
+// are searched, which can be narrowed down to one with channel_id. Results
+// can also be filtered by author_id, and by when they were sent with after
+// and before, which take the same timestamps as the message cursors.
+func (h *MessageHandler) searchMessages() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		terms := strings.Fields(c.Query("q"))
+		if len(terms) == 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "q is required"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		query := &search.Query{Terms: terms, Limit: defaultSearchLimit}
+		if l := c.Query("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "limit must be a positive number"})
+				return
+			}
+			query.Limit = util.Min(n, maxMessageLimit)
+		}
+		if o := c.Query("offset"); o != "" {
+			n, err := strconv.Atoi(o)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "offset must not be negative"})
+				return
+			}
+			query.Offset = n
+		}
+		if a := c.Query("author_id"); a != "" {
+			id, err := uuid.Parse(a)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "invalid author_id"})
+				return
+			}
+			query.AuthorID = id.String()
+		}
+		for _, bound := range []struct {
+			key string
+			t   *time.Time
+		}{{"after", &query.After}, {"before", &query.Before}} {
+			if v := c.Query(bound.key); v != "" {
+				if *bound.t, ok = parseTimestamp(v); !ok {
+					c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "invalid " + bound.key})
+					return
+				}
+			}
+		}
+
+		if id := c.Query("channel_id"); id != "" {
+			channel, ok := memberChannel(c, h.db, id, user)
+			if !ok {
+				return
+			}
+			query.ChannelIDs = []string{channel.ID.String()}
+		} else {
+			channels, err := h.db.GetUserChannels(c.Request.Context(), user.ID.String())
+			if err != nil {
+				databaseError(c, err)
+				return
+			}
+			for _, channel := range channels {
+				query.ChannelIDs = append(query.ChannelIDs, channel.ID.String())
+			}
+		}
 
+		msgs, total, err := h.db.SearchMessages(c.Request.Context(), query)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		res := &structs.SearchResults{Total: total, Hits: make([]*structs.SearchHit, 0, len(msgs))}
+		for _, msg := range msgs {
+			res.Hits = append(res.Hits, &structs.SearchHit{Message: h.ws.signMessage(msg), Snippet: search.Snippet(msg.Content, terms)})
+		}
+		c.JSON(http.StatusOK, res)
 	}
 }
 
+type ReactionBody struct {
+	Emoji string `json:"emoji"`
+}
+
 func (h *MessageHandler) postReaction() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		var reactionBody ReactionBody
+		if err := c.BindJSON(&reactionBody); err != nil || !util.IsEmoji(reactionBody.Emoji) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
 
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+
+		msg, ok := h.memberMessage(c, user)
+		if !ok {
+			return
+		}
+		perms, ok := channelPermissions(c, h.db, msg.ChannelID.String(), user)
+		if !ok || !hasPermission(c, perms, structs.PermAddReactions) {
+			return
+		}
+
+		added, err := h.db.CreateReaction(c.Request.Context(), msg.ID.String(), user, reactionBody.Emoji)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+		if added {
+			_ = h.ws.dispatchEvent(ActionReactionAdd, nil, &structs.ReactionAdd{
+				ChannelID: msg.ChannelID,
+				MessageID: msg.ID,
+				Emoji:     reactionBody.Emoji,
+				User:      user,
+			})
+		}
 	}
 }
 
 func (h *MessageHandler) deleteReaction() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		var reactionBody ReactionBody
+		if err := c.BindJSON(&reactionBody); err != nil || !util.IsEmoji(reactionBody.Emoji) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+
+		msg, ok := h.memberMessage(c, user)
+		if !ok {
+			return
+		}
+
+		removed, err := h.db.DeleteReaction(c.Request.Context(), msg.ID.String(), user, reactionBody.Emoji)
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
 
+		c.Status(http.StatusNoContent)
+		if removed {
+			_ = h.ws.dispatchEvent(ActionReactionRemove, nil, &structs.ReactionRemove{
+				ChannelID: msg.ChannelID,
+				MessageID: msg.ID,
+				Emoji:     reactionBody.Emoji,
+				User:      user,
+			})
+		}
+	}
+}
+
+// memberMessage returns the message given by the id parameter, as long as the
+// user is a member of the channel it was sent in. If not, an error response
+// is written and ok is false.
+func (h *MessageHandler) memberMessage(c *gin.Context, user *structs.User) (msg *structs.Message, ok bool) {
+	ctx := c.Request.Context()
+	msg, err := h.db.FindMessageByID(ctx, c.Param("id"))
+	isMember := false
+	if err == nil {
+		isMember, err = h.db.IsChannelMember(ctx, msg.ChannelID.String(), user.ID.String())
+	}
+	if errors.Is(err, database.ErrNotFound) || (err == nil && !isMember) {
+		c.JSON(http.StatusNotFound, ErrorResponse{CodeError, "message not found"})
+		return nil, false
+	} else if err != nil {
+		databaseError(c, err)
+		return nil, false
 	}
+	return msg, true
 }
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// maxSanctionReasonLength is how long the reason for a sanction can be
+const maxSanctionReasonLength = 512
+
+// sanctionAudits are the actions recorded in the audit log when a sanction of
+// each type is put on or lifted.
+var sanctionAudits = map[structs.SanctionType]struct{ put, delete structs.AuditAction }{
+	structs.SanctionBan:  {structs.AuditBan, structs.AuditUnban},
+	structs.SanctionMute: {structs.AuditMute, structs.AuditUnmute},
+}
+
+// activeSanction returns the sanction of a type on a user, or nil if there is
+// none or it has expired.
+func activeSanction(ctx context.Context, db database.DB, userID string, sanctionType structs.SanctionType) (*structs.Sanction, error) {
+	sanction, err := db.FindSanction(ctx, userID, sanctionType)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !sanction.Active(time.Now()) {
+		return nil, nil
+	}
+	return sanction, nil
+}
+
+// sanctioned reports whether there is a sanction of a type on the user. If
+// there is, or it can not be worked out, an error response is written saying
+// why.
+func sanctioned(c *gin.Context, db database.DB, user *structs.User, sanctionType structs.SanctionType) bool {
+	sanction, err := activeSanction(c.Request.Context(), db, user.ID.String(), sanctionType)
+	if err != nil {
+		databaseError(c, err)
+		return true
+	}
+	if sanction == nil {
+		return false
+	}
+
+	msg := "you are banned"
+	if sanctionType == structs.SanctionMute {
+		msg = "you are muted"
+	}
+	if sanction.Expires != nil {
+		msg += " until " + sanction.Expires.UTC().Format(time.RFC3339)
+	}
+	if sanction.Reason != "" {
+		msg += ": " + sanction.Reason
+	}
+	c.JSON(http.StatusForbidden, ErrorResponse{CodeError, msg})
+	return true
+}
+
+// RequireUnsanctioned only lets a request through if its user is neither
+// banned nor muted. It goes on every route that writes something on behalf of
+// the user, and has to come after IsAuthorized. The user is kept in the
+// context, so that currentUser does not look them up again.
+func RequireUnsanctioned(db database.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, db)
+		if !ok || sanctioned(c, db, user, structs.SanctionBan) || sanctioned(c, db, user, structs.SanctionMute) {
+			c.Abort()
+			return
+		}
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// moderatedUser returns the user given by the id parameter, as long as the
+// user ranks above them. If not, an error response is written and ok is
+// false.
+func (h *UserHandler) moderatedUser(c *gin.Context, user *structs.User) (target *structs.User, ok bool) {
+	target, err := h.db.FindUserByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		databaseError(c, err)
+		return nil, false
+	}
+	if !user.CanManage(target) {
+		c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "can only moderate users below your own role"})
+		return nil, false
+	}
+	return target, true
+}
+
+// kick disconnects every client of a user, who is free to connect again.
+func (h *UserHandler) kick() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		target, ok := h.moderatedUser(c, user)
+		if !ok {
+			return
+		}
+
+		h.ws.disconnectUser(target.ID.String(), Kicked)
+		c.Status(http.StatusNoContent)
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditKick,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   target.ID.String(),
+		})
+	}
+}
+
+// putSanction bans or mutes a user for duration seconds. Bans without a
+// duration last until they are lifted, while mutes always need one. Banned
+// users are disconnected right away, and their tokens stop working.
+func (h *UserHandler) putSanction(sanctionType structs.SanctionType) gin.HandlerFunc {
+	type PutSanctionBody struct {
+		Reason   string `json:"reason"`
+		Duration int64  `json:"duration"`
+	}
+
+	return func(c *gin.Context) {
+		var putSanctionBody PutSanctionBody
+		if err := c.BindJSON(&putSanctionBody); err != nil || putSanctionBody.Duration < 0 ||
+			len(putSanctionBody.Reason) > maxSanctionReasonLength {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+		if sanctionType == structs.SanctionMute && putSanctionBody.Duration == 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "duration is required"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		target, ok := h.moderatedUser(c, user)
+		if !ok {
+			return
+		}
+
+		sanction := &structs.Sanction{
+			UserID:      target.ID,
+			Type:        sanctionType,
+			ModeratorID: user.ID,
+			Reason:      putSanctionBody.Reason,
+			Created:     time.Now(),
+		}
+		if putSanctionBody.Duration > 0 {
+			expires := sanction.Created.Add(time.Duration(putSanctionBody.Duration) * time.Second)
+			sanction.Expires = &expires
+		}
+		if err := h.db.SetSanction(c.Request.Context(), sanction); err != nil {
+			databaseError(c, err)
+			return
+		}
+		// banned users are logged out of everywhere, and can not log in again
+		if sanctionType == structs.SanctionBan {
+			if err := h.db.DeleteUserRefreshTokens(c.Request.Context(), target.ID.String()); err != nil {
+				databaseError(c, err)
+				return
+			}
+			if err := h.jwt.RevokeUserTokens(c.Request.Context(), target.ID.String()); err != nil {
+				databaseError(c, err)
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, sanction)
+		if sanctionType == structs.SanctionBan {
+			h.ws.disconnectUser(target.ID.String(), Banned)
+		}
+
+		details := map[string]string{}
+		if sanction.Reason != "" {
+			details["reason"] = sanction.Reason
+		}
+		if sanction.Expires != nil {
+			details["expires"] = sanction.Expires.UTC().Format(time.RFC3339)
+		}
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     sanctionAudits[sanctionType].put,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   target.ID.String(),
+			Details:    details,
+		})
+	}
+}
+
+// deleteSanction lifts the ban or mute on a user.
+func (h *UserHandler) deleteSanction(sanctionType structs.SanctionType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		target, ok := h.moderatedUser(c, user)
+		if !ok {
+			return
+		}
+
+		if err := h.db.DeleteSanction(c.Request.Context(), target.ID.String(), sanctionType); err != nil {
+			databaseError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     sanctionAudits[sanctionType].delete,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   target.ID.String(),
+		})
+	}
+}
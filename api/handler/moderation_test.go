@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+func TestModeration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil, nil)
+	users := map[structs.Role]*structs.User{}
+	tokens := map[structs.Role]string{}
+	for _, role := range []structs.Role{structs.RoleAdmin, structs.RoleModerator, structs.RoleMember} {
+		users[role], tokens[role] = s.addUser(t, string(role), role)
+	}
+	member := "/api/users/" + users[structs.RoleMember].ID.String()
+	post := gin.H{"channel_id": s.channelID, "content": "hello"}
+	own, _ := s.db.CreateMessage(ctx, &structs.Message{ID: uuid.New(), ChannelID: uuid.MustParse(s.channelID), Author: users[structs.RoleMember], Content: "hi", Timestamp: time.Now()})
+	edit := "/api/messages/" + own.ID.String()
+	react := edit + "/reactions"
+	dm := gin.H{"user_ids": []uuid.UUID{users[structs.RoleModerator].ID}}
+	owned, _ := s.db.CreateChannel(ctx, &structs.Channel{ID: uuid.New(), Type: structs.ChannelTypeText, Name: "owned", OwnerID: users[structs.RoleMember].ID, Created: time.Now()})
+	ownedPath := "/api/channels/" + owned.ID.String()
+	leave := "/api/channels/" + s.channelID + "/members"
+	emoji := gin.H{"emoji": "👍"}
+	login := gin.H{"username": "member", "password": "password"}
+
+	tests := []struct {
+		name   string
+		as     structs.Role
+		method string
+		path   string
+		body   interface{}
+		want   int
+	}{
+		{"member can not mute", structs.RoleMember, http.MethodPut, "/api/users/" + users[structs.RoleModerator].ID.String() + "/mute", gin.H{"duration": 60}, http.StatusForbidden},
+		{"moderator can not ban admins", structs.RoleModerator, http.MethodPut, "/api/users/" + users[structs.RoleAdmin].ID.String() + "/ban", gin.H{}, http.StatusForbidden},
+		{"mute needs a duration", structs.RoleModerator, http.MethodPut, member + "/mute", gin.H{}, http.StatusBadRequest},
+		{"moderator can mute members", structs.RoleModerator, http.MethodPut, member + "/mute", gin.H{"duration": 60, "reason": "spam"}, http.StatusOK},
+		{"muted member can not post", structs.RoleMember, http.MethodPost, "/api/messages/", post, http.StatusForbidden},
+		{"muted member can not edit", structs.RoleMember, http.MethodPatch, edit, gin.H{"content": "edited"}, http.StatusForbidden},
+		{"muted member can not react", structs.RoleMember, http.MethodPost, react, gin.H{"emoji": "👍"}, http.StatusForbidden},
+		{"muted member can not open conversations", structs.RoleMember, http.MethodPost, "/api/conversations/", dm, http.StatusForbidden},
+		{"muted member can not delete messages", structs.RoleMember, http.MethodDelete, edit, nil, http.StatusForbidden},
+		{"muted member can not remove reactions", structs.RoleMember, http.MethodDelete, react, emoji, http.StatusForbidden},
+		{"muted member can not delete channels", structs.RoleMember, http.MethodDelete, ownedPath, nil, http.StatusForbidden},
+		{"muted member can not leave channels", structs.RoleMember, http.MethodDelete, leave, nil, http.StatusForbidden},
+		{"moderator can unmute", structs.RoleModerator, http.MethodDelete, member + "/mute", nil, http.StatusNoContent},
+		{"unmuted member can post", structs.RoleMember, http.MethodPost, "/api/messages/", post, http.StatusOK},
+		{"moderator can kick members", structs.RoleModerator, http.MethodPost, member + "/kick", nil, http.StatusNoContent},
+		{"kicked member can log in", structs.RoleMember, http.MethodPost, "/api/auth/login", login, http.StatusOK},
+		{"admin can ban members", structs.RoleAdmin, http.MethodPut, member + "/ban", gin.H{"reason": "abuse"}, http.StatusOK},
+		{"banned member can not log in", structs.RoleMember, http.MethodPost, "/api/auth/login", login, http.StatusForbidden},
+		{"banned member's token is revoked", structs.RoleMember, http.MethodGet, "/api/messages/?channel_id=" + s.channelID, nil, http.StatusUnauthorized},
+		{"banned member can not post", structs.RoleMember, http.MethodPost, "/api/messages/", post, http.StatusUnauthorized},
+		{"banned member can not edit", structs.RoleMember, http.MethodPatch, edit, gin.H{"content": "edited"}, http.StatusUnauthorized},
+		{"banned member can not react", structs.RoleMember, http.MethodPost, react, gin.H{"emoji": "👍"}, http.StatusUnauthorized},
+		{"admin can unban", structs.RoleAdmin, http.MethodDelete, member + "/ban", nil, http.StatusNoContent},
+		{"unbanning twice", structs.RoleAdmin, http.MethodDelete, member + "/ban", nil, http.StatusNotFound},
+		{"unbanned member can log in", structs.RoleMember, http.MethodPost, "/api/auth/login", login, http.StatusOK},
+		{"unbanned member can edit", structs.RoleMember, http.MethodPatch, edit, gin.H{"content": "edited"}, http.StatusOK},
+		{"unbanned member can react", structs.RoleMember, http.MethodPost, react, gin.H{"emoji": "👍"}, http.StatusNoContent},
+		{"unbanned member can open conversations", structs.RoleMember, http.MethodPost, "/api/conversations/", dm, http.StatusOK},
+		{"unbanned member can remove reactions", structs.RoleMember, http.MethodDelete, react, emoji, http.StatusNoContent},
+		{"unbanned member can delete messages", structs.RoleMember, http.MethodDelete, edit, nil, http.StatusNoContent},
+		{"unbanned member can delete channels", structs.RoleMember, http.MethodDelete, ownedPath, nil, http.StatusNoContent},
+		{"unbanned member can leave channels", structs.RoleMember, http.MethodDelete, leave, nil, http.StatusNoContent},
+	}
+	memberClient := identifiedClient(s.hub, users[structs.RoleMember], s.channelID)
+	moderatorClient := identifiedClient(s.hub, users[structs.RoleModerator], s.channelID)
+	var refreshTokens []string
+	for _, tt := range tests {
+		w := s.do(jsonRequest(tt.method, tt.path, tokens[tt.as], tt.body))
+		if w.Code != tt.want {
+			t.Errorf("%v: got %v: %v, wanted %v", tt.name, w.Code, w.Body, tt.want)
+		}
+		// the member goes on with the tokens they last logged in with
+		if tt.path == "/api/auth/login" && w.Code == http.StatusOK {
+			var issued struct {
+				Token        string `json:"token"`
+				RefreshToken string `json:"refresh_token"`
+			}
+			_ = json.Unmarshal(w.Body.Bytes(), &issued)
+			tokens[structs.RoleMember] = issued.Token
+			refreshTokens = append(refreshTokens, issued.RefreshToken)
+		}
+	}
+	if len(refreshTokens) != 2 {
+		t.Fatalf("member logged in %v times, wanted 2", len(refreshTokens))
+	}
+	if _, err := s.db.FindRefreshToken(ctx, api.HashRefreshToken(refreshTokens[0])); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("FindRefreshToken() from before the ban got %v, wanted %v", err, database.ErrNotFound)
+	}
+	if _, err := s.db.FindRefreshToken(ctx, api.HashRefreshToken(refreshTokens[1])); err != nil {
+		t.Errorf("FindRefreshToken() from after the ban got %v, wanted nil", err)
+	}
+
+	if got := memberClient.closedWith(); got == nil || got.Code != Kicked {
+		t.Errorf("member client closed with %v, wanted %v", got, Kicked)
+	}
+	if got := moderatorClient.closedWith(); got != nil {
+		t.Errorf("moderator client closed with %v, wanted it left alone", got)
+	}
+
+	// muted admins can not change overrides to give themselves permissions back
+	override := "/api/channels/" + s.channelID + "/overrides/member"
+	deny := gin.H{"deny": structs.PermSendMessages}
+	later := time.Now().Add(time.Hour)
+	_ = s.db.SetSanction(ctx, &structs.Sanction{UserID: users[structs.RoleAdmin].ID, Type: structs.SanctionMute, Created: time.Now(), Expires: &later})
+	if w := s.do(jsonRequest(http.MethodPut, override, tokens[structs.RoleAdmin], deny)); w.Code != http.StatusForbidden {
+		t.Errorf("muted admin setting an override got %v: %v, wanted %v", w.Code, w.Body, http.StatusForbidden)
+	}
+	if w := s.do(jsonRequest(http.MethodDelete, override, tokens[structs.RoleAdmin], nil)); w.Code != http.StatusForbidden {
+		t.Errorf("muted admin removing an override got %v: %v, wanted %v", w.Code, w.Body, http.StatusForbidden)
+	}
+	expired := time.Now().Add(-time.Minute)
+	_ = s.db.SetSanction(ctx, &structs.Sanction{UserID: users[structs.RoleAdmin].ID, Type: structs.SanctionMute, Created: time.Now(), Expires: &expired})
+	if w := s.do(jsonRequest(http.MethodPut, override, tokens[structs.RoleAdmin], deny)); w.Code != http.StatusOK {
+		t.Errorf("admin setting an override after the mute got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+	}
+	if w := s.do(jsonRequest(http.MethodDelete, override, tokens[structs.RoleAdmin], nil)); w.Code != http.StatusOK {
+		t.Errorf("admin removing an override after the mute got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+	}
+
+	_ = s.db.SetSanction(ctx, &structs.Sanction{UserID: users[structs.RoleMember].ID, Type: structs.SanctionBan, Created: time.Now(), Expires: &expired})
+	if w := s.do(jsonRequest(http.MethodPost, "/api/auth/login", "", login)); w.Code != http.StatusOK {
+		t.Errorf("logging in after a ban expired got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+	}
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// RequirePermission only lets a request through if the role of its user has
+// perm outside of any channel. It has to come after IsAuthorized. The user is
+// kept in the context, so that currentUser does not look them up again.
+func RequirePermission(db database.DB, perm structs.Permissions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, db)
+		if !ok {
+			c.Abort()
+			return
+		}
+		if !user.Role.Permissions().Has(perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{CodeError, "missing permissions"})
+			return
+		}
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// hasPermission reports whether perms includes want. If not, an error
+// response is written.
+func hasPermission(c *gin.Context, perms, want structs.Permissions) bool {
+	if !perms.Has(want) {
+		c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "missing permissions"})
+		return false
+	}
+	return true
+}
+
+// channelPermissions returns what the user is allowed to do in the channel
+// with the given ID. If it can not be found, an error response is written and
+// ok is false.
+func channelPermissions(c *gin.Context, db database.DB, channelID string, user *structs.User) (perms structs.Permissions, ok bool) {
+	channel, err := db.FindChannelByID(c.Request.Context(), channelID)
+	if err != nil {
+		databaseError(c, err)
+		return 0, false
+	}
+	return channel.PermissionsFor(user.Role), true
+}
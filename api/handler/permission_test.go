@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+func TestPermissions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, nil, nil)
+	users := map[structs.Role]*structs.User{}
+	tokens := map[structs.Role]string{}
+	for _, role := range []structs.Role{structs.RoleOwner, structs.RoleAdmin, structs.RoleModerator, structs.RoleMember} {
+		users[role], tokens[role] = s.addUser(t, string(role), role)
+	}
+
+	tests := []struct {
+		name string
+		as   structs.Role
+		role structs.Role
+		want int
+	}{
+		{"member can not change roles", structs.RoleMember, structs.RoleMember, http.StatusForbidden},
+		{"moderator can not change roles", structs.RoleModerator, structs.RoleMember, http.StatusForbidden},
+		{"admin can not make admins", structs.RoleAdmin, structs.RoleAdmin, http.StatusForbidden},
+		{"admin can promote members", structs.RoleAdmin, structs.RoleModerator, http.StatusOK},
+		{"nobody can make owners", structs.RoleOwner, structs.RoleOwner, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		path := "/api/users/" + users[structs.RoleMember].ID.String() + "/role"
+		if w := s.do(jsonRequest(http.MethodPut, path, tokens[tt.as], gin.H{"role": tt.role})); w.Code != tt.want {
+			t.Errorf("%v: got %v: %v, wanted %v", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+	if got, _ := s.db.FindUserByID(ctx, users[structs.RoleMember].ID.String()); got.Role != structs.RoleModerator {
+		t.Errorf("role after promotion got %v, wanted %v", got.Role, structs.RoleModerator)
+	}
+	_, _ = s.db.UpdateUser(ctx, users[structs.RoleMember])
+
+	path := "/api/channels/" + s.channelID + "/overrides/member"
+	override := gin.H{"deny": structs.PermSendMessages}
+	if w := s.do(jsonRequest(http.MethodPut, path, tokens[structs.RoleModerator], override)); w.Code != http.StatusForbidden {
+		t.Errorf("moderator setting an override got %v, wanted %v", w.Code, http.StatusForbidden)
+	}
+	if w := s.do(jsonRequest(http.MethodPut, path, tokens[structs.RoleAdmin], override)); w.Code != http.StatusOK {
+		t.Errorf("admin setting an override got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+	}
+
+	post := gin.H{"channel_id": s.channelID, "content": "hello"}
+	if w := s.do(jsonRequest(http.MethodPost, "/api/messages/", tokens[structs.RoleMember], post)); w.Code != http.StatusForbidden {
+		t.Errorf("member posting in a denied channel got %v, wanted %v", w.Code, http.StatusForbidden)
+	}
+	w := s.do(jsonRequest(http.MethodPost, "/api/messages/", tokens[structs.RoleAdmin], post))
+	var msg structs.Message
+	_ = json.Unmarshal(w.Body.Bytes(), &msg)
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin posting in a denied channel got %v: %v, wanted %v", w.Code, w.Body, http.StatusOK)
+	}
+
+	if w := s.do(jsonRequest(http.MethodDelete, path, tokens[structs.RoleAdmin], nil)); w.Code != http.StatusOK {
+		t.Errorf("admin removing an override got %v, wanted %v", w.Code, http.StatusOK)
+	}
+	if w := s.do(jsonRequest(http.MethodPost, "/api/messages/", tokens[structs.RoleMember], post)); w.Code != http.StatusOK {
+		t.Errorf("member posting after the override was removed got %v, wanted %v", w.Code, http.StatusOK)
+	}
+
+	msgPath := "/api/messages/" + msg.ID.String()
+	if w := s.do(jsonRequest(http.MethodDelete, msgPath, tokens[structs.RoleMember], nil)); w.Code != http.StatusForbidden {
+		t.Errorf("member deleting the message of another got %v, wanted %v", w.Code, http.StatusForbidden)
+	}
+	if w := s.do(jsonRequest(http.MethodDelete, msgPath, tokens[structs.RoleModerator], nil)); w.Code != http.StatusNoContent {
+		t.Errorf("moderator deleting the message of another got %v, wanted %v", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestRegister_FirstOwner(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, &RateLimitConfig{}, nil)
+
+	// the first users register at the same time
+	var (
+		names []string
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("user%d", i))
+	}
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			w := s.do(jsonRequest(http.MethodPost, "/api/auth/register", "", gin.H{"username": name, "password": "password1"}))
+			if w.Code != http.StatusOK {
+				t.Errorf("registering %v got %v: %v, wanted %v", name, w.Code, w.Body, http.StatusOK)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	owners := 0
+	for _, name := range names {
+		if user, _ := s.db.FindUserByUsername(ctx, name); user != nil && user.Role == structs.RoleOwner {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Errorf("owners after registering at once got %v, wanted 1", owners)
+	}
+}
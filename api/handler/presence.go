@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// presence is what the hub knows about the status of a user, across all of
+// their sessions.
+type presence struct {
+	// chosen is the status the user set, online unless they set another
+	chosen structs.Status
+	// status is the status the user was last told they have, and public what
+	// everyone else was last told
+	status structs.Status
+	public structs.Status
+}
+
+// publicStatus is how a status appears to other users.
+func publicStatus(status structs.Status) structs.Status {
+	if status == structs.StatusInvisible {
+		return structs.StatusOffline
+	}
+	return status
+}
+
+// presenceOf returns the presence of a user. The hub must be locked.
+func (h *Hub) presenceOf(userID string) *presence {
+	p, ok := h.presences[userID]
+	if !ok {
+		p = &presence{
+			chosen: structs.StatusOnline,
+			status: structs.StatusOffline,
+			public: structs.StatusOffline,
+		}
+		h.presences[userID] = p
+	}
+	return p
+}
+
+// currentStatus works out the status of a user from the status they chose
+// and the clients they have. Online users become idle once none of their
+// clients have been active for the idle timeout. The hub must be locked.
+func (h *Hub) currentStatus(userID string) structs.Status {
+	present, active := false, false
+	for _, client := range h.Clients {
+		if client.Identified && client.User.ID.String() == userID {
+			present = true
+			if time.Since(client.lastActive) < h.idleTimeout {
+				active = true
+			}
+		}
+	}
+	if !present {
+		return structs.StatusOffline
+	}
+
+	chosen := h.presenceOf(userID).chosen
+	if chosen == structs.StatusOnline && !active {
+		return structs.StatusIdle
+	}
+	return chosen
+}
+
+// updatePresence works out the status of the user of c again, and lets
+// everyone know if it changed. The user only joins and leaves as far as
+// others can tell when their first session starts and their last one ends,
+// and never while invisible. c does not have to be in the hub anymore.
+func (h *Hub) updatePresence(c *Client) {
+	user := c.User
+	userID := user.ID.String()
+
+	h.mu.Lock()
+	p := h.presenceOf(userID)
+	status := h.currentStatus(userID)
+	public := publicStatus(status)
+	oldStatus, oldPublic := p.status, p.public
+	p.status, p.public = status, public
+	// users who went offline without choosing a status have nothing to keep
+	if status == structs.StatusOffline && p.chosen == structs.StatusOnline {
+		delete(h.presences, userID)
+	}
+	h.mu.Unlock()
+
+	if status != oldStatus {
+		_ = h.broadcastFunc(&sendEvent{
+			Operation: Action,
+			Data:      &structs.PresenceUpdate{User: user, Status: status},
+			Action:    ActionPresenceUpdate,
+		}, func(client *Client) bool { return client.User.ID == user.ID })
+	}
+	if public == oldPublic {
+		return
+	}
+	if oldPublic == structs.StatusOffline {
+		_ = h.dispatchEvent(ActionUserJoin, c, user)
+	}
+	_ = h.dispatchEvent(ActionPresenceUpdate, c, &structs.PresenceUpdate{User: user, Status: public})
+	if public == structs.StatusOffline {
+		_ = h.dispatchEvent(ActionUserLeave, c, user)
+	}
+}
+
+// setStatus changes the status the user of the client chose.
+func (h *Hub) setStatus(client *Client, status structs.Status) {
+	if !client.Identified || !status.Settable() {
+		return
+	}
+	h.mu.Lock()
+	h.presenceOf(client.User.ID.String()).chosen = status
+	client.lastActive = time.Now()
+	h.mu.Unlock()
+	h.updatePresence(client)
+}
+
+// markActive notes that the client was just used by its user, which brings
+// an idle user back online.
+func (h *Hub) markActive(client *Client) {
+	h.mu.Lock()
+	client.lastActive = time.Now()
+	h.mu.Unlock()
+	h.updatePresence(client)
+}
+
+// markUserActive is markActive for every client of a user.
+func (h *Hub) markUserActive(user *structs.User) {
+	var first *Client
+	h.mu.Lock()
+	for _, client := range h.Clients {
+		if client.Identified && client.User.ID == user.ID {
+			if _, detached := client.session.detachedFor(); detached {
+				continue
+			}
+			client.lastActive = time.Now()
+			if first == nil {
+				first = client
+			}
+		}
+	}
+	h.mu.Unlock()
+	if first != nil {
+		h.updatePresence(first)
+	}
+}
+
+// updateIdle updates the presence of every connected user, so that those who
+// went inactive turn idle.
+func (h *Hub) updateIdle() {
+	seen := map[string]bool{}
+	var clients []*Client
+	h.mu.Lock()
+	for _, client := range h.Clients {
+		if client.Identified && !seen[client.User.ID.String()] {
+			seen[client.User.ID.String()] = true
+			clients = append(clients, client)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.updatePresence(client)
+	}
+}
+
+// sharedPresences returns the users sharing a channel with c that others can
+// see, along with their statuses. The hub must be locked.
+func (h *Hub) sharedPresences(c *Client) ([]*structs.User, []*structs.PresenceUpdate) {
+	users := make([]*structs.User, 0)
+	presences := make([]*structs.PresenceUpdate, 0)
+	seen := map[string]bool{c.User.ID.String(): true}
+	for _, client := range h.Clients {
+		if !client.Identified || seen[client.User.ID.String()] || !client.sharesChannel(c.Channels) {
+			continue
+		}
+		seen[client.User.ID.String()] = true
+		p, ok := h.presences[client.User.ID.String()]
+		if !ok || p.public == structs.StatusOffline {
+			continue
+		}
+		users = append(users, client.User)
+		presences = append(presences, &structs.PresenceUpdate{User: client.User, Status: p.public})
+	}
+	return users, presences
+}
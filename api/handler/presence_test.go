@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// identifiedClient adds a client to the hub as if user had identified on it.
+func identifiedClient(h *Hub, user *structs.User, channels ...string) *Client {
+	client := newClient(nil, 16)
+	client.Identified = true
+	client.User = user
+	client.session = newSession(16)
+	for _, id := range channels {
+		client.Channels[id] = true
+	}
+	h.registerClient(client)
+	return client
+}
+
+// received returns the actions queued for a client so far.
+func received(client *Client) []ActionCode {
+	var actions []ActionCode
+	for {
+		select {
+		case evt := <-client.send:
+			actions = append(actions, evt.Action)
+		default:
+			return actions
+		}
+	}
+}
+
+func sameActions(got, want []ActionCode) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHub_Presence(t *testing.T) {
+	h := NewHub(nil, nil, nil, &HubConfig{IdleTimeout: time.Millisecond * 50})
+	jeff := &structs.User{ID: uuid.New(), Username: "jeff"}
+	bob := &structs.User{ID: uuid.New(), Username: "bob"}
+	channel := uuid.New().String()
+
+	observer := identifiedClient(h, bob, channel)
+	h.updatePresence(observer)
+	_ = received(observer)
+	first := identifiedClient(h, jeff, channel)
+	h.updatePresence(first)
+	want := []ActionCode{ActionUserJoin, ActionPresenceUpdate}
+	if got := received(observer); !sameActions(got, want) {
+		t.Errorf("first session got %v, wanted %v", got, want)
+	}
+
+	second := identifiedClient(h, jeff, channel)
+	h.updatePresence(second)
+	if got := received(observer); len(got) != 0 {
+		t.Errorf("second session got %v, wanted nothing", got)
+	}
+
+	h.setStatus(second, structs.StatusDND)
+	if got := received(observer); !sameActions(got, []ActionCode{ActionPresenceUpdate}) {
+		t.Errorf("setStatus() got %v, wanted a presence update", got)
+	}
+	h.setStatus(first, structs.StatusDND)
+	if got := received(observer); len(got) != 0 {
+		t.Errorf("setStatus() to the same status got %v, wanted nothing", got)
+	}
+
+	h.setStatus(first, structs.StatusOnline)
+	_ = received(observer)
+	time.Sleep(time.Millisecond * 60)
+	// only jeff is meant to go idle
+	h.markActive(observer)
+	h.updateIdle()
+	if got := received(observer); !sameActions(got, []ActionCode{ActionPresenceUpdate}) {
+		t.Errorf("going idle got %v, wanted a presence update", got)
+	}
+	h.mu.Lock()
+	status := h.presences[jeff.ID.String()].public
+	h.mu.Unlock()
+	if status != structs.StatusIdle {
+		t.Errorf("status got %v, wanted %v", status, structs.StatusIdle)
+	}
+
+	h.setStatus(first, structs.StatusInvisible)
+	want = []ActionCode{ActionPresenceUpdate, ActionUserLeave}
+	if got := received(observer); !sameActions(got, want) {
+		t.Errorf("going invisible got %v, wanted %v", got, want)
+	}
+	_ = received(first)
+	h.dropClient(second)
+	h.dropClient(first)
+	if got := received(observer); len(got) != 0 {
+		t.Errorf("invisible user leaving got %v, wanted nothing", got)
+	}
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/ratelimit"
+)
+
+// RateLimitConfig limits how often clients can make requests and send
+// websocket events. Anything without a limit can be done as often as wanted.
+type RateLimitConfig struct {
+	// Routes are keyed by method and path as registered, such as
+	// "POST /api/messages/" or "PATCH /api/messages/:id". They are counted
+	// per user, or per address for requests without a token.
+	Routes map[string]ratelimit.Limit
+	// Events are keyed by op code. They are counted per user, or per address
+	// before the client identifies.
+	Events map[OpCode]ratelimit.Limit
+}
+
+// DefaultRateLimits returns the limits used when nothing else is configured.
+func DefaultRateLimits() *RateLimitConfig {
+	return &RateLimitConfig{
+		Routes: map[string]ratelimit.Limit{
+			"POST /api/auth/login":               {Burst: 10, Interval: time.Second * 6},
+			"POST /api/auth/register":            {Burst: 5, Interval: time.Minute},
+			"POST /api/auth/refresh":             {Burst: 10, Interval: time.Second * 6},
+			"POST /api/messages/":                {Burst: 5, Interval: time.Second},
+			"GET /api/messages/search":           {Burst: 5, Interval: time.Second},
+			"PATCH /api/messages/:id":            {Burst: 5, Interval: time.Second},
+			"DELETE /api/messages/:id":           {Burst: 5, Interval: time.Second},
+			"POST /api/messages/:id/reactions":   {Burst: 10, Interval: time.Millisecond * 500},
+			"DELETE /api/messages/:id/reactions": {Burst: 10, Interval: time.Millisecond * 500},
+			"POST /api/attachments/":             {Burst: 5, Interval: time.Second * 5},
+		},
+		Events: map[OpCode]ratelimit.Limit{
+			Identify:  {Burst: 10, Interval: time.Second * 6},
+			Resume:    {Burst: 10, Interval: time.Second * 6},
+			Ping:      {Burst: 5, Interval: time.Second},
+			Typing:    {Burst: 5, Interval: time.Second * 2},
+			SetStatus: {Burst: 5, Interval: time.Second * 5},
+		},
+	}
+}
+
+// opCodeNames are the op codes clients send, by the names they are
+// configured with.
+var opCodeNames = map[string]OpCode{
+	"identify":   Identify,
+	"resume":     Resume,
+	"ping":       Ping,
+	"typing":     Typing,
+	"set_status": SetStatus,
+}
+
+// ParseOpCode returns the op code of a client event from its name, such as
+// "typing" or "set_status".
+func ParseOpCode(name string) (OpCode, bool) {
+	op, ok := opCodeNames[name]
+	return op, ok
+}
+
+// RateLimiters holds a limiter for every configured route and event. It is
+// shared by the HTTP handlers and the hub, and a nil RateLimiters limits
+// nothing.
+type RateLimiters struct {
+	routes map[string]*ratelimit.Limiter
+	events map[OpCode]*ratelimit.Limiter
+}
+
+// NewRateLimiters returns limiters for conf, or for DefaultRateLimits if conf
+// is nil.
+func NewRateLimiters(conf *RateLimitConfig) *RateLimiters {
+	if conf == nil {
+		conf = DefaultRateLimits()
+	}
+	l := &RateLimiters{
+		routes: map[string]*ratelimit.Limiter{},
+		events: map[OpCode]*ratelimit.Limiter{},
+	}
+	for route, limit := range conf.Routes {
+		if limit.Valid() {
+			l.routes[route] = ratelimit.NewLimiter(limit)
+		}
+	}
+	for op, limit := range conf.Events {
+		if limit.Valid() {
+			l.events[op] = ratelimit.NewLimiter(limit)
+		}
+	}
+	return l
+}
+
+// RateLimit is middleware that limits each route it is used on as limiters
+// are configured to. It counts requests per user if it comes after
+// IsAuthorized, and per address otherwise.
+func RateLimit(limiters *RateLimiters) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiters != nil {
+			limiter, ok := limiters.routes[c.Request.Method+" "+c.FullPath()]
+			if ok && !allowRequest(c, limiter) {
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// allowRequest takes a request from the bucket of whoever made it. If there
+// are none left, a 429 response is written saying when to try again.
+func allowRequest(c *gin.Context, limiter *ratelimit.Limiter) bool {
+	key := "ip:" + c.ClientIP()
+	if claims, ok := c.Get("claims"); ok {
+		if claims, ok := claims.(*api.UserClaims); ok {
+			key = "user:" + claims.Subject
+		}
+	}
+
+	ok, retryAfter := limiter.Allow(key)
+	if ok {
+		return true
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, ErrorResponse{CodeError, "too many requests"})
+	return false
+}
+
+// allowEvent takes an event from the bucket of the user of a client, or of
+// its address if it has not identified yet. If there are none left, the
+// client is sent a RateLimited error saying when to try again, and the event
+// should be ignored.
+func (h *Hub) allowEvent(client *Client, op OpCode) bool {
+	if h.limiters == nil {
+		return true
+	}
+	limiter, ok := h.limiters.events[op]
+	if !ok {
+		return true
+	}
+
+	h.mu.Lock()
+	key := "ip:" + client.addr
+	if client.Identified {
+		key = "user:" + client.User.ID.String()
+	}
+	h.mu.Unlock()
+
+	ok, retryAfter := limiter.Allow(key)
+	if ok {
+		return true
+	}
+	h.send(client, &sendEvent{
+		Operation: Error,
+		Data: &ErrorData{
+			Code:       RateLimited,
+			Message:    ErrRateLimited.Error(),
+			RetryAfter: retryAfter.Milliseconds(),
+		},
+		Action: ActionNone,
+	})
+	return false
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/ratelimit"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t, &RateLimitConfig{
+		Routes: map[string]ratelimit.Limit{
+			"POST /api/messages/":    {Burst: 2, Interval: time.Minute},
+			"POST /api/auth/login":   {Burst: 1, Interval: time.Millisecond * 1500},
+			"POST /api/attachments/": {Burst: 1, Interval: time.Minute},
+		},
+		Events: map[OpCode]ratelimit.Limit{Ping: {Burst: 1, Interval: time.Minute}},
+	}, nil)
+	var tokens []string
+	for _, name := range []string{"jeff", "bob"} {
+		_, token := s.addUser(t, name, structs.RoleMember)
+		tokens = append(tokens, token)
+	}
+	post := gin.H{"channel_id": s.channelID, "content": "hello"}
+
+	for i := 0; i < 2; i++ {
+		if w := s.do(jsonRequest(http.MethodPost, "/api/messages/", tokens[0], post)); w.Code != http.StatusOK {
+			t.Fatalf("message %v within the limit got %v: %v, wanted %v", i, w.Code, w.Body, http.StatusOK)
+		}
+	}
+	w := s.do(jsonRequest(http.MethodPost, "/api/messages/", tokens[0], post))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("message over the limit got %v with Retry-After %q, wanted %v with 60", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if w := s.do(jsonRequest(http.MethodPost, "/api/messages/", tokens[1], post)); w.Code != http.StatusOK {
+		t.Errorf("message by another user got %v, wanted %v", w.Code, http.StatusOK)
+	}
+	if w := s.do(jsonRequest(http.MethodGet, "/api/messages/?channel_id="+s.channelID, tokens[0], nil)); w.Code == http.StatusTooManyRequests {
+		t.Errorf("route without a limit got %v", w.Code)
+	}
+
+	_ = s.do(uploadRequest(t, tokens[0], s.channelID, "file", []byte("hello")))
+	if w := s.do(uploadRequest(t, tokens[0], s.channelID, "file", []byte("hello"))); w.Code != http.StatusTooManyRequests {
+		t.Errorf("upload over the limit got %v, wanted %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	// logins have no token, so they are limited by address
+	login := gin.H{"username": "jeff", "password": ""}
+	_ = s.do(jsonRequest(http.MethodPost, "/api/auth/login", "", login))
+	w = s.do(jsonRequest(http.MethodPost, "/api/auth/login", "", login))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("login over the limit got %v with Retry-After %q, wanted %v with 2", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	client := identifiedClient(s.hub, &structs.User{ID: uuid.New(), Username: "alice"})
+	received(client)
+	ping := &Event{Operation: Ping, RawData: json.RawMessage(`{"sequence":1}`)}
+	s.hub.onEvent(&WSEvent{Client: client, Event: ping})
+	s.hub.onEvent(&WSEvent{Client: client, Event: ping})
+	var ops []OpCode
+	var limited *ErrorData
+	for len(client.send) > 0 {
+		evt := <-client.send
+		ops = append(ops, evt.Operation)
+		if data, ok := evt.Data.(*ErrorData); ok {
+			limited = data
+		}
+	}
+	if len(ops) != 2 || ops[0] != PingACK || limited == nil || limited.Code != RateLimited || limited.RetryAfter <= 0 {
+		t.Errorf("pinging twice got %v with error %+v, wanted an ack and a %v error", ops, limited, RateLimited)
+	}
+	if got := client.closedWith(); got != nil {
+		t.Errorf("rate limited client closed with %v, wanted it left connected", got)
+	}
+}
+
+func TestRateLimit_Middleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiters := NewRateLimiters(&RateLimitConfig{
+		Routes: map[string]ratelimit.Limit{"GET /limited": {Burst: 1, Interval: time.Minute}},
+	})
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	r.GET("/limited", RateLimit(limiters), ok)
+	r.GET("/unlimited", RateLimit(limiters), ok)
+	r.GET("/nil", RateLimit(nil), ok)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/limited", http.StatusNoContent},
+		{"/limited", http.StatusTooManyRequests},
+		{"/unlimited", http.StatusNoContent},
+		{"/unlimited", http.StatusNoContent},
+		{"/nil", http.StatusNoContent},
+		{"/nil", http.StatusNoContent},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("request %v to %v got %v, wanted %v", i, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// session outlives the connection of an identified client, so that a client
+// that reconnects can resume where it left off. Every action event sent in
+// a session is numbered, and the most recent ones are kept for replaying.
+type session struct {
+	mu     sync.Mutex
+	id     string
+	seq    int64
+	buffer []*sendEvent
+	size   int
+	// detached is when the client lost its connection, and is zero while
+	// there is a client attached
+	detached time.Time
+}
+
+func newSession(bufferSize int) *session {
+	return &session{
+		id:   uuid.New().String(),
+		size: bufferSize,
+	}
+}
+
+// sequence returns a copy of evt with the next sequence number, and keeps it
+// for replaying. It also reports whether a client is attached to send it to.
+func (s *session) sequence(evt *sendEvent) (*sendEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	evtCopy := *evt
+	evtCopy.Sequence = s.seq
+
+	s.buffer = append(s.buffer, &evtCopy)
+	if len(s.buffer) > s.size {
+		s.buffer = s.buffer[len(s.buffer)-s.size:]
+	}
+	return &evtCopy, s.detached.IsZero()
+}
+
+func (s *session) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detached = time.Now()
+}
+
+// detachedFor returns how long the session has been without a client, and
+// whether it is without one at all.
+func (s *session) detachedFor() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.detached.IsZero() {
+		return 0, false
+	}
+	return time.Since(s.detached), true
+}
+
+// resume attaches the session again, and returns the events sent after the
+// given sequence number. If some of them are no longer kept, ok is false
+// and the session stays detached.
+func (s *session) resume(after int64) (events []*sendEvent, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if after > s.seq || after < 0 {
+		return nil, false
+	}
+	missed := s.seq - after
+	if missed > int64(len(s.buffer)) {
+		return nil, false
+	}
+
+	s.detached = time.Time{}
+	return append([]*sendEvent{}, s.buffer[int64(len(s.buffer))-missed:]...), true
+}
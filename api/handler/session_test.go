@@ -0,0 +1,30 @@
+package handler
+
+import "testing"
+
+func TestSession_Resume(t *testing.T) {
+	s := newSession(3)
+	for i := 0; i < 5; i++ {
+		evt, attached := s.sequence(&sendEvent{Operation: Action})
+		if !attached || evt.Sequence != int64(i+1) {
+			t.Fatalf("sequence() got (%v, %v), wanted (%v, true)", evt.Sequence, attached, i+1)
+		}
+	}
+
+	s.detach()
+	if _, attached := s.sequence(&sendEvent{Operation: Action}); attached {
+		t.Errorf("sequence() on detached session got attached")
+	}
+
+	// only the last 3 of the 6 events are kept
+	if _, ok := s.resume(2); ok {
+		t.Errorf("resume(2) succeeded with events missing from the buffer")
+	}
+	events, ok := s.resume(4)
+	if !ok || len(events) != 2 || events[0].Sequence != 5 || events[1].Sequence != 6 {
+		t.Errorf("resume(4) got (%v, %v), wanted events 5 and 6", events, ok)
+	}
+	if _, detached := s.detachedFor(); detached {
+		t.Errorf("session is still detached after resuming")
+	}
+}
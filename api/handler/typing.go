@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+type typingKey struct {
+	userID    string
+	channelID string
+}
+
+// typingTracker keeps track of who is typing in which channel. Indicators
+// expire on their own unless they are renewed before the timeout.
+type typingTracker struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	timers  map[typingKey]*time.Timer
+}
+
+func newTypingTracker(timeout time.Duration) *typingTracker {
+	return &typingTracker{
+		timeout: timeout,
+		timers:  map[typingKey]*time.Timer{},
+	}
+}
+
+// start marks a user as typing in a channel, or renews the indicator if they
+// already are. expire is called if it is not renewed or stopped before the
+// timeout. It reports whether the user was not typing there before.
+func (t *typingTracker) start(userID, channelID string, expire func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := typingKey{userID, channelID}
+	old, renewed := t.timers[key]
+	if renewed {
+		old.Stop()
+	}
+
+	// a timer that already fired but is waiting for the lock sees that it
+	// was replaced, and leaves the new one alone
+	var timer *time.Timer
+	timer = time.AfterFunc(t.timeout, func() {
+		t.mu.Lock()
+		if t.timers[key] != timer {
+			t.mu.Unlock()
+			return
+		}
+		delete(t.timers, key)
+		t.mu.Unlock()
+		expire()
+	})
+	t.timers[key] = timer
+	return !renewed
+}
+
+// stop clears the indicator of a user in a channel, and reports whether there
+// was one.
+func (t *typingTracker) stop(userID, channelID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := typingKey{userID, channelID}
+	timer, ok := t.timers[key]
+	if ok {
+		timer.Stop()
+		delete(t.timers, key)
+	}
+	return ok
+}
+
+// stopUser clears every indicator of a user, and returns the channels they
+// were typing in.
+func (t *typingTracker) stopUser(userID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var channelIDs []string
+	for key, timer := range t.timers {
+		if key.userID == userID {
+			timer.Stop()
+			delete(t.timers, key)
+			channelIDs = append(channelIDs, key.channelID)
+		}
+	}
+	return channelIDs
+}
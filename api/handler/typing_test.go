@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingTracker(t *testing.T) {
+	tracker := newTypingTracker(time.Millisecond * 50)
+	expired := make(chan string, 2)
+	expire := func(channelID string) func() {
+		return func() { expired <- channelID }
+	}
+
+	if !tracker.start("jeff", "a", expire("a")) {
+		t.Errorf("start() got false, wanted true")
+	}
+	if tracker.start("jeff", "a", expire("a")) {
+		t.Errorf("start() while typing got true, wanted false")
+	}
+	tracker.start("jeff", "b", expire("b"))
+
+	if !tracker.stop("jeff", "b") {
+		t.Errorf("stop() got false, wanted true")
+	}
+	if tracker.stop("jeff", "b") {
+		t.Errorf("stop() twice got true, wanted false")
+	}
+
+	select {
+	case got := <-expired:
+		if got != "a" {
+			t.Errorf("expired got %v, wanted a", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("indicator did not expire")
+	}
+	select {
+	case got := <-expired:
+		t.Errorf("expired got %v after it was stopped", got)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	tracker.start("jeff", "a", expire("a"))
+	tracker.start("bob", "a", expire("a"))
+	if got := tracker.stopUser("jeff"); len(got) != 1 || got[0] != "a" {
+		t.Errorf("stopUser() got %v, wanted [a]", got)
+	}
+	if !tracker.stop("bob", "a") {
+		t.Errorf("stopUser() stopped the indicators of another user")
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	api "github.com/intrntsrfr/vue-ws-test"
+	"github.com/intrntsrfr/vue-ws-test/database"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// UserHandler handles managing and moderating other users.
+type UserHandler struct {
+	r      *gin.Engine
+	db     database.DB
+	jwt    api.JWTService
+	ws     *Hub
+	logins *LoginTracker
+}
+
+func NewUserHandler(r *gin.Engine, db database.DB, jwtService api.JWTService, hub *Hub, logins *LoginTracker) {
+	h := &UserHandler{r, db, jwtService, hub, logins}
+
+	g := h.r.Group("/api/users")
+	g.Use(h.jwt.IsAuthorized())
+	g.PUT("/:id/role", RequirePermission(h.db, structs.PermManageRoles), h.putRole())
+
+	moderate := RequirePermission(h.db, structs.PermModerateMembers)
+	g.POST("/:id/kick", moderate, h.kick())
+	g.PUT("/:id/mute", moderate, h.putSanction(structs.SanctionMute))
+	g.DELETE("/:id/mute", moderate, h.deleteSanction(structs.SanctionMute))
+	g.PUT("/:id/ban", moderate, h.putSanction(structs.SanctionBan))
+	g.DELETE("/:id/ban", moderate, h.deleteSanction(structs.SanctionBan))
+
+	g.DELETE("/:id/lockout", RequirePermission(h.db, structs.PermAdministrator), h.unlock())
+}
+
+// putRole gives a user another role. Users can only change the roles of
+// those below them, and only to roles below their own, so there is only ever
+// the one owner.
+func (h *UserHandler) putRole() gin.HandlerFunc {
+	type PutRoleBody struct {
+		Role structs.Role `json:"role"`
+	}
+
+	return func(c *gin.Context) {
+		var putRoleBody PutRoleBody
+		if err := c.BindJSON(&putRoleBody); err != nil || !putRoleBody.Role.Valid() {
+			c.JSON(http.StatusBadRequest, ErrorResponse{CodeError, "bad request"})
+			return
+		}
+
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		target, err := h.db.FindUserByID(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+		if !user.CanManage(target) || putRoleBody.Role.Rank() >= user.Role.Rank() {
+			c.JSON(http.StatusForbidden, ErrorResponse{CodeError, "can only change roles below your own"})
+			return
+		}
+
+		targetCopy := *target
+		targetCopy.Role = putRoleBody.Role
+		if _, err := h.db.UpdateUser(c.Request.Context(), &targetCopy); err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		targetCopy.Password = ""
+		c.JSON(http.StatusOK, &targetCopy)
+		_ = h.ws.dispatchEvent(ActionUserUpdate, nil, &targetCopy)
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditRoleUpdate,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   target.ID.String(),
+			Details:    map[string]string{"role": string(targetCopy.Role), "previous_role": string(target.Role)},
+		})
+	}
+}
+
+// unlock lifts the lockout on a user, so that they can log in right away.
+func (h *UserHandler) unlock() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c, h.db)
+		if !ok {
+			return
+		}
+		target, err := h.db.FindUserByID(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			databaseError(c, err)
+			return
+		}
+
+		h.logins.unlock(target.Username)
+		c.Status(http.StatusNoContent)
+		audit(c, h.db, user, &structs.AuditEntry{
+			Action:     structs.AuditUnlock,
+			TargetType: structs.AuditTargetUser,
+			TargetID:   target.ID.String(),
+		})
+	}
+}
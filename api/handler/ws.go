@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	api "github.com/intrntsrfr/vue-ws-test"
@@ -13,6 +16,7 @@ import (
 	"github.com/intrntsrfr/vue-ws-test/database"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -24,6 +28,13 @@ const (
 	PingACK
 	Action
 	Error
+	Hello
+	Resume
+	InvalidSession
+	// Typing is sent by clients while their user is typing in a channel
+	Typing
+	// SetStatus is sent by clients to change the status of their user
+	SetStatus
 )
 
 type ActionCode int
@@ -34,6 +45,21 @@ const (
 	ActionUserJoin
 	ActionUserLeave
 	ActionUserMessage
+	ActionReactionAdd
+	ActionReactionRemove
+	ActionChannelCreate
+	ActionChannelUpdate
+	ActionChannelDelete
+	ActionChannelMemberAdd
+	ActionChannelMemberRemove
+	ActionResumed
+	ActionMessageUpdate
+	ActionMessageDelete
+	ActionTypingStart
+	ActionTypingStop
+	ActionPresenceUpdate
+	ActionReadStateUpdate
+	ActionUserUpdate
 )
 
 type WSEvent struct {
@@ -52,19 +78,50 @@ type sendEvent struct {
 	Operation OpCode      `json:"op"`
 	Data      interface{} `json:"data"`
 	Action    ActionCode  `json:"action"`
+	// Sequence numbers the action events sent in a session, starting at 1
+	Sequence int64 `json:"s,omitempty"`
 }
 
 type IdentifyData struct {
 	Token string `json:"token"`
+	// Status is the status to start with, which is left as it was if empty
+	Status structs.Status `json:"status,omitempty"`
+}
+
+// ResumeData is sent by a reconnecting client instead of IdentifyData, with
+// the last sequence number it received in its previous session
+type ResumeData struct {
+	Token     string `json:"token"`
+	SessionID string `json:"session_id"`
+	Sequence  int64  `json:"sequence"`
 }
 
 type PingData struct {
 	Sequence int `json:"sequence"`
 }
 
+// StatusData is sent by clients to change the status of their user, which
+// applies to all of their sessions
+type StatusData struct {
+	Status structs.Status `json:"status"`
+}
+
+// TypingData is sent by clients every few seconds while their user is typing
+type TypingData struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+}
+
+// HelloData is sent when a client connects, and tells it how often to ping
+type HelloData struct {
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
 type ErrorData struct {
 	Code    ErrorCode `json:"code"`
 	Message string    `json:"message"`
+	// RetryAfter is how many milliseconds to wait before sending the same
+	// event again, if it was rate limited
+	RetryAfter int64 `json:"retry_after,omitempty"`
 }
 
 type ErrorCode int
@@ -73,6 +130,18 @@ const (
 	UnknownError ErrorCode = iota
 	PingTimedOut
 	AuthFailed
+	TokenRevoked
+	SlowConsumer
+	ServerError
+	// Kicked is sent to every client of a user a moderator kicked. They are
+	// free to connect again.
+	Kicked
+	// Banned is sent to every client of a user a moderator banned, and to
+	// any they try to identify with afterwards
+	Banned
+	// RateLimited is sent to clients that send an event more often than
+	// allowed. The event is ignored, but the client stays connected.
+	RateLimited
 )
 
 var (
@@ -80,20 +149,82 @@ var (
 	ErrPingTimedOut = errors.New("no ping for too long")
 	ErrInvalidData  = errors.New("invalid data")
 	ErrAuthFailed   = errors.New("authentication failed")
+	ErrTokenRevoked = errors.New("session was logged out")
+	ErrSlowConsumer = errors.New("too many events were waiting to be sent")
+	ErrServerError  = errors.New("internal server error")
+	ErrKicked       = errors.New("kicked by a moderator")
+	ErrBanned       = errors.New("banned by a moderator")
+	ErrRateLimited  = errors.New("too many events, slow down")
 )
 
 var ErrNoSuchError = errors.New("no such error")
 
-// Client represents a connected websocket client
-type Client struct {
-	User       *structs.User
-	Conn       *websocket.Conn
-	Identified bool
-	LastPing   time.Time
+const (
+	// DefaultHeartbeatInterval is how often clients should ping when nothing
+	// else is configured.
+	DefaultHeartbeatInterval = time.Second * 30
+	// DefaultSendQueueSize is how many events can wait to be written to a
+	// client when nothing else is configured.
+	DefaultSendQueueSize = 256
+	// DefaultResumeWindow is how long a session can be resumed for after its
+	// client disconnects when nothing else is configured.
+	DefaultResumeWindow = time.Minute * 2
+	// DefaultReplayBufferSize is how many events are kept per session for
+	// replaying when nothing else is configured.
+	DefaultReplayBufferSize = 256
+	// DefaultTypingTimeout is how long a typing indicator lasts without being
+	// renewed when nothing else is configured.
+	DefaultTypingTimeout = time.Second * 10
+	// DefaultIdleTimeout is how long users can go without doing anything
+	// before they turn idle when nothing else is configured.
+	DefaultIdleTimeout = time.Minute * 5
+)
+
+// minTypingInterval is how often a client may renew its typing indicator.
+// Anything sent more often is ignored.
+const minTypingInterval = time.Second * 2
+
+// SlowClientPolicy decides what happens to clients whose send queue is full
+type SlowClientPolicy int
+
+const (
+	// DisconnectSlowClients disconnects the client with SlowConsumer
+	DisconnectSlowClients SlowClientPolicy = iota
+	// DropSlowClientEvents throws away events until there is room again
+	DropSlowClientEvents
+)
+
+type HubConfig struct {
+	// HeartbeatInterval is how often clients are asked to ping. Clients that
+	// have not pinged for one and a half intervals are disconnected.
+	HeartbeatInterval time.Duration
+	// SendQueueSize is how many events can wait to be written to a client
+	SendQueueSize    int
+	SlowClientPolicy SlowClientPolicy
+	// ResumeWindow is how long a session can be resumed after its client
+	// disconnects, during which the user still counts as present. A negative
+	// window turns resuming off.
+	ResumeWindow time.Duration
+	// ReplayBufferSize is how many events are kept per session. Clients that
+	// missed more than this have to identify again.
+	ReplayBufferSize int
+	// TypingTimeout is how long a typing indicator lasts unless the client
+	// renews it. Once it runs out, a stop event is sent.
+	TypingTimeout time.Duration
+	// IdleTimeout is how long none of the clients of a user can be active
+	// before the user turns idle
+	IdleTimeout time.Duration
+	// URLSigner signs the links to attachments in the messages sent out. If
+	// it is nil, links are signed with a random key and stop working once
+	// the server restarts.
+	URLSigner *api.URLSigner
 }
 
 // Hub maintains a list of connected clients and broadcasts messages to them
 type Hub struct {
+	// mu guards Clients and their subscriptions, which are also modified by
+	// the HTTP handlers when users join or leave channels
+	mu         sync.Mutex
 	Clients    []*Client
 	Messages   []*structs.Message
 	EventCh    chan *WSEvent
@@ -101,10 +232,26 @@ type Hub struct {
 	Unregister chan *Client
 	db         database.DB
 	jwt        api.JWTService
+	typing     *typingTracker
+	signer     *api.URLSigner
+	limiters   *RateLimiters
+	// presences is keyed by user ID, and guarded by mu
+	presences map[string]*presence
+
+	heartbeatInterval time.Duration
+	sendQueueSize     int
+	slowClientPolicy  SlowClientPolicy
+	resumeWindow      time.Duration
+	replayBufferSize  int
+	idleTimeout       time.Duration
 }
 
-// NewHub returns a default Hub
-func NewHub(db database.DB, jwt api.JWTService) *Hub {
+// NewHub returns a Hub using conf, or the defaults if conf is nil. Events are
+// limited by limiters, which can be nil to limit none.
+func NewHub(db database.DB, jwt api.JWTService, limiters *RateLimiters, conf *HubConfig) *Hub {
+	if conf == nil {
+		conf = &HubConfig{}
+	}
 	hub := &Hub{
 		Clients:    []*Client{},
 		Messages:   []*structs.Message{},
@@ -113,6 +260,41 @@ func NewHub(db database.DB, jwt api.JWTService) *Hub {
 		Unregister: make(chan *Client),
 		db:         db,
 		jwt:        jwt,
+		presences:  map[string]*presence{},
+		signer:     conf.URLSigner,
+		limiters:   limiters,
+
+		heartbeatInterval: conf.HeartbeatInterval,
+		sendQueueSize:     conf.SendQueueSize,
+		slowClientPolicy:  conf.SlowClientPolicy,
+		resumeWindow:      conf.ResumeWindow,
+		replayBufferSize:  conf.ReplayBufferSize,
+		idleTimeout:       conf.IdleTimeout,
+	}
+	if hub.heartbeatInterval <= 0 {
+		hub.heartbeatInterval = DefaultHeartbeatInterval
+	}
+	if hub.sendQueueSize <= 0 {
+		hub.sendQueueSize = DefaultSendQueueSize
+	}
+	if hub.resumeWindow == 0 {
+		hub.resumeWindow = DefaultResumeWindow
+	}
+	if hub.replayBufferSize <= 0 {
+		hub.replayBufferSize = DefaultReplayBufferSize
+	}
+	if hub.idleTimeout <= 0 {
+		hub.idleTimeout = DefaultIdleTimeout
+	}
+	typingTimeout := conf.TypingTimeout
+	if typingTimeout <= 0 {
+		typingTimeout = DefaultTypingTimeout
+	}
+	hub.typing = newTypingTracker(typingTimeout)
+	if hub.signer == nil {
+		key := make([]byte, 32)
+		_, _ = rand.Read(key)
+		hub.signer = api.NewURLSigner(key, 0)
 	}
 	return hub
 }
@@ -131,12 +313,18 @@ func (h *Hub) Handler() gin.HandlerFunc {
 			fmt.Println(err)
 			return
 		}
-		defer conn.Close()
 
-		// &structs.User{ID: uuid.New(), Username: username, Created: time.Now().Format(time.RFC3339)}
-		client := &Client{User: nil, Conn: conn, Identified: false, LastPing: time.Now()}
+		client := newClient(conn, h.sendQueueSize)
+		client.addr = c.ClientIP()
+		go client.writePump()
 		h.Register <- client
 
+		h.send(client, &sendEvent{
+			Operation: Hello,
+			Data:      &HelloData{HeartbeatInterval: h.heartbeatInterval.Milliseconds()},
+			Action:    ActionNone,
+		})
+
 		for {
 			var evt Event
 			err := conn.ReadJSON(&evt)
@@ -152,15 +340,51 @@ func (h *Hub) Handler() gin.HandlerFunc {
 		}
 
 		h.Unregister <- client
+		client.close(nil)
 	}
 }
 
 // Run starts a loop for reading events that come through
 func (h *Hub) Run() {
-	//h.heartbeats()
+	go h.heartbeats()
 	h.listenEvents()
 }
 
+// heartbeats disconnects clients that have not pinged for too long, drops
+// sessions that can no longer be resumed and lets users turn idle
+func (h *Hub) heartbeats() {
+	timeout := h.heartbeatInterval + h.heartbeatInterval/2
+	ticker := time.NewTicker(h.heartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.mu.Lock()
+		var stale, expired []*Client
+		for _, client := range h.Clients {
+			if client.session != nil {
+				if d, detached := client.session.detachedFor(); detached {
+					if d > h.resumeWindow {
+						expired = append(expired, client)
+					}
+					continue
+				}
+			}
+			if time.Since(client.LastPing) > timeout {
+				stale = append(stale, client)
+			}
+		}
+		h.mu.Unlock()
+
+		for _, client := range stale {
+			_ = h.disconnectClient(client, PingTimedOut)
+		}
+		for _, client := range expired {
+			h.dropClient(client)
+		}
+		h.updateIdle()
+	}
+}
+
 func (h *Hub) listenEvents() {
 	for {
 		select {
@@ -175,6 +399,9 @@ func (h *Hub) listenEvents() {
 }
 
 func (h *Hub) onEvent(evt *WSEvent) {
+	if !h.allowEvent(evt.Client, evt.Event.Operation) {
+		return
+	}
 	switch evt.Event.Operation {
 	case Identify:
 		data := IdentifyData{}
@@ -182,42 +409,236 @@ func (h *Hub) onEvent(evt *WSEvent) {
 			return
 		}
 		h.identifyClient(evt.Client, &data)
+	case Resume:
+		data := ResumeData{}
+		if err := json.Unmarshal(evt.Event.RawData, &data); err != nil {
+			return
+		}
+		h.resumeClient(evt.Client, &data)
 	case Ping:
 		data := PingData{}
 		if err := json.Unmarshal(evt.Event.RawData, &data); err != nil {
 			return
 		}
 		h.handlePing(evt.Client, &data)
+	case Typing:
+		data := TypingData{}
+		if err := json.Unmarshal(evt.Event.RawData, &data); err != nil {
+			return
+		}
+		if !h.channelAllows(evt.Client, data.ChannelID.String(), structs.PermSendMessages) || h.muted(evt.Client) {
+			return
+		}
+		h.handleTyping(evt.Client, &data)
+	case SetStatus:
+		data := StatusData{}
+		if err := json.Unmarshal(evt.Event.RawData, &data); err != nil {
+			return
+		}
+		h.setStatus(evt.Client, data.Status)
 	}
 }
 
-func (h *Hub) identifyClient(client *Client, evt *IdentifyData) {
-	token, err := h.jwt.ParseToken(evt.Token)
+// channelAllows reports whether the user of an identified client has perm in
+// the channel with the given ID, after its overrides.
+func (h *Hub) channelAllows(client *Client, channelID string, perm structs.Permissions) bool {
+	h.mu.Lock()
+	identified, user := client.Identified, client.User
+	h.mu.Unlock()
+	if !identified {
+		return false
+	}
+	channel, err := h.db.FindChannelByID(client.ctx, channelID)
 	if err != nil {
+		return false
+	}
+	return channel.PermissionsFor(user.Role).Has(perm)
+}
+
+// muted reports whether the user of a client is muted. If that can not be
+// worked out, they are taken to be.
+func (h *Hub) muted(client *Client) bool {
+	h.mu.Lock()
+	user := client.User
+	h.mu.Unlock()
+	mute, err := activeSanction(client.ctx, h.db, user.ID.String(), structs.SanctionMute)
+	return err != nil || mute != nil
+}
+
+// authenticate returns the claims of token, or disconnects the client if
+// it is not valid.
+func (h *Hub) authenticate(client *Client, token string) (*api.UserClaims, bool) {
+	parsed, err := h.jwt.ParseToken(client.ctx, token)
+	if errors.Is(err, api.ErrTokenRevoked) {
+		_ = h.disconnectClient(client, TokenRevoked)
+		return nil, false
+	} else if errors.Is(err, api.ErrInvalidToken) {
 		_ = h.disconnectClient(client, AuthFailed)
-		return
+		return nil, false
+	} else if err != nil {
+		_ = h.disconnectClient(client, ServerError)
+		return nil, false
 	}
-	claims, ok := token.(*api.UserClaims)
+	claims, ok := parsed.(*api.UserClaims)
 	if !ok {
 		_ = h.disconnectClient(client, AuthFailed)
+		return nil, false
+	}
+	return claims, true
+}
+
+func (h *Hub) identifyClient(client *Client, evt *IdentifyData) {
+	if client.Identified {
+		return
+	}
+	claims, ok := h.authenticate(client, evt.Token)
+	if !ok {
 		return
 	}
 
-	user := h.db.FindUserByID(claims.Subject)
-	if user == nil {
+	user, err := h.db.FindUserByID(client.ctx, claims.Subject)
+	if errors.Is(err, database.ErrNotFound) {
 		_ = h.disconnectClient(client, AuthFailed)
 		return
+	} else if err != nil {
+		_ = h.disconnectClient(client, ServerError)
+		return
+	}
+	if ban, err := activeSanction(client.ctx, h.db, claims.Subject, structs.SanctionBan); err != nil {
+		_ = h.disconnectClient(client, ServerError)
+		return
+	} else if ban != nil {
+		_ = h.disconnectClient(client, Banned)
+		return
 	}
 	userCopy := *user
 	userCopy.Password = ""
 
+	userChannels, err := h.db.GetUserChannels(client.ctx, user.ID.String())
+	if err != nil {
+		_ = h.disconnectClient(client, ServerError)
+		return
+	}
+	channels := make(map[string]bool)
+	for _, channel := range userChannels {
+		channels[channel.ID.String()] = true
+	}
+
+	h.mu.Lock()
 	client.Identified = true
 	client.User = &userCopy
+	client.TokenID = claims.ID
+	client.Channels = channels
+	client.session = newSession(h.replayBufferSize)
+	if evt.Status.Settable() {
+		h.presenceOf(userCopy.ID.String()).chosen = evt.Status
+	}
+	h.mu.Unlock()
 	_ = h.dispatchEvent(ActionUserReady, client, nil)
 }
 
+// resumeClient moves a detached session over to the client and replays the
+// events it missed. If that is not possible, the client is told to identify
+// instead.
+func (h *Hub) resumeClient(client *Client, evt *ResumeData) {
+	if client.Identified {
+		return
+	}
+	claims, ok := h.authenticate(client, evt.Token)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	var old *Client
+	for _, c := range h.Clients {
+		if c.session != nil && c.session.id == evt.SessionID {
+			old = c
+			break
+		}
+	}
+	if old == nil || old.User.ID.String() != claims.Subject {
+		h.mu.Unlock()
+		h.send(client, &sendEvent{Operation: InvalidSession, Action: ActionNone})
+		return
+	}
+	if _, detached := old.session.detachedFor(); !detached {
+		h.mu.Unlock()
+		h.send(client, &sendEvent{Operation: InvalidSession, Action: ActionNone})
+		return
+	}
+	missed, ok := old.session.resume(evt.Sequence)
+	if !ok {
+		h.mu.Unlock()
+		h.dropClient(old)
+		h.send(client, &sendEvent{Operation: InvalidSession, Action: ActionNone})
+		return
+	}
+
+	for i, c := range h.Clients {
+		if c == old {
+			h.Clients = append(h.Clients[:i], h.Clients[i+1:]...)
+			break
+		}
+	}
+	client.Identified = true
+	client.User = old.User
+	client.TokenID = claims.ID
+	client.Channels = old.Channels
+	client.session = old.session
+	// the hub is locked while replaying, so nothing new is sent in between
+	for _, e := range missed {
+		if !client.enqueue(e) {
+			_ = h.disconnectClient(client, SlowConsumer)
+			break
+		}
+	}
+	h.mu.Unlock()
+
+	h.send(client, &sendEvent{Operation: Action, Action: ActionResumed})
+	h.updatePresence(client)
+}
+
 func (h *Hub) handlePing(client *Client, evt *PingData) {
+	h.mu.Lock()
+	client.LastPing = time.Now()
+	h.mu.Unlock()
+
+	h.send(client, &sendEvent{
+		Operation: PingACK,
+		Data:      &PingData{Sequence: evt.Sequence},
+		Action:    ActionNone,
+	})
+}
+
+// handleTyping shows the user of the client as typing to the other members
+// of the channel, until they stop renewing it or send a message.
+func (h *Hub) handleTyping(client *Client, evt *TypingData) {
+	if !client.Identified || time.Since(client.lastTyping) < minTypingInterval {
+		return
+	}
+	channelID := evt.ChannelID.String()
+	h.mu.Lock()
+	member := client.Channels[channelID]
+	user := client.User
+	h.mu.Unlock()
+	if !member {
+		return
+	}
+	client.lastTyping = time.Now()
+	h.markActive(client)
 
+	stop := &structs.TypingStop{ChannelID: evt.ChannelID, User: user}
+	started := h.typing.start(user.ID.String(), channelID, func() {
+		_ = h.dispatchEvent(ActionTypingStop, nil, stop)
+	})
+	if started {
+		_ = h.dispatchEvent(ActionTypingStart, nil, &structs.TypingStart{
+			ChannelID: evt.ChannelID,
+			User:      user,
+			Timestamp: client.lastTyping,
+		})
+	}
 }
 
 type DispatchEvent func(conn *Client, data interface{}) error
@@ -235,6 +656,34 @@ func (h *Hub) dispatchEvent(ac ActionCode, conn *Client, data interface{}) error
 		dpe = h.userLeave
 	case ActionUserMessage:
 		dpe = h.userMessage
+	case ActionMessageUpdate:
+		dpe = h.messageUpdate
+	case ActionMessageDelete:
+		dpe = h.messageDelete
+	case ActionTypingStart:
+		dpe = h.typingStart
+	case ActionTypingStop:
+		dpe = h.typingStop
+	case ActionPresenceUpdate:
+		dpe = h.presenceUpdate
+	case ActionReadStateUpdate:
+		dpe = h.readStateUpdate
+	case ActionUserUpdate:
+		dpe = h.userUpdate
+	case ActionReactionAdd:
+		dpe = h.reactionAdd
+	case ActionReactionRemove:
+		dpe = h.reactionRemove
+	case ActionChannelCreate:
+		dpe = h.channelCreate
+	case ActionChannelUpdate:
+		dpe = h.channelUpdate
+	case ActionChannelDelete:
+		dpe = h.channelDelete
+	case ActionChannelMemberAdd:
+		dpe = h.channelMemberAdd
+	case ActionChannelMemberRemove:
+		dpe = h.channelMemberRemove
 	}
 	err := dpe(conn, data)
 	if err != nil {
@@ -244,17 +693,110 @@ func (h *Hub) dispatchEvent(ac ActionCode, conn *Client, data interface{}) error
 }
 
 func (h *Hub) registerClient(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.Clients = append(h.Clients, client)
 }
 
+// removeClient is called when the connection of a client is gone. If the
+// client can resume later, its session is kept around until the resume
+// window is over.
 func (h *Hub) removeClient(client *Client) {
+	if client.Identified && client.session != nil && h.resumeWindow > 0 && resumable(client.closedWith()) {
+		client.session.detach()
+		return
+	}
+	h.dropClient(client)
+}
+
+// dropClient removes a client from the hub for good.
+func (h *Hub) dropClient(client *Client) {
+	h.mu.Lock()
 	for i, c := range h.Clients {
 		if c == client {
 			h.Clients = append(h.Clients[:i], h.Clients[i+1:]...)
 			break
 		}
 	}
-	h.dispatchEvent(ActionUserLeave, nil, client.User)
+	h.mu.Unlock()
+	if client.Identified {
+		for _, channelID := range h.typing.stopUser(client.User.ID.String()) {
+			_ = h.dispatchEvent(ActionTypingStop, nil, &structs.TypingStop{ChannelID: uuid.MustParse(channelID), User: client.User})
+		}
+		h.updatePresence(client)
+	}
+}
+
+// disconnectToken disconnects every client that identified with the access
+// token with the given ID.
+func (h *Hub) disconnectToken(tokenID string) {
+	if tokenID == "" {
+		return
+	}
+	h.disconnectFunc(TokenRevoked, func(client *Client) bool { return client.TokenID == tokenID })
+}
+
+// disconnectUser disconnects every client of a user, along with any of their
+// sessions waiting to be resumed.
+func (h *Hub) disconnectUser(userID string, code ErrorCode) {
+	h.disconnectFunc(code, func(client *Client) bool { return client.User.ID.String() == userID })
+}
+
+// disconnectFunc disconnects every identified client for which include
+// returns true, with the error for code. Detached sessions are dropped.
+func (h *Hub) disconnectFunc(code ErrorCode, include func(client *Client) bool) {
+	h.mu.Lock()
+	var clients []*Client
+	for _, client := range h.Clients {
+		if client.Identified && include(client) {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		if _, detached := client.session.detachedFor(); detached {
+			h.dropClient(client)
+			continue
+		}
+		_ = h.disconnectClient(client, code)
+	}
+}
+
+// subscribe makes every client of a user receive events from a channel.
+func (h *Hub) subscribe(userID, channelID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, client := range h.Clients {
+		if client.Identified && client.User.ID.String() == userID {
+			client.Channels[channelID] = true
+		}
+	}
+}
+
+// unsubscribe stops every client of a user from receiving events from a
+// channel. An empty userID unsubscribes every client.
+func (h *Hub) unsubscribe(userID, channelID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, client := range h.Clients {
+		if client.Identified && (userID == "" || client.User.ID.String() == userID) {
+			delete(client.Channels, channelID)
+		}
+	}
+}
+
+// resumable reports whether a client disconnected with data may resume its
+// session. Clients that were let go on purpose may not.
+func resumable(data *ErrorData) bool {
+	if data == nil {
+		return true
+	}
+	switch data.Code {
+	case PingTimedOut, SlowConsumer:
+		return true
+	}
+	return false
 }
 
 func getError(code ErrorCode) (error, error) {
@@ -263,64 +805,174 @@ func getError(code ErrorCode) (error, error) {
 		return ErrPingTimedOut, nil
 	case AuthFailed:
 		return ErrAuthFailed, nil
+	case TokenRevoked:
+		return ErrTokenRevoked, nil
+	case SlowConsumer:
+		return ErrSlowConsumer, nil
+	case ServerError:
+		return ErrServerError, nil
+	case Kicked:
+		return ErrKicked, nil
+	case Banned:
+		return ErrBanned, nil
+	case RateLimited:
+		return ErrRateLimited, nil
 	}
 	return nil, ErrNoSuchError
 }
 
+// disconnectClient sends the error for code to the client and closes its
+// connection. It does not wait for either to happen.
 func (h *Hub) disconnectClient(client *Client, code ErrorCode) error {
-	defer func(client *Client) {
-		_ = client.Conn.Close()
-	}(client)
-
 	msgErr, err := getError(code)
 	if err != nil {
+		client.close(nil)
 		return err
 	}
 
-	data := &sendEvent{
-		Operation: Error,
-		Data:      &ErrorData{Code: code, Message: msgErr.Error()},
-		Action:    ActionNone,
-	}
+	client.close(&ErrorData{Code: code, Message: msgErr.Error()})
+	return nil
+}
 
-	return client.Conn.WriteJSON(data)
+// send queues msg for the client. If the queue is full, the client is
+// either disconnected or misses the event, depending on the policy. Action
+// events are numbered and kept by the session of the client, if it has one.
+func (h *Hub) send(client *Client, msg *sendEvent) {
+	if client.session != nil && msg.Operation == Action {
+		var attached bool
+		msg, attached = client.session.sequence(msg)
+		if !attached {
+			return
+		}
+	}
+	if client.enqueue(msg) {
+		return
+	}
+	if h.slowClientPolicy == DisconnectSlowClients {
+		_ = h.disconnectClient(client, SlowConsumer)
+	}
 }
 
-func (h *Hub) broadcast(msg interface{}) error {
-	// TODO: add subscription policy
+// broadcastFunc sends msg to every identified client for which include
+// returns true.
+func (h *Hub) broadcastFunc(msg *sendEvent, include func(client *Client) bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	for _, client := range h.Clients {
-		/*
-			if time.Since(client.LastPing) > time.Second*15 {
-				h.disconnectClient(client, PingTimedOut)
-			}
-		*/
-		if client.Identified {
-			_ = client.Conn.WriteJSON(msg)
+		if client.Identified && include(client) {
+			h.send(client, msg)
 		}
 	}
 	return nil
 }
 
+// broadcast sends msg to every identified client
+func (h *Hub) broadcast(msg *sendEvent) error {
+	return h.broadcastFunc(msg, func(*Client) bool { return true })
+}
+
+// broadcastChannel sends msg to the clients subscribed to a channel
+func (h *Hub) broadcastChannel(channelID string, msg *sendEvent) error {
+	return h.broadcastFunc(msg, func(client *Client) bool { return client.Channels[channelID] })
+}
+
+// broadcastOthers sends msg to the clients subscribed to a channel, except
+// for those of the given user
+func (h *Hub) broadcastOthers(channelID string, user *structs.User, msg *sendEvent) error {
+	return h.broadcastFunc(msg, func(client *Client) bool {
+		return client.Channels[channelID] && client.User.ID != user.ID
+	})
+}
+
+// broadcastShared sends msg to the clients of other users that share a
+// channel with c
+func (h *Hub) broadcastShared(c *Client, msg *sendEvent) error {
+	return h.broadcastFunc(msg, func(client *Client) bool {
+		return client.User.ID != c.User.ID && client.sharesChannel(c.Channels)
+	})
+}
+
 func (h *Hub) userReady(c *Client, _ interface{}) error {
-	msgs := h.db.GetRecentMessages(50)
-	users := make([]*structs.User, 0)
-	for _, client := range h.Clients {
-		if client.Identified && client != c {
-			users = append(users, client.User)
+	h.mu.Lock()
+	channelIDs := make([]string, 0, len(c.Channels))
+	for id := range c.Channels {
+		channelIDs = append(channelIDs, id)
+	}
+	users, presences := h.sharedPresences(c)
+	status := h.currentStatus(c.User.ID.String())
+	h.mu.Unlock()
+
+	readStates, err := h.db.GetReadStates(c.ctx, c.User.ID.String())
+	if err != nil {
+		_ = h.disconnectClient(c, ServerError)
+		return err
+	}
+	lastRead := make(map[string]time.Time)
+	for _, state := range readStates {
+		lastRead[state.ChannelID.String()] = state.Timestamp
+	}
+
+	channels := make([]*structs.Channel, 0, len(channelIDs))
+	msgs := make([]*structs.Message, 0)
+	unread := make([]*structs.UnreadCount, 0, len(channelIDs))
+	for _, id := range channelIDs {
+		channel, recent, count, err := h.loadChannel(c.ctx, id, c.User, lastRead[id])
+		if errors.Is(err, database.ErrNotFound) {
+			continue
+		} else if err != nil {
+			_ = h.disconnectClient(c, ServerError)
+			return err
 		}
+		channels = append(channels, channel)
+		msgs = append(msgs, h.signMessages(recent)...)
+		unread = append(unread, count)
 	}
 
 	data := &sendEvent{
 		Operation: Action,
-		Data:      &structs.UserReady{msgs, users},
-		Action:    ActionUserReady,
+		Data: &structs.UserReady{
+			SessionID:  c.session.id,
+			Channels:   channels,
+			Messages:   msgs,
+			Users:      users,
+			Presences:  presences,
+			Status:     status,
+			ReadStates: readStates,
+			Unread:     unread,
+		},
+		Action: ActionUserReady,
 	}
-	_ = c.Conn.WriteJSON(data)
-	_ = h.dispatchEvent(ActionUserJoin, nil, c.User)
+	h.send(c, data)
+	h.updatePresence(c)
 	return nil
 }
 
-func (h *Hub) userJoin(_ *Client, data interface{}) error {
+// loadChannel returns a channel for the ready event of a user, along with its
+// most recent messages and how many of the messages sent after lastRead are
+// unread.
+func (h *Hub) loadChannel(ctx context.Context, id string, user *structs.User, lastRead time.Time) (*structs.Channel, []*structs.Message, *structs.UnreadCount, error) {
+	channel, err := h.db.FindChannelByID(ctx, id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	recent, err := h.db.GetRecentMessages(ctx, id, 50)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	count, mentions, err := h.db.CountMessagesAfter(ctx, id, user.ID.String(), lastRead, mentionOf(user))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return channel, recent, &structs.UnreadCount{ChannelID: channel.ID, Count: count, Mentions: mentions}, nil
+}
+
+// mentionOf returns how a user is mentioned in messages, which search.Mentions
+// only finds as a word of its own.
+func mentionOf(user *structs.User) string {
+	return "@" + user.Username
+}
+
+func (h *Hub) userJoin(c *Client, data interface{}) error {
 	d, ok := data.(*structs.User)
 	if !ok {
 		return ErrInvalidData
@@ -328,13 +980,27 @@ func (h *Hub) userJoin(_ *Client, data interface{}) error {
 
 	d2 := &sendEvent{
 		Operation: Action,
-		Data:      &structs.UserJoin{d},
+		Data:      &structs.UserJoin{User: d},
 		Action:    ActionUserJoin,
 	}
-	return h.broadcast(d2)
+	return h.broadcastShared(c, d2)
 }
 
-func (h *Hub) userLeave(_ *Client, data interface{}) error {
+func (h *Hub) presenceUpdate(c *Client, data interface{}) error {
+	d, ok := data.(*structs.PresenceUpdate)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionPresenceUpdate,
+	}
+	return h.broadcastShared(c, d2)
+}
+
+func (h *Hub) userLeave(c *Client, data interface{}) error {
 	d, ok := data.(*structs.User)
 	if !ok {
 		return ErrInvalidData
@@ -342,10 +1008,10 @@ func (h *Hub) userLeave(_ *Client, data interface{}) error {
 
 	d2 := &sendEvent{
 		Operation: Action,
-		Data:      &structs.UserLeave{d},
+		Data:      &structs.UserLeave{User: d},
 		Action:    ActionUserLeave,
 	}
-	return h.broadcast(d2)
+	return h.broadcastShared(c, d2)
 }
 
 func (h *Hub) userMessage(_ *Client, data interface{}) error {
@@ -356,8 +1022,243 @@ func (h *Hub) userMessage(_ *Client, data interface{}) error {
 
 	d2 := &sendEvent{
 		Operation: Action,
-		Data:      &structs.UserMessage{d},
+		Data:      &structs.UserMessage{Message: d},
 		Action:    ActionUserMessage,
 	}
+	if err := h.broadcastChannel(d.ChannelID.String(), d2); err != nil {
+		return err
+	}
+	if d.Author != nil {
+		h.markUserActive(d.Author)
+	}
+
+	// sending a message is the end of typing it
+	if d.Author != nil && h.typing.stop(d.Author.ID.String(), d.ChannelID.String()) {
+		return h.typingStop(nil, &structs.TypingStop{ChannelID: d.ChannelID, User: d.Author})
+	}
+	return nil
+}
+
+func (h *Hub) messageUpdate(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.Message)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      &structs.MessageUpdate{Message: d},
+		Action:    ActionMessageUpdate,
+	}
+	return h.broadcastChannel(d.ChannelID.String(), d2)
+}
+
+func (h *Hub) messageDelete(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.MessageDelete)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionMessageDelete,
+	}
+	return h.broadcastChannel(d.ChannelID.String(), d2)
+}
+
+func (h *Hub) typingStart(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.TypingStart)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionTypingStart,
+	}
+	return h.broadcastOthers(d.ChannelID.String(), d.User, d2)
+}
+
+func (h *Hub) typingStop(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.TypingStop)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionTypingStop,
+	}
+	return h.broadcastOthers(d.ChannelID.String(), d.User, d2)
+}
+
+// userUpdate tells everyone about the change to a user, and gives the clients
+// of the user the change as well.
+func (h *Hub) userUpdate(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.User)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	h.mu.Lock()
+	for _, client := range h.Clients {
+		if client.Identified && client.User.ID == d.ID {
+			client.User = d
+		}
+	}
+	h.mu.Unlock()
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      &structs.UserUpdate{User: d},
+		Action:    ActionUserUpdate,
+	}
 	return h.broadcast(d2)
 }
+
+func (h *Hub) readStateUpdate(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.ReadState)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      &structs.ReadStateUpdate{ReadState: d},
+		Action:    ActionReadStateUpdate,
+	}
+	// read states are only of interest to the sessions of their own user
+	return h.broadcastFunc(d2, func(client *Client) bool { return client.User.ID == d.UserID })
+}
+
+func (h *Hub) reactionAdd(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.ReactionAdd)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionReactionAdd,
+	}
+	return h.broadcastChannel(d.ChannelID.String(), d2)
+}
+
+func (h *Hub) reactionRemove(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.ReactionRemove)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionReactionRemove,
+	}
+	return h.broadcastChannel(d.ChannelID.String(), d2)
+}
+
+func (h *Hub) channelCreate(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.Channel)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	if !d.Private() {
+		d2 := &sendEvent{
+			Operation: Action,
+			Data:      &structs.ChannelCreate{Channel: d},
+			Action:    ActionChannelCreate,
+		}
+		return h.broadcast(d2)
+	}
+
+	// private conversations only ever reach the sessions of their members
+	members, err := h.db.GetChannelMembers(context.Background(), d.ID.String())
+	if err != nil {
+		return err
+	}
+	recipients := withoutPasswords(members)
+	for _, u := range recipients {
+		h.subscribe(u.ID.String(), d.ID.String())
+	}
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      &structs.ChannelCreate{Channel: d, Recipients: recipients},
+		Action:    ActionChannelCreate,
+	}
+	return h.broadcastChannel(d.ID.String(), d2)
+}
+
+func (h *Hub) channelUpdate(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.Channel)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      &structs.ChannelUpdate{Channel: d},
+		Action:    ActionChannelUpdate,
+	}
+	if d.Private() {
+		return h.broadcastChannel(d.ID.String(), d2)
+	}
+	return h.broadcast(d2)
+}
+
+func (h *Hub) channelDelete(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.Channel)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      &structs.ChannelDelete{ChannelID: d.ID},
+		Action:    ActionChannelDelete,
+	}
+	var err error
+	if d.Private() {
+		err = h.broadcastChannel(d.ID.String(), d2)
+	} else {
+		err = h.broadcast(d2)
+	}
+	h.unsubscribe("", d.ID.String())
+	return err
+}
+
+func (h *Hub) channelMemberAdd(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.ChannelMemberAdd)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	h.subscribe(d.User.ID.String(), d.ChannelID.String())
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionChannelMemberAdd,
+	}
+	return h.broadcastChannel(d.ChannelID.String(), d2)
+}
+
+func (h *Hub) channelMemberRemove(_ *Client, data interface{}) error {
+	d, ok := data.(*structs.ChannelMemberRemove)
+	if !ok {
+		return ErrInvalidData
+	}
+
+	d2 := &sendEvent{
+		Operation: Action,
+		Data:      d,
+		Action:    ActionChannelMemberRemove,
+	}
+	err := h.broadcastChannel(d.ChannelID.String(), d2)
+	h.unsubscribe(d.User.ID.String(), d.ChannelID.String())
+	return err
+}
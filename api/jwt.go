@@ -1,66 +1,204 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"github.com/intrntsrfr/vue-ws-test/structs"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+var (
+	ErrTokenRevoked = errors.New("token has been revoked")
+	// ErrInvalidToken is returned for tokens that can not be parsed, are not
+	// signed by us or have expired.
+	ErrInvalidToken = errors.New("invalid token")
 )
 
 type JWTService interface {
-	ParseToken(token string) (jwt.Claims, error)
-	GenerateToken(user *structs.User) (string, error)
+	ParseToken(ctx context.Context, token string) (jwt.Claims, error)
+	GenerateToken(ctx context.Context, user *structs.User) (string, error)
+	// GenerateRefreshToken returns a new refresh token for a user, along with
+	// what should be stored to recognise it later.
+	GenerateRefreshToken(user *structs.User) (string, *structs.RefreshToken, error)
+	// RevokeToken stops the access token with the given claims from being
+	// accepted, even if it has not expired yet.
+	RevokeToken(ctx context.Context, claims *UserClaims) error
+	// RevokeUserTokens stops every access token issued to a user so far from
+	// being accepted.
+	RevokeUserTokens(ctx context.Context, userID string) error
 	IsAuthorized() gin.HandlerFunc
 }
 
+// RevocationList keeps track of access tokens that are revoked before they
+// expire. Entries only need to be kept until then.
+type RevocationList interface {
+	RevokeToken(ctx context.Context, id string, expires time.Time) error
+	IsTokenRevoked(ctx context.Context, id string) (bool, error)
+	// RevokeUserTokens revokes the tokens of a user issued so far, by moving
+	// the version their tokens have to carry up by one.
+	RevokeUserTokens(ctx context.Context, userID string) error
+	UserTokenVersion(ctx context.Context, userID string) (int, error)
+}
+
+const (
+	DefaultAccessTokenTTL  = time.Minute * 15
+	DefaultRefreshTokenTTL = time.Hour * 24 * 30
+)
+
+type JWTConfig struct {
+	Key             []byte
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	Revocations     RevocationList
+}
+
 type JWTUtil struct {
-	key []byte
+	key         []byte
+	accessTTL   time.Duration
+	refreshTTL  time.Duration
+	revocations RevocationList
 }
 
-func NewJWTUtil(key []byte) *JWTUtil {
-	return &JWTUtil{key}
+func NewJWTUtil(conf *JWTConfig) *JWTUtil {
+	j := &JWTUtil{
+		key:         conf.Key,
+		accessTTL:   conf.AccessTokenTTL,
+		refreshTTL:  conf.RefreshTokenTTL,
+		revocations: conf.Revocations,
+	}
+	if j.accessTTL <= 0 {
+		j.accessTTL = DefaultAccessTokenTTL
+	}
+	if j.refreshTTL <= 0 {
+		j.refreshTTL = DefaultRefreshTokenTTL
+	}
+	return j
 }
 
 type UserClaims struct {
 	jwt.RegisteredClaims
 	Username string `json:"username"`
+	// Version is the token version of the user when the token was issued.
+	// Tokens from before the latest version are revoked.
+	Version int `json:"ver,omitempty"`
 }
 
-func (j *JWTUtil) ParseToken(tokenStr string) (jwt.Claims, error) {
+func (j *JWTUtil) ParseToken(ctx context.Context, tokenStr string) (jwt.Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return j.key, nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
 	}
 
 	if !token.Valid {
-		return nil, errors.New("invalid token")
+		return nil, ErrInvalidToken
+	}
+
+	if revoked, err := j.isRevoked(ctx, token.Claims); err != nil {
+		return nil, err
+	} else if revoked {
+		return nil, ErrTokenRevoked
 	}
 
 	return token.Claims, nil
 }
 
-func (j *JWTUtil) GenerateToken(user *structs.User) (string, error) {
+func (j *JWTUtil) GenerateToken(ctx context.Context, user *structs.User) (string, error) {
+	version := 0
+	if j.revocations != nil {
+		v, err := j.revocations.UserTokenVersion(ctx, user.ID.String())
+		if err != nil {
+			return "", err
+		}
+		version = v
+	}
+
 	tkn := jwt.New(jwt.SigningMethodHS256)
 	claims := UserClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			Issuer:    "ws-test",
 			Subject:   user.ID.String(),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24 * 3)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(j.accessTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 		Username: user.Username,
+		Version:  version,
 	}
 
 	tkn.Claims = claims
 	return tkn.SignedString(j.key)
 }
 
+func (j *JWTUtil) GenerateRefreshToken(user *structs.User) (string, *structs.RefreshToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	return token, &structs.RefreshToken{
+		Hash:    HashRefreshToken(token),
+		UserID:  user.ID,
+		Created: time.Now(),
+		Expires: time.Now().Add(j.refreshTTL),
+	}, nil
+}
+
+// HashRefreshToken returns what refresh tokens are stored and looked up as,
+// so that a leaked database does not leak usable tokens.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (j *JWTUtil) RevokeToken(ctx context.Context, claims *UserClaims) error {
+	if j.revocations == nil || claims.ID == "" {
+		return nil
+	}
+	expires := time.Now().Add(j.accessTTL)
+	if claims.ExpiresAt != nil {
+		expires = claims.ExpiresAt.Time
+	}
+	return j.revocations.RevokeToken(ctx, claims.ID, expires)
+}
+
+func (j *JWTUtil) RevokeUserTokens(ctx context.Context, userID string) error {
+	if j.revocations == nil {
+		return nil
+	}
+	return j.revocations.RevokeUserTokens(ctx, userID)
+}
+
+func (j *JWTUtil) isRevoked(ctx context.Context, claims jwt.Claims) (bool, error) {
+	c, ok := claims.(*UserClaims)
+	if !ok || j.revocations == nil {
+		return false, nil
+	}
+	if c.ID != "" {
+		if revoked, err := j.revocations.IsTokenRevoked(ctx, c.ID); err != nil || revoked {
+			return revoked, err
+		}
+	}
+	version, err := j.revocations.UserTokenVersion(ctx, c.Subject)
+	if err != nil {
+		return false, err
+	}
+	return c.Version < version, nil
+}
+
 func (j *JWTUtil) IsAuthorized() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth := c.GetHeader("Authorization")
@@ -72,7 +210,11 @@ func (j *JWTUtil) IsAuthorized() gin.HandlerFunc {
 		token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(t *jwt.Token) (interface{}, error) {
 			return j.key, nil
 		})
-		if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			// lets clients know it is time to use their refresh token
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "token expired"})
+			return
+		} else if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "mangled token"})
 			return
 		}
@@ -80,6 +222,13 @@ func (j *JWTUtil) IsAuthorized() gin.HandlerFunc {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid token"})
 			return
 		}
+		if revoked, err := j.isRevoked(c.Request.Context(), token.Claims); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "internal server error"})
+			return
+		} else if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid token"})
+			return
+		}
 
 		c.Set("claims", token.Claims)
 		c.Next()
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PasswordService interface {
+	Hash(password string) (string, error)
+	// Verify reports whether password matches hash, in constant time.
+	Verify(hash, password string) bool
+	// NeedsRehash reports whether hash was made with other parameters than
+	// the current ones, or is not hashed at all.
+	NeedsRehash(hash string) bool
+}
+
+// DefaultBcryptCost is used when no cost is configured.
+const DefaultBcryptCost = 12
+
+type PasswordUtil struct {
+	cost      int
+	dummyHash []byte
+}
+
+// NewPasswordUtil returns a PasswordUtil hashing with the given bcrypt cost.
+// Costs outside the range bcrypt supports are an error.
+func NewPasswordUtil(cost int) (*PasswordUtil, error) {
+	if cost == 0 {
+		cost = DefaultBcryptCost
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	// the dummy hash is compared against when there is nothing to compare,
+	// so that failing early does not take less time than failing late
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy password"), cost)
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordUtil{cost, dummy}, nil
+}
+
+func (p *PasswordUtil) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), p.cost)
+	return string(hash), err
+}
+
+func (p *PasswordUtil) Verify(hash, password string) bool {
+	if hash == "" {
+		_ = bcrypt.CompareHashAndPassword(p.dummyHash, []byte(password))
+		return false
+	}
+	if !isBcryptHash(hash) {
+		// passwords stored before hashing was introduced
+		_ = bcrypt.CompareHashAndPassword(p.dummyHash, []byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (p *PasswordUtil) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != p.cost
+}
+
+func isBcryptHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// CredentialPolicy decides which usernames and passwords are accepted when
+// registering.
+type CredentialPolicy struct {
+	MinUsernameLength int  `json:"min_username_length"`
+	MaxUsernameLength int  `json:"max_username_length"`
+	MinPasswordLength int  `json:"min_password_length"`
+	MaxPasswordLength int  `json:"max_password_length"`
+	RequireLetter     bool `json:"require_letter"`
+	RequireDigit      bool `json:"require_digit"`
+}
+
+// maxBcryptLength is the number of bytes bcrypt looks at, anything past it
+// is ignored.
+const maxBcryptLength = 72
+
+// DefaultCredentialPolicy returns the policy used when none is configured.
+func DefaultCredentialPolicy() *CredentialPolicy {
+	return &CredentialPolicy{
+		MinUsernameLength: 3,
+		MaxUsernameLength: 32,
+		MinPasswordLength: 8,
+		MaxPasswordLength: maxBcryptLength,
+		RequireLetter:     true,
+		RequireDigit:      true,
+	}
+}
+
+var (
+	ErrUsernameLength  = errors.New("username has the wrong length")
+	ErrUsernameInvalid = errors.New("username may only contain letters, digits, '.', '-' and '_'")
+	ErrPasswordLength  = errors.New("password has the wrong length")
+	ErrPasswordLetter  = errors.New("password must contain a letter")
+	ErrPasswordDigit   = errors.New("password must contain a digit")
+)
+
+// ValidateUsername returns an error describing why the username is not
+// allowed, or nil if it is.
+func (p *CredentialPolicy) ValidateUsername(username string) error {
+	n := utf8.RuneCountInString(username)
+	if n < p.MinUsernameLength || n > p.MaxUsernameLength {
+		return fmt.Errorf("%w: it must be between %v and %v characters", ErrUsernameLength, p.MinUsernameLength, p.MaxUsernameLength)
+	}
+	valid := strings.IndexFunc(username, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(".-_", r)
+	}) == -1
+	if !valid {
+		return ErrUsernameInvalid
+	}
+	return nil
+}
+
+// ValidatePassword returns an error describing why the password is not
+// allowed, or nil if it is. The maximum length is never above what bcrypt
+// can hash.
+func (p *CredentialPolicy) ValidatePassword(password string) error {
+	max := p.MaxPasswordLength
+	if max <= 0 || max > maxBcryptLength {
+		max = maxBcryptLength
+	}
+	n := utf8.RuneCountInString(password)
+	if n < p.MinPasswordLength || len(password) > max {
+		return fmt.Errorf("%w: it must be at least %v characters and at most %v bytes", ErrPasswordLength, p.MinPasswordLength, max)
+	}
+	if p.RequireLetter && strings.IndexFunc(password, unicode.IsLetter) == -1 {
+		return ErrPasswordLetter
+	}
+	if p.RequireDigit && strings.IndexFunc(password, unicode.IsDigit) == -1 {
+		return ErrPasswordDigit
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordUtil(t *testing.T) {
+	p, err := NewPasswordUtil(bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+
+	hash, err := p.Hash("hunter22")
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	if !p.Verify(hash, "hunter22") || p.Verify(hash, "hunter23") {
+		t.Errorf("Verify() did not match only the right password")
+	}
+	if p.NeedsRehash(hash) {
+		t.Errorf("NeedsRehash() got true for a fresh hash")
+	}
+
+	// plain text passwords from before hashing still work, but need a rehash
+	if !p.Verify("hunter22", "hunter22") || !p.NeedsRehash("hunter22") {
+		t.Errorf("plain text password was not accepted and flagged for rehash")
+	}
+	if p.Verify("", "") {
+		t.Errorf("Verify() accepted an empty hash")
+	}
+
+	other, _ := NewPasswordUtil(bcrypt.MinCost + 1)
+	if !other.NeedsRehash(hash) {
+		t.Errorf("NeedsRehash() got false after the cost changed")
+	}
+}
+
+func TestCredentialPolicy(t *testing.T) {
+	p := DefaultCredentialPolicy()
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     error
+	}{
+		{"valid", "jeff_92", "hunter22", nil},
+		{"short username", "je", "hunter22", ErrUsernameLength},
+		{"bad username", "jeff bob", "hunter22", ErrUsernameInvalid},
+		{"short password", "jeff", "hunt2", ErrPasswordLength},
+		{"long password", "jeff", string(make([]byte, 73)), ErrPasswordLength},
+		{"no digit", "jeff", "hunterhunter", ErrPasswordDigit},
+		{"no letter", "jeff", "1234567890", ErrPasswordLetter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.ValidateUsername(tt.username)
+			if err == nil {
+				err = p.ValidatePassword(tt.password)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Package ratelimit limits how often something can be done, using a token
+// bucket for each key such as a user or an address.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have filled up again are thrown
+// away, since they are no different from new ones.
+const sweepInterval = time.Minute
+
+// Limit allows Burst requests at once, after which one more is allowed every
+// Interval.
+type Limit struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// Valid reports whether the limit allows anything at all. Limits that do not
+// are taken to mean no limit.
+func (l Limit) Valid() bool {
+	return l.Burst > 0 && l.Interval > 0
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a bucket of tokens for each key, which requests take from.
+// It is safe to use from several goroutines.
+type Limiter struct {
+	limit Limit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewLimiter returns a Limiter that allows each key as much as limit does.
+func NewLimiter(limit Limit) *Limiter {
+	return &Limiter{
+		limit:   limit,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Limit returns the limit the Limiter was made with.
+func (l *Limiter) Limit() Limit {
+	return l.limit
+}
+
+// Allow takes a token from the bucket of key. If there is none left, it
+// reports false along with how long it takes for the next one.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if !l.limit.Valid() {
+		return true, 0
+	}
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lastSweep.IsZero() {
+		l.lastSweep = now
+	} else if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(l.limit.Interval))
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(l.limit.Interval)
+		if b.tokens > float64(l.limit.Burst) {
+			b.tokens = float64(l.limit.Burst)
+		}
+		b.last = now
+	}
+}
+
+// sweep throws away the buckets that are full again.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
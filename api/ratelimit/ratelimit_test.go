@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(Limit{Burst: 3, Interval: time.Second})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("jeff"); !ok {
+			t.Fatalf("request %v within the burst got limited", i)
+		}
+	}
+	if ok, wait := l.Allow("jeff"); ok || wait != time.Second {
+		t.Errorf("request after the burst got %v, %v, wanted false, %v", ok, wait, time.Second)
+	}
+	if ok, _ := l.Allow("bob"); !ok {
+		t.Errorf("request with another key got limited")
+	}
+
+	now = now.Add(time.Millisecond * 1500)
+	if ok, _ := l.Allow("jeff"); !ok {
+		t.Errorf("request after a refill got limited")
+	}
+	if ok, wait := l.Allow("jeff"); ok || wait != time.Millisecond*500 {
+		t.Errorf("request after using the refill got %v, %v, wanted false, %v", ok, wait, time.Millisecond*500)
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(Limit{Burst: 2, Interval: time.Minute})
+	l.now = func() time.Time { return now }
+
+	_, _ = l.Allow("jeff")
+	_, _ = l.Allow("bob")
+	_, _ = l.Allow("bob")
+	now = now.Add(sweepInterval)
+	_, _ = l.Allow("alice")
+
+	if _, ok := l.buckets["jeff"]; ok {
+		t.Errorf("full bucket was kept after a sweep")
+	}
+	if b, ok := l.buckets["bob"]; !ok || b.tokens != 1 {
+		t.Errorf("bucket that is not full got %v, wanted it kept with 1 token", b)
+	}
+}
+
+func TestLimiter_NoLimit(t *testing.T) {
+	l := NewLimiter(Limit{})
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("jeff"); !ok {
+			t.Fatalf("request %v got limited without a limit", i)
+		}
+	}
+}
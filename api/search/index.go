@@ -0,0 +1,192 @@
+// Package search keeps an inverted index of messages, so that they can be
+// found by the words in them.
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// Query is what to look for. Messages have to contain every term, and match
+// every other field that is set.
+type Query struct {
+	Terms    []string
+	AuthorID string
+	// ChannelIDs limits the search to the given channels. Callers use it to
+	// leave out the channels a user can not see, so it is always set.
+	ChannelIDs []string
+	// After and Before limit when the messages were sent, if they are set
+	After  time.Time
+	Before time.Time
+	Offset int
+	Limit  int
+}
+
+// document is what the index knows about a message.
+type document struct {
+	channelID string
+	authorID  string
+	timestamp time.Time
+	terms     []string
+}
+
+// Index maps the terms in messages to the messages they are in. It is safe to
+// use from several goroutines.
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]bool
+	docs     map[string]*document
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[string]bool),
+		docs:     make(map[string]*document),
+	}
+}
+
+// Tokenize splits text into the terms it is indexed and searched by, which
+// are its runs of letters and digits, lowercased.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Add indexes a message, replacing what was indexed for it before.
+func (i *Index) Add(msg *structs.Message) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	id := msg.ID.String()
+	i.remove(id)
+
+	doc := &document{
+		channelID: msg.ChannelID.String(),
+		timestamp: msg.Timestamp,
+	}
+	if msg.Author != nil {
+		doc.authorID = msg.Author.ID.String()
+	}
+	seen := make(map[string]bool)
+	for _, term := range Tokenize(msg.Content) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		doc.terms = append(doc.terms, term)
+		if i.postings[term] == nil {
+			i.postings[term] = make(map[string]bool)
+		}
+		i.postings[term][id] = true
+	}
+	i.docs[id] = doc
+}
+
+// Remove takes a message out of the index.
+func (i *Index) Remove(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remove(id)
+}
+
+// RemoveChannel takes every message in a channel out of the index.
+func (i *Index) RemoveChannel(channelID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for id, doc := range i.docs {
+		if doc.channelID == channelID {
+			i.remove(id)
+		}
+	}
+}
+
+// remove takes a message out of the index. The index must be locked.
+func (i *Index) remove(id string) {
+	doc, ok := i.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(i.postings[term], id)
+		if len(i.postings[term]) == 0 {
+			delete(i.postings, term)
+		}
+	}
+	delete(i.docs, id)
+}
+
+// Search returns the IDs of a page of the messages matching q, newest first,
+// along with how many match in total.
+func (i *Index) Search(q *Query) (ids []string, total int) {
+	var terms []string
+	for _, term := range q.Terms {
+		terms = append(terms, Tokenize(term)...)
+	}
+	if len(terms) == 0 {
+		return []string{}, 0
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	// start from the rarest term, so there is as little to intersect as
+	// possible
+	sort.Slice(terms, func(a, b int) bool { return len(i.postings[terms[a]]) < len(i.postings[terms[b]]) })
+	channels := make(map[string]bool, len(q.ChannelIDs))
+	for _, id := range q.ChannelIDs {
+		channels[id] = true
+	}
+
+	var matches []string
+candidates:
+	for id := range i.postings[terms[0]] {
+		for _, term := range terms[1:] {
+			if !i.postings[term][id] {
+				continue candidates
+			}
+		}
+		if i.matches(i.docs[id], q, channels) {
+			matches = append(matches, id)
+		}
+	}
+
+	sort.Slice(matches, func(a, b int) bool {
+		ta, tb := i.docs[matches[a]].timestamp, i.docs[matches[b]].timestamp
+		if ta.Equal(tb) {
+			return matches[a] > matches[b]
+		}
+		return ta.After(tb)
+	})
+
+	total = len(matches)
+	if q.Offset >= total {
+		return []string{}, total
+	}
+	matches = matches[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matches) {
+		matches = matches[:q.Limit]
+	}
+	return matches, total
+}
+
+// matches reports whether a document fits everything in q but the terms.
+func (i *Index) matches(doc *document, q *Query, channels map[string]bool) bool {
+	if !channels[doc.channelID] {
+		return false
+	}
+	if q.AuthorID != "" && doc.authorID != q.AuthorID {
+		return false
+	}
+	if !q.After.IsZero() && !doc.timestamp.After(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !doc.timestamp.Before(q.Before) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"  ", nil},
+		{"it's v2.0", []string{"it", "s", "v2", "0"}},
+		{"Grüße @jeff", []string{"grüße", "jeff"}},
+	}
+	for _, tt := range tests {
+		if got := Tokenize(tt.text); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Tokenize(%q) got %q, wanted %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	index := NewIndex()
+	channel := uuid.New()
+	msg := &structs.Message{ID: uuid.New(), ChannelID: channel, Content: "hello hello world", Timestamp: time.Now()}
+	index.Add(msg)
+
+	query := &Query{Terms: []string{"Hello"}, ChannelIDs: []string{channel.String()}}
+	if got, total := index.Search(query); total != 1 || len(got) != 1 || got[0] != msg.ID.String() {
+		t.Errorf("Search() got (%v, %v), wanted the message", got, total)
+	}
+	if got, total := index.Search(&Query{Terms: []string{"hello"}}); total != 0 {
+		t.Errorf("Search() without channels got %v, wanted nothing", got)
+	}
+	if got, total := index.Search(&Query{Terms: []string{"!?"}, ChannelIDs: query.ChannelIDs}); total != 0 {
+		t.Errorf("Search() without terms got %v, wanted nothing", got)
+	}
+
+	msg.Content = "goodbye"
+	index.Add(msg)
+	if got, total := index.Search(query); total != 0 {
+		t.Errorf("Search() for replaced content got %v, wanted nothing", got)
+	}
+	index.Remove(msg.ID.String())
+	if len(index.postings) != 0 || len(index.docs) != 0 {
+		t.Errorf("Remove() left %v terms and %v documents, wanted none", len(index.postings), len(index.docs))
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("lorem ipsum ", 10)
+	tests := []struct {
+		content string
+		terms   []string
+		want    string
+	}{
+		{"the build is broken", []string{"BUILD"}, "the [build] is broken"},
+		{"build it, then build again", []string{"build"}, "[build] it, then [build] again"},
+		{"rebuild nothing", []string{"build"}, "rebuild nothing"},
+		{long + "needle " + long, []string{"needle"}, "…" + long[len(long)-60:] + "[needle] " + long[:59] + "…"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		for _, part := range Snippet(tt.content, tt.terms) {
+			if part.Highlight {
+				b.WriteString("[" + part.Text + "]")
+			} else {
+				b.WriteString(part.Text)
+			}
+		}
+		if got := b.String(); got != tt.want {
+			t.Errorf("Snippet(%q) got %q, wanted %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"hey @jeff", true},
+		{"@jeff, look", true},
+		{"thanks @jeff.", true},
+		{"(@jeff)", true},
+		{"hey @jeffrey", false},
+		{"@jeff_bot said", false},
+		{"@jeff.smith said", false},
+		{"mail bob@jeff.com", false},
+		{"@jeffrey and @jeff", true},
+		{"hey jeff", false},
+	}
+	for _, tt := range tests {
+		if got := Mentions(tt.content, "@jeff"); got != tt.want {
+			t.Errorf("Mentions(%q) got %v, wanted %v", tt.content, got, tt.want)
+		}
+	}
+}
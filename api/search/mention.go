@@ -0,0 +1,32 @@
+package search
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Mentions reports whether content mentions someone as a word of its own, so
+// that mentioning "@jeff" is not found in "@jeffrey" or "bob@jeff.com".
+// Usernames can hold dots, dashes and underscores, which only end a mention
+// when nothing more of a name follows them, as in "thanks @jeff.".
+func Mentions(content, mention string) bool {
+	if mention == "" {
+		return false
+	}
+	for i := 0; ; {
+		at := strings.Index(content[i:], mention)
+		if at < 0 {
+			return false
+		}
+		start, end := i+at, i+at+len(mention)
+		before, _ := utf8.DecodeLastRuneInString(content[:start])
+		if start == 0 || !isTermRune(before) {
+			rest := strings.TrimLeft(content[end:], ".-_")
+			next, _ := utf8.DecodeRuneInString(rest)
+			if rest == "" || !isTermRune(next) {
+				return true
+			}
+		}
+		i = start + 1
+	}
+}
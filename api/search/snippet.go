@@ -0,0 +1,90 @@
+package search
+
+import (
+	"unicode"
+
+	"github.com/intrntsrfr/vue-ws-test/structs"
+)
+
+// snippetRadius is about how many characters of context a snippet keeps on
+// either side of the first match.
+const snippetRadius = 60
+
+// Snippet returns the part of content around the first of the terms in it,
+// split up so that the terms can be highlighted. Content that is cut off is
+// marked with an ellipsis.
+func Snippet(content string, terms []string) []*structs.SnippetPart {
+	wanted := make(map[string]bool)
+	for _, term := range terms {
+		for _, t := range Tokenize(term) {
+			wanted[t] = true
+		}
+	}
+
+	text := []rune(content)
+	type span struct{ start, end int }
+	var matches []span
+	for start := 0; start < len(text); {
+		if !isTermRune(text[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(text) && isTermRune(text[end]) {
+			end++
+		}
+		if terms := Tokenize(string(text[start:end])); len(terms) == 1 && wanted[terms[0]] {
+			matches = append(matches, span{start, end})
+		}
+		start = end
+	}
+	if len(matches) == 0 {
+		return []*structs.SnippetPart{{Text: content}}
+	}
+
+	// keep whole words at the edges
+	from := matches[0].start - snippetRadius
+	if from <= 0 {
+		from = 0
+	} else {
+		for from < matches[0].start && !unicode.IsSpace(text[from-1]) {
+			from++
+		}
+	}
+	to := matches[0].end + snippetRadius
+	if to >= len(text) {
+		to = len(text)
+	} else {
+		for to > matches[0].end && !unicode.IsSpace(text[to]) {
+			to--
+		}
+	}
+
+	var parts []*structs.SnippetPart
+	add := func(s string, highlight bool) {
+		if s != "" {
+			parts = append(parts, &structs.SnippetPart{Text: s, Highlight: highlight})
+		}
+	}
+	if from > 0 {
+		add("…", false)
+	}
+	pos := from
+	for _, m := range matches {
+		if m.start < from || m.end > to {
+			continue
+		}
+		add(string(text[pos:m.start]), false)
+		add(string(text[m.start:m.end]), true)
+		pos = m.end
+	}
+	add(string(text[pos:to]), false)
+	if to < len(text) {
+		add("…", false)
+	}
+	return parts
+}
+
+func isTermRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	s := NewURLSigner([]byte("key"), time.Minute)
+	signed := s.Sign("/api/attachments/1")
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("encountered error: %v", err)
+	}
+	expires, signature := u.Query().Get("expires"), u.Query().Get("signature")
+	if u.Path != "/api/attachments/1" || expires == "" || signature == "" {
+		t.Fatalf("Sign() got %v, wanted the path with an expiry and signature", signed)
+	}
+
+	if !s.Verify("/api/attachments/1", expires, signature) {
+		t.Errorf("Verify() got false for a fresh link")
+	}
+	if s.Verify("/api/attachments/2", expires, signature) {
+		t.Errorf("Verify() got true for another path")
+	}
+	if s.Verify("/api/attachments/1", expires+"0", signature) {
+		t.Errorf("Verify() got true for a changed expiry")
+	}
+	other := NewURLSigner([]byte("other"), time.Minute)
+	if other.Verify("/api/attachments/1", expires, signature) {
+		t.Errorf("Verify() got true for another key")
+	}
+
+	expired := &URLSigner{key: []byte("key"), ttl: -time.Minute}
+	u, _ = url.Parse(expired.Sign("/api/attachments/1"))
+	if s.Verify("/api/attachments/1", u.Query().Get("expires"), u.Query().Get("signature")) {
+		t.Errorf("Verify() got true for an expired link")
+	}
+}
@@ -0,0 +1,57 @@
+package structs
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditAction is a kind of action that is recorded in the audit log
+type AuditAction string
+
+const (
+	AuditLogin       AuditAction = "login"
+	AuditLoginFailed AuditAction = "login_failed"
+	AuditRegister    AuditAction = "register"
+	AuditLogout      AuditAction = "logout"
+
+	AuditKick   AuditAction = "kick"
+	AuditMute   AuditAction = "mute"
+	AuditUnmute AuditAction = "unmute"
+	AuditBan    AuditAction = "ban"
+	AuditUnban  AuditAction = "unban"
+	AuditUnlock AuditAction = "unlock"
+
+	AuditMessageEdit   AuditAction = "message_edit"
+	AuditMessageDelete AuditAction = "message_delete"
+
+	AuditRoleUpdate     AuditAction = "role_update"
+	AuditOverrideUpdate AuditAction = "override_update"
+	AuditOverrideDelete AuditAction = "override_delete"
+)
+
+// AuditTargetType is what kind of thing an action was done to
+type AuditTargetType string
+
+const (
+	AuditTargetUser    AuditTargetType = "user"
+	AuditTargetMessage AuditTargetType = "message"
+	AuditTargetChannel AuditTargetType = "channel"
+)
+
+// AuditEntry records who did what to what, and from where. Entries are never
+// changed or removed once recorded.
+type AuditEntry struct {
+	ID     uuid.UUID   `json:"id"`
+	Action AuditAction `json:"action"`
+	// ActorID is the user who did it, which is nil for failed logins of
+	// users that do not exist
+	ActorID    *uuid.UUID      `json:"actor_id,omitempty"`
+	TargetType AuditTargetType `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	IP         string          `json:"ip"`
+	Timestamp  time.Time       `json:"timestamp"`
+	// Details holds anything else worth knowing about the action, such as
+	// the role a user was given
+	Details map[string]string `json:"details,omitempty"`
+}
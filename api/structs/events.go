@@ -1,9 +1,35 @@
 package structs
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
 // UserReady is data that is sent to the user when the server has loaded their data
 type UserReady struct {
-	Messages []*Message `json:"messages"`
-	Users    []*User    `json:"users"`
+	// SessionID is used to resume the session after reconnecting
+	SessionID string     `json:"session_id"`
+	Channels  []*Channel `json:"channels"`
+	Messages  []*Message `json:"messages"`
+	// Users are the other users that share a channel with the user and are
+	// not offline, with their statuses in Presences
+	Users     []*User           `json:"users"`
+	Presences []*PresenceUpdate `json:"presences"`
+	// Status is the status of the user themselves, which may be invisible
+	Status Status `json:"status"`
+	// ReadStates are where the user left off in their channels, and Unread
+	// how much was sent in them since
+	ReadStates []*ReadState   `json:"read_states"`
+	Unread     []*UnreadCount `json:"unread"`
+}
+
+// UnreadCount is how many messages in a channel a user has not read, and how
+// many of those mention them
+type UnreadCount struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	Count     int       `json:"count"`
+	Mentions  int       `json:"mentions"`
 }
 
 // UserJoin is the data to be sent when a user joins
@@ -16,7 +42,102 @@ type UserLeave struct {
 	*User `json:"user"`
 }
 
+// UserUpdate is the data to be sent when a user is changed, such as when they
+// are given another role
+type UserUpdate struct {
+	*User `json:"user"`
+}
+
+// PresenceUpdate is the data to be sent when the status of a user changes.
+// A user going invisible shows up as offline to everyone but themselves.
+type PresenceUpdate struct {
+	User   *User  `json:"user"`
+	Status Status `json:"status"`
+}
+
+// ReadStateUpdate is the data to be sent to the other sessions of a user
+// when they read further in a channel
+type ReadStateUpdate struct {
+	*ReadState `json:"read_state"`
+}
+
 // UserMessage is the data to be sent when a user sends a message
 type UserMessage struct {
 	*Message `json:"message"`
 }
+
+// MessageUpdate is the data to be sent when a message is edited
+type MessageUpdate struct {
+	*Message `json:"message"`
+}
+
+// MessageDelete is the data to be sent when a message is deleted
+type MessageDelete struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+// TypingStart is the data to be sent when a user starts typing in a channel
+type TypingStart struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	User      *User     `json:"user"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TypingStop is the data to be sent when a user stops typing, either by
+// sending their message or by letting the indicator expire
+type TypingStop struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	User      *User     `json:"user"`
+}
+
+// ReactionAdd is the data to be sent when a user reacts to a message
+type ReactionAdd struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	MessageID uuid.UUID `json:"message_id"`
+	Emoji     string    `json:"emoji"`
+	User      *User     `json:"user"`
+}
+
+// ReactionRemove is the data to be sent when a user removes their reaction
+type ReactionRemove struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	MessageID uuid.UUID `json:"message_id"`
+	Emoji     string    `json:"emoji"`
+	User      *User     `json:"user"`
+}
+
+// ChannelCreate is the data to be sent when a channel is created. Recipients
+// are only set for private conversations.
+type ChannelCreate struct {
+	*Channel   `json:"channel"`
+	Recipients []*User `json:"recipients,omitempty"`
+}
+
+// Conversation is a private channel along with the users in it
+type Conversation struct {
+	*Channel   `json:"channel"`
+	Recipients []*User `json:"recipients"`
+}
+
+// ChannelUpdate is the data to be sent when a channel is changed
+type ChannelUpdate struct {
+	*Channel `json:"channel"`
+}
+
+// ChannelDelete is the data to be sent when a channel is deleted
+type ChannelDelete struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+}
+
+// ChannelMemberAdd is the data to be sent when a user joins a channel
+type ChannelMemberAdd struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	User      *User     `json:"user"`
+}
+
+// ChannelMemberRemove is the data to be sent when a user leaves a channel
+type ChannelMemberRemove struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	User      *User     `json:"user"`
+}
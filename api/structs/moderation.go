@@ -0,0 +1,34 @@
+package structs
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SanctionType is what a sanction keeps a user from doing
+type SanctionType string
+
+const (
+	// SanctionBan keeps a user from logging in or connecting
+	SanctionBan SanctionType = "ban"
+	// SanctionMute keeps a user from sending messages
+	SanctionMute SanctionType = "mute"
+)
+
+// Sanction is a ban or mute put on a user by a moderator. A user has at most
+// one of each type.
+type Sanction struct {
+	UserID      uuid.UUID    `json:"user_id"`
+	Type        SanctionType `json:"type"`
+	ModeratorID uuid.UUID    `json:"moderator_id"`
+	Reason      string       `json:"reason,omitempty"`
+	Created     time.Time    `json:"created"`
+	// Expires is when the sanction is lifted, or nil if it never is
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Active reports whether the sanction still applies at t.
+func (s *Sanction) Active(t time.Time) bool {
+	return s.Expires == nil || t.Before(*s.Expires)
+}
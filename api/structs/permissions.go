@@ -0,0 +1,122 @@
+package structs
+
+// Role is how far a user is trusted across the server
+type Role string
+
+const (
+	// RoleOwner can do everything, and is given to the first user
+	RoleOwner     Role = "owner"
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	// RoleMember is what everyone else has, including users stored before
+	// roles existed
+	RoleMember Role = "member"
+)
+
+// Permissions is a set of things a user is allowed to do
+type Permissions uint64
+
+const (
+	PermSendMessages Permissions = 1 << iota
+	PermAddReactions
+	PermCreateChannels
+	// PermManageMessages allows deleting the messages of others
+	PermManageMessages
+	// PermManageChannels allows changing and deleting channels made by others,
+	// and their permission overrides
+	PermManageChannels
+	PermModerateMembers
+	PermManageRoles
+	PermViewAuditLog
+	// PermAdministrator allows everything, and can not be taken away by
+	// overrides
+	PermAdministrator
+)
+
+var rolePermissions = map[Role]Permissions{
+	RoleOwner: PermAdministrator,
+	RoleAdmin: PermAdministrator,
+	RoleModerator: PermSendMessages | PermAddReactions | PermCreateChannels |
+		PermManageMessages | PermModerateMembers,
+	RoleMember: PermSendMessages | PermAddReactions | PermCreateChannels,
+}
+
+var roleRanks = map[Role]int{
+	RoleMember:    0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+	RoleOwner:     3,
+}
+
+// Valid reports whether r is one of the roles.
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Rank orders roles by how far they are trusted. Users can only manage those
+// of a lower rank.
+func (r Role) Rank() int {
+	return roleRanks[r.orMember()]
+}
+
+// Permissions returns what a role is allowed to do outside of any channel.
+func (r Role) Permissions() Permissions {
+	return rolePermissions[r.orMember()]
+}
+
+func (r Role) orMember() Role {
+	if !r.Valid() {
+		return RoleMember
+	}
+	return r
+}
+
+// Has reports whether p includes every permission in want. Administrators
+// have every permission.
+func (p Permissions) Has(want Permissions) bool {
+	return p&PermAdministrator != 0 || p&want == want
+}
+
+// PermissionOverride changes what a role is allowed to do in one channel
+type PermissionOverride struct {
+	Role  Role        `json:"role"`
+	Allow Permissions `json:"allow"`
+	Deny  Permissions `json:"deny"`
+}
+
+// PermissionsFor returns what a role is allowed to do in the channel, after
+// its override.
+func (c *Channel) PermissionsFor(r Role) Permissions {
+	perms := r.Permissions()
+	if perms.Has(PermAdministrator) {
+		return perms
+	}
+	for _, o := range c.Overrides {
+		if o.Role.orMember() == r.orMember() {
+			perms = perms&^o.Deny | o.Allow&^PermAdministrator
+		}
+	}
+	return perms
+}
+
+// SetOverride replaces the override for a role, or removes it if it neither
+// allows nor denies anything.
+func (c *Channel) SetOverride(override *PermissionOverride) {
+	overrides := make([]*PermissionOverride, 0, len(c.Overrides)+1)
+	for _, o := range c.Overrides {
+		if o.Role != override.Role {
+			overrides = append(overrides, o)
+		}
+	}
+	if override.Allow != 0 || override.Deny != 0 {
+		overrides = append(overrides, override)
+	}
+	c.Overrides = overrides
+}
+
+// CanManage reports whether u ranks above other, which it takes to change
+// their role or moderate them. Nobody can manage themselves.
+func (u *User) CanManage(other *User) bool {
+	return u.ID != other.ID && u.Role.Rank() > other.Role.Rank()
+}
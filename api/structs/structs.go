@@ -8,10 +8,46 @@ import (
 // Message represents a message sent over the websocket
 type Message struct {
 	ID        uuid.UUID   `json:"id"`
+	ChannelID uuid.UUID   `json:"channel_id"`
 	Author    *User       `json:"author"`
 	Content   string      `json:"content"`
 	Timestamp time.Time   `json:"timestamp"`
 	Reactions []*Reaction `json:"reactions,omitempty"`
+	// EditedTimestamp is when the message was last edited, if ever
+	EditedTimestamp *time.Time `json:"edited_timestamp,omitempty"`
+	// History holds what the message said before each edit, oldest first
+	History     []*MessageRevision `json:"history,omitempty"`
+	Attachments []*Attachment      `json:"attachments,omitempty"`
+}
+
+// Attachment is a file uploaded to a channel, to be sent along with a message
+type Attachment struct {
+	ID          uuid.UUID `json:"id"`
+	ChannelID   uuid.UUID `json:"channel_id"`
+	UploaderID  uuid.UUID `json:"uploader_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	// Width and Height are only set for images, which also have a thumbnail
+	Width   int       `json:"width,omitempty"`
+	Height  int       `json:"height,omitempty"`
+	Created time.Time `json:"created"`
+	// URL and ThumbnailURL are links to download the attachment with, which
+	// expire. They are filled in whenever the attachment is sent out, and
+	// never stored.
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// IsImage reports whether the attachment is an image with a thumbnail
+func (a *Attachment) IsImage() bool {
+	return a.Width > 0 && a.Height > 0
+}
+
+// MessageRevision is what a message said up until it was edited
+type MessageRevision struct {
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type Messages []*Message
@@ -21,18 +57,122 @@ func (m Messages) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
 
 type ByTime struct{ Messages }
 
-func (m ByTime) Less(i, j int) bool { return m.Messages[i].Timestamp.Before(m.Messages[j].Timestamp) }
+// Less orders messages by timestamp, falling back to the ID so that messages
+// sent at the same instant still have a stable order.
+func (m ByTime) Less(i, j int) bool {
+	if m.Messages[i].Timestamp.Equal(m.Messages[j].Timestamp) {
+		return m.Messages[i].ID.String() < m.Messages[j].ID.String()
+	}
+	return m.Messages[i].Timestamp.Before(m.Messages[j].Timestamp)
+}
 
-// Reaction represents a message reaction
+// Reaction represents a message reaction. Emoji is a string rather than a
+// rune, as many emojis are made up of several code points.
 type Reaction struct {
-	Emoji rune    `json:"emoji"`
+	Emoji string  `json:"emoji"`
 	Users []*User `json:"users"`
 }
 
+type ChannelType int
+
+const (
+	// ChannelTypeText is a public channel anyone can join
+	ChannelTypeText ChannelType = iota
+	// ChannelTypeDM is a private conversation between two users
+	ChannelTypeDM
+	// ChannelTypeGroup is a private conversation between a few users
+	ChannelTypeGroup
+)
+
+// Channel represents a channel that users can join and send messages in
+type Channel struct {
+	ID      uuid.UUID   `json:"id"`
+	Type    ChannelType `json:"type"`
+	Name    string      `json:"name"`
+	Topic   string      `json:"topic"`
+	OwnerID uuid.UUID   `json:"owner_id"`
+	Created time.Time   `json:"created"`
+	// Overrides change what roles are allowed to do in the channel
+	Overrides []*PermissionOverride `json:"overrides,omitempty"`
+}
+
+// Private reports whether the channel is a conversation that only its
+// members can see.
+func (c *Channel) Private() bool {
+	return c.Type != ChannelTypeText
+}
+
+// RefreshToken represents a refresh token handed out to a user. Only a hash
+// of the token itself is kept.
+type RefreshToken struct {
+	Hash    string    `json:"hash"`
+	UserID  uuid.UUID `json:"user_id"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// ReadState is the last message a user has read in a channel
+type ReadState struct {
+	UserID    uuid.UUID `json:"user_id"`
+	ChannelID uuid.UUID `json:"channel_id"`
+	MessageID uuid.UUID `json:"message_id"`
+	// Timestamp is when the message was sent, which everything sent after
+	// counts as unread from
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// SearchResults is a page of the messages matching a search, along with how
+// many match in total
+type SearchResults struct {
+	Total int          `json:"total"`
+	Hits  []*SearchHit `json:"hits"`
+}
+
+// SearchHit is a message matching a search, with the part of it that matched
+type SearchHit struct {
+	Message *Message       `json:"message"`
+	Snippet []*SnippetPart `json:"snippet"`
+}
+
+// SnippetPart is a piece of a snippet, which is highlighted if it is one of
+// the terms that were searched for
+type SnippetPart struct {
+	Text      string `json:"text"`
+	Highlight bool   `json:"highlight,omitempty"`
+}
+
 // User represents a user
 type User struct {
 	ID       uuid.UUID `json:"id"`
 	Username string    `json:"username"`
 	Password string    `json:"password,omitempty"`
 	Created  time.Time `json:"created"`
+	Role     Role      `json:"role,omitempty"`
+}
+
+// Status is how present a user appears to be
+type Status string
+
+const (
+	StatusOnline Status = "online"
+	// StatusIdle is set by the server when none of the sessions of a user have
+	// been active for a while, but can also be chosen
+	StatusIdle Status = "idle"
+	// StatusDND means do not disturb
+	StatusDND Status = "dnd"
+	// StatusInvisible is chosen by users who want to appear offline. Other
+	// users never see it.
+	StatusInvisible Status = "invisible"
+	// StatusOffline is what users without any sessions appear as. It can not
+	// be chosen.
+	StatusOffline Status = "offline"
+)
+
+// Settable reports whether users can choose the status themselves.
+func (s Status) Settable() bool {
+	switch s {
+	case StatusOnline, StatusIdle, StatusDND, StatusInvisible:
+		return true
+	}
+	return false
 }
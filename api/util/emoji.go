@@ -0,0 +1,102 @@
+package util
+
+import "unicode/utf8"
+
+const (
+	zwj               = '\u200D'
+	variationSelector = '\uFE0F'
+	keycap            = '\u20E3'
+	tagCancel         = '\U000E007F'
+)
+
+// emojiRanges holds the code point ranges that may start an emoji. It is
+// deliberately coarse; anything inside the pictographic blocks is accepted.
+var emojiRanges = [][2]rune{
+	{0x00A9, 0x00A9}, {0x00AE, 0x00AE}, {0x203C, 0x203C}, {0x2049, 0x2049},
+	{0x2122, 0x2122}, {0x2139, 0x2139}, {0x2194, 0x2199}, {0x21A9, 0x21AA},
+	{0x231A, 0x231B}, {0x2328, 0x2328}, {0x23CF, 0x23CF}, {0x23E9, 0x23F3},
+	{0x23F8, 0x23FA}, {0x24C2, 0x24C2}, {0x25AA, 0x25AB}, {0x25B6, 0x25B6},
+	{0x25C0, 0x25C0}, {0x25FB, 0x25FE}, {0x2600, 0x27BF}, {0x2934, 0x2935},
+	{0x2B05, 0x2B07}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x3030, 0x3030}, {0x303D, 0x303D}, {0x3297, 0x3297}, {0x3299, 0x3299},
+	{0x1F000, 0x1F1E5}, {0x1F200, 0x1F3FA}, {0x1F400, 0x1FAFF},
+}
+
+func isEmojiBase(r rune) bool {
+	for _, rng := range emojiRanges {
+		if r >= rng[0] && r <= rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool { return r >= 0x1F1E6 && r <= 0x1F1FF }
+func isModifier(r rune) bool          { return r >= 0x1F3FB && r <= 0x1F3FF }
+func isTag(r rune) bool               { return r >= 0xE0020 && r <= 0xE007E }
+func isKeycapBase(r rune) bool        { return r == '#' || r == '*' || (r >= '0' && r <= '9') }
+
+// IsEmoji reports whether s is exactly one emoji. Multi code point sequences
+// such as flags, keycaps, skin tones, tag sequences and ZWJ sequences are
+// accepted as long as the whole string forms a single emoji.
+func IsEmoji(s string) bool {
+	if s == "" || !utf8.ValidString(s) {
+		return false
+	}
+	rs := []rune(s)
+
+	// flags are a pair of regional indicators and nothing else
+	if isRegionalIndicator(rs[0]) {
+		return len(rs) == 2 && isRegionalIndicator(rs[1])
+	}
+
+	// keycaps are a digit, # or * followed by an optional VS16 and U+20E3
+	if isKeycapBase(rs[0]) {
+		switch len(rs) {
+		case 2:
+			return rs[1] == keycap
+		case 3:
+			return rs[1] == variationSelector && rs[2] == keycap
+		}
+		return false
+	}
+
+	i := 0
+	for {
+		n, ok := emojiElement(rs[i:])
+		if !ok {
+			return false
+		}
+		i += n
+		if i == len(rs) {
+			return true
+		}
+		// tag sequences (subdivision flags) must end the emoji
+		if isTag(rs[i]) {
+			for i < len(rs) && isTag(rs[i]) {
+				i++
+			}
+			return i == len(rs)-1 && rs[i] == tagCancel
+		}
+		if rs[i] != zwj || i+1 == len(rs) {
+			return false
+		}
+		i++
+	}
+}
+
+// emojiElement consumes a single emoji with its optional presentation
+// selector or skin tone modifier, returning how many runes were used.
+func emojiElement(rs []rune) (int, bool) {
+	if len(rs) == 0 || !isEmojiBase(rs[0]) {
+		return 0, false
+	}
+	n := 1
+	if n < len(rs) && rs[n] == variationSelector {
+		n++
+	}
+	if n < len(rs) && isModifier(rs[n]) {
+		n++
+	}
+	return n, true
+}
@@ -0,0 +1,39 @@
+package util
+
+import "testing"
+
+func TestIsEmoji(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want bool
+	}{
+		{"empty", "", false},
+		{"plain text", "a", false},
+		{"two emojis", "😀😀", false},
+		{"emoji with text", "😀a", false},
+		{"single", "😀", true},
+		{"text presentation", "❤", true},
+		{"emoji presentation", "❤️", true},
+		{"skin tone", "👍🏽", true},
+		{"lone skin tone", "🏽", false},
+		{"flag", "🇳🇴", true},
+		{"half a flag", "🇳", false},
+		{"keycap", "1️⃣", true},
+		{"keycap without selector", "#⃣", true},
+		{"digit", "1", false},
+		{"zwj family", "👨‍👩‍👧‍👦", true},
+		{"zwj with skin tones", "🧑🏻‍🤝‍🧑🏿", true},
+		{"trailing zwj", "👨‍", false},
+		{"tag sequence", "🏴󠁧󠁢󠁳󠁣󠁴󠁿", true},
+		{"unterminated tag sequence", "🏴󠁧󠁢󠁳󠁣󠁴", false},
+		{"invalid utf8", "\xff", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsEmoji(tt.in); got != tt.want {
+				t.Errorf("IsEmoji(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		w, h         int
+		wantW, wantH int
+	}{
+		{400, 200, 100, 50},
+		{200, 400, 50, 100},
+		{50, 20, 50, 20},
+		{1000, 1, 100, 1},
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(10, 10, 10+tt.w, 10+tt.h))
+		got := Thumbnail(img, 100).Bounds()
+		if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+			t.Errorf("Thumbnail() of %vx%v got %vx%v, wanted %vx%v", tt.w, tt.h, got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+
+	// a black and white checkerboard averages out to grey
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	r, _, _, _ := Thumbnail(img, 2).At(0, 0).RGBA()
+	if r>>8 != 127 {
+		t.Errorf("Thumbnail() pixel got %v, wanted 127", r>>8)
+	}
+}
@@ -8,7 +8,8 @@ enum OpCode {
     Ping,
     PingACK,
     Action,
-    Error
+    Error,
+    Hello
 }
 
 enum ActionCode {
@@ -38,6 +39,10 @@ interface PingData {
     sequence: number
 }
 
+interface HelloData {
+    heartbeat_interval: number
+}
+
 interface ErrorData {
     code: ErrorCode
     message: string
@@ -73,6 +78,7 @@ export const useSocketStore = defineStore('socket', () => {
     const username = ref('')
     const state = reactive<SocketState>(defaultState())
     const pingInterval = ref<number | null>(null)
+    const pingSequence = ref(0)
 
     const connect = () => {
         if (!authStore.loggedIn) return
@@ -86,10 +92,6 @@ export const useSocketStore = defineStore('socket', () => {
                     action: ActionCode.None
                 } as SocketEvent)
             )
-
-            pingInterval.value = setInterval(() => {
-                console.log('weed')
-            }, 5000)
         }
 
         ws.onerror = () => {
@@ -117,6 +119,9 @@ export const useSocketStore = defineStore('socket', () => {
             case OpCode.Error:
                 handleError(evt.data as ErrorData)
                 break
+            case OpCode.Hello:
+                handleHello(evt.data as HelloData)
+                break
 
             default:
                 break
@@ -159,6 +164,21 @@ export const useSocketStore = defineStore('socket', () => {
         state.messages = [...state.messages, evt.message as Message]
     }
 
+    const handleHello = (data: HelloData) => {
+        if (pingInterval.value) clearInterval(pingInterval.value)
+        pingInterval.value = setInterval(() => {
+            if (!socket.value) return
+            pingSequence.value++
+            socket.value.send(
+                JSON.stringify({
+                    op: OpCode.Ping,
+                    data: { sequence: pingSequence.value } as PingData,
+                    action: ActionCode.None
+                } as SocketEvent)
+            )
+        }, data.heartbeat_interval)
+    }
+
     const handleError = (data: ErrorData) => {
         authStore.logout()
         disconnect()
@@ -166,7 +186,9 @@ export const useSocketStore = defineStore('socket', () => {
 
     const disconnect = () => {
         socket.value = null
+        if (pingInterval.value) clearInterval(pingInterval.value)
         pingInterval.value = null
+        pingSequence.value = 0
         Object.assign(state, defaultState())
     }
 